@@ -0,0 +1,127 @@
+package ssp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"sync"
+)
+
+// ErrDecrypt is returned when a value can't be decrypted because
+// it was tampered with or its key isn't in the key ring
+var ErrDecrypt = fmt.Errorf("Decrypt Failed")
+
+// AEADKeyRing seals values with AES-256-GCM under one of several keys.
+// Sealed values are prefixed with the ID of their key so keys can be
+// rotated: add a new key, activate it, and retire the old key once
+// no values sealed with it are still needed.
+type AEADKeyRing struct {
+	keys      map[byte]cipher.AEAD
+	activeKey byte
+	mutex     sync.RWMutex
+}
+
+// NewAEADKeyRing creates a key ring with a single 32 byte key
+// that's active for sealing new values
+func NewAEADKeyRing(keyID byte, key []byte) (*AEADKeyRing, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &AEADKeyRing{
+		keys:      map[byte]cipher.AEAD{keyID: aead},
+		activeKey: keyID,
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("AEAD key must be 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// AddKey registers a new 32 byte key. Values sealed with it can be
+// opened immediately but it isn't used for sealing until it's activated.
+func (kr *AEADKeyRing) AddKey(keyID byte, key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+	if _, ok := kr.keys[keyID]; ok {
+		return fmt.Errorf("key %d already exists", keyID)
+	}
+	kr.keys[keyID] = aead
+	return nil
+}
+
+// ActivateKey sets the key that's used to seal new values
+func (kr *AEADKeyRing) ActivateKey(keyID byte) error {
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+	if _, ok := kr.keys[keyID]; !ok {
+		return fmt.Errorf("unknown key %d", keyID)
+	}
+	kr.activeKey = keyID
+	return nil
+}
+
+// RetireKey removes a key so values sealed with it can no longer
+// be opened. The active key can't be retired.
+func (kr *AEADKeyRing) RetireKey(keyID byte) error {
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+	if _, ok := kr.keys[keyID]; !ok {
+		return fmt.Errorf("unknown key %d", keyID)
+	}
+	if keyID == kr.activeKey {
+		return fmt.Errorf("can't retire the active key %d", keyID)
+	}
+	delete(kr.keys, keyID)
+	return nil
+}
+
+// Seal encrypts and authenticates plaintext with the active key. The
+// additional data is authenticated but not stored; the same value must
+// be passed to Open. The result is key ID | nonce | ciphertext.
+func (kr *AEADKeyRing) Seal(plaintext, additionalData []byte) ([]byte, error) {
+	kr.mutex.RLock()
+	keyID := kr.activeKey
+	aead := kr.keys[keyID]
+	kr.mutex.RUnlock()
+
+	sealed := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	sealed[0] = keyID
+	_, err := rand.Read(sealed[1:])
+	if err != nil {
+		return nil, fmt.Errorf("error reading random bytes: %v", err)
+	}
+	return aead.Seal(sealed, sealed[1:], plaintext, additionalData), nil
+}
+
+// Open decrypts a value from Seal. It returns ErrDecrypt if the value
+// was modified, the additional data doesn't match or the key is unknown.
+func (kr *AEADKeyRing) Open(sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) == 0 {
+		return nil, ErrDecrypt
+	}
+	kr.mutex.RLock()
+	aead, ok := kr.keys[sealed[0]]
+	kr.mutex.RUnlock()
+	if !ok || len(sealed) < 1+aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce := sealed[1 : 1+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, sealed[1+aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,68 @@
+package ssp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testAEADKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestAEADKeyRingRotation(t *testing.T) {
+	if _, err := NewAEADKeyRing(1, []byte("short")); err == nil {
+		t.Fatalf("Accepted short key")
+	}
+	kr, err := NewAEADKeyRing(1, testAEADKey(1))
+	if err != nil {
+		t.Fatalf("Failed creating key ring: %v", err)
+	}
+	old, _ := kr.Seal([]byte("old"), []byte("aad"))
+
+	if err := kr.AddKey(2, testAEADKey(2)); err != nil {
+		t.Fatalf("Failed add: %v", err)
+	}
+	if err := kr.AddKey(2, testAEADKey(2)); err == nil {
+		t.Fatalf("Added duplicate key")
+	}
+	if err := kr.RetireKey(1); err == nil {
+		t.Fatalf("Retired the active key")
+	}
+	if err := kr.ActivateKey(2); err != nil {
+		t.Fatalf("Failed activate: %v", err)
+	}
+	current, _ := kr.Seal([]byte("new"), []byte("aad"))
+	if current[0] != 2 {
+		t.Fatalf("Sealed with wrong key %d", current[0])
+	}
+
+	for sealed, expected := range map[string]string{string(old): "old", string(current): "new"} {
+		plaintext, err := kr.Open([]byte(sealed), []byte("aad"))
+		if err != nil || string(plaintext) != expected {
+			t.Fatalf("Failed open: %q %v", plaintext, err)
+		}
+	}
+
+	if err := kr.RetireKey(1); err != nil {
+		t.Fatalf("Failed retire: %v", err)
+	}
+	if _, err := kr.Open(old, []byte("aad")); err != ErrDecrypt {
+		t.Fatalf("Opened value from retired key: %v", err)
+	}
+}
+
+func TestAEADKeyRingRejects(t *testing.T) {
+	kr, _ := NewAEADKeyRing(1, testAEADKey(1))
+	sealed, _ := kr.Seal([]byte("value"), []byte("aad"))
+
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+	for _, bad := range [][]byte{tampered, sealed[:5], nil} {
+		if _, err := kr.Open(bad, []byte("aad")); err != ErrDecrypt {
+			t.Errorf("Expected decrypt error but got %v", err)
+		}
+	}
+	if _, err := kr.Open(sealed, []byte("other")); err != ErrDecrypt {
+		t.Errorf("Opened with wrong additional data: %v", err)
+	}
+}
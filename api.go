@@ -12,8 +12,12 @@
 package ssp
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"time"
@@ -34,11 +38,53 @@ type Tree interface {
 	Nut() (Nut, error)
 }
 
+// RemoteIPTree is an optional interface for a Tree that
+// embeds the requester's IP address in the Nuts it produces.
+// If implemented, it's used in place of Tree.Nut
+type RemoteIPTree interface {
+	NutForIP(remoteIP string) (Nut, error)
+}
+
+// NutVerifier is an optional interface for a Tree that can
+// cheaply check whether a Nut is one it produced and is not expired.
+// If implemented, Nuts are verified before they're looked up in the Hoard.
+type NutVerifier interface {
+	Verify(nut Nut) error
+}
+
+// NutExpirationVerifier is an optional interface for a NutVerifier
+// that checks a Nut's age against SqrlSspAPI.NutExpiration. If
+// implemented, it's used in place of Verify so the expiration
+// doesn't need to be configured twice.
+type NutExpirationVerifier interface {
+	VerifyExpiration(nut Nut, expiration time.Duration) error
+}
+
+// nuts with an embedded time are allowed to be this
+// far in the future to allow for clock skew between servers
+const nutMaxClockSkew = time.Minute
+
 // ErrNotFound specific error returned if a Hoard
 // or identity isn't found. This is to differentiate
 // from more serious errors at the storage level
 var ErrNotFound = fmt.Errorf("Not Found")
 
+// ErrNotSupported is returned when an optional interface
+// isn't implemented by the underlying storage
+var ErrNotSupported = fmt.Errorf("Not Supported")
+
+// ErrHoardFull is returned by a Hoard that has reached its
+// capacity. The API responds with 503 Service Unavailable.
+var ErrHoardFull = fmt.Errorf("Hoard Full")
+
+// ErrInvalidNut is returned by a NutVerifier if a Nut
+// wasn't produced by the Tree
+var ErrInvalidNut = fmt.Errorf("Invalid Nut")
+
+// ErrExpiredNut is returned by a NutVerifier if a Nut
+// is older than it's expiration
+var ErrExpiredNut = fmt.Errorf("Expired Nut")
+
 // Hoard stores Nuts for later use
 type Hoard interface {
 	Get(nut Nut) (*HoardCache, error)
@@ -52,6 +98,7 @@ type HoardCache struct {
 	RemoteIP     string        `json:"remoteIP"`
 	OriginalNut  Nut           `json:"originalNut"`
 	PagNut       Nut           `json:"pagNut"`
+	Sin          string        `json:"sin,omitempty"`
 	LastRequest  *CliRequest   `json:"lastRequest"`
 	Identity     *SqrlIdentity `json:"identity"`
 	LastResponse []byte        `json:"lastResponse"`
@@ -70,6 +117,11 @@ type SqrlIdentity struct {
 	// Btn is filled in if the request includes a button press response from an
 	// ask. -1 if there's no value.
 	Btn int `json:"-" sql:"-"`
+	// Ins and Pins are filled in if the Nut was requested with a secure
+	// index (sin) and the client responded with it's index values.
+	// These are per-request and are not stored.
+	Ins  string `json:"ins,omitempty" sql:"-"`
+	Pins string `json:"pins,omitempty" sql:"-"`
 }
 
 // Authenticator interface to allow user management triggered by
@@ -78,8 +130,11 @@ type Authenticator interface {
 	// Called when a SQRL identity has been successfully authenticated. It
 	// should return a URL that will finish authentication to create a
 	// logged in session. This is also called for a new user.
+	// If the nut was issued with a secure index, the identity
+	// has Ins (and Pins if there's a previous identity) set.
 	// If an error occurs this should return an error
-	// page redirection
+	// page redirection or the Authenticator should
+	// implement AuthenticatorWithError
 	AuthenticateIdentity(identity *SqrlIdentity) string
 	// When an identity is rekeyed, it's necessary to swap the identity
 	// associated with a given user. This callback happens when a user
@@ -106,6 +161,40 @@ type AuthStore interface {
 	DeleteIdentity(idk string) error
 }
 
+// IdentityFilter selects identities to list. Nil fields match any value.
+type IdentityFilter struct {
+	Disabled *bool
+	// Rekeyed matches identities that have (or haven't) been rekeyed
+	Rekeyed  *bool
+	SQRLOnly *bool
+}
+
+// Matches returns true if identity is selected by the filter
+func (f IdentityFilter) Matches(identity *SqrlIdentity) bool {
+	if f.Disabled != nil && *f.Disabled != identity.Disabled {
+		return false
+	}
+	if f.Rekeyed != nil && *f.Rekeyed != (identity.Rekeyed != "") {
+		return false
+	}
+	if f.SQRLOnly != nil && *f.SQRLOnly != identity.SQRLOnly {
+		return false
+	}
+	return true
+}
+
+// IdentityLister is an optional interface for an AuthStore
+// that can enumerate and search identities for admin tools.
+type IdentityLister interface {
+	// ListIdentities returns up to limit identities matching filter
+	// ordered by Idk, starting after the Idk in after. Pass the last
+	// Idk of a page as after to get the next page.
+	ListIdentities(filter IdentityFilter, after string, limit int) ([]*SqrlIdentity, error)
+	// FindIdentitiesByPidk returns the identities that have pidk
+	// as their previous identity
+	FindIdentitiesByPidk(pidk string) ([]*SqrlIdentity, error)
+}
+
 // SqrlSspAPI implements the endpoitns outlined here
 // https://www.grc.com/sqrl/sspapi.htm
 type SqrlSspAPI struct {
@@ -118,6 +207,40 @@ type SqrlSspAPI struct {
 	// if the SQRL endpoints are not at the root of the host, then this overrides the path where they are hosted
 	RootPath      string
 	Authenticator Authenticator
+	// MaxNutsPerIP limits the nuts /nut.sqrl and /png.sqrl create for one
+	// IP in each NutExpiration so a client calling them in a loop can't
+	// fill the Hoard. Requests over the limit get 429 Too Many Requests.
+	// Zero or less is unlimited.
+	//
+	// Behind a reverse proxy or load balancer, set TrustedIP too. By
+	// default every request comes from the proxy's address so all the
+	// clients share one limit and a single client can lock out the rest.
+	MaxNutsPerIP int
+	// TrustedIP gets the IP that MaxNutsPerIP is counted against. It
+	// defaults to RemoteAddrIP since X-Forwarded-For is set by the client
+	// unless a proxy replaces it. Behind a proxy, set it to read the
+	// address the proxy adds.
+	TrustedIP func(r *http.Request) string
+
+	// the default Tree created by NewSqrlSspAPI
+	ownedTree Tree
+	nutQuota  ipQuota
+}
+
+// Close implements io.Closer. It stops the background work of the
+// default Tree created when nil is passed to NewSqrlSspAPI. The Tree,
+// Hoard and AuthStore passed to NewSqrlSspAPI are owned by the caller,
+// who must close them since they may be shared with other APIs.
+func (api *SqrlSspAPI) Close() error {
+	return closeIfCloser(api.ownedTree)
+}
+
+// closeIfCloser closes value if it implements io.Closer
+func closeIfCloser(value interface{}) error {
+	if closer, ok := value.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
 }
 
 // NutExpirationSeconds has a self-explanatory name
@@ -128,9 +251,13 @@ func (api *SqrlSspAPI) NutExpirationSeconds() int {
 // NewSqrlSspAPI takes a Tree implementation that produces Nuts.
 // If set to nil, a the API defaults to NewRandomTree(8).
 // Also needs a Hoard to store a retrieve Nuts
+// Only the default Tree is closed by SqrlSspAPI.Close; the caller
+// still owns and must close the rest.
 func NewSqrlSspAPI(tree Tree, hoard Hoard, authenticator Authenticator, authStore AuthStore) *SqrlSspAPI {
+	var ownedTree Tree
 	if tree == nil {
 		tree, _ = NewRandomTree(8)
+		ownedTree = tree
 	}
 	return &SqrlSspAPI{
 		tree:          tree,
@@ -138,6 +265,8 @@ func NewSqrlSspAPI(tree Tree, hoard Hoard, authenticator Authenticator, authStor
 		NutExpiration: 10 * time.Minute,
 		Authenticator: authenticator,
 		authStore:     authStore,
+		TrustedIP:     RemoteAddrIP,
+		ownedTree:     ownedTree,
 	}
 }
 
@@ -157,26 +286,42 @@ func (api *SqrlSspAPI) Host(r *http.Request) string {
 	return host
 }
 
-func (api *SqrlSspAPI) swapIdentities(previousIdentity, newIdentity *SqrlIdentity) error {
-	err := api.Authenticator.SwapIdentities(previousIdentity, newIdentity)
+func (api *SqrlSspAPI) swapIdentities(ctx context.Context, previousIdentity, newIdentity *SqrlIdentity) error {
+	err := ContextAuthenticator(api.Authenticator).SwapIdentitiesContext(ctx, previousIdentity, newIdentity)
 	if err != nil {
 		return err
 	}
 	previousIdentity.Rekeyed = newIdentity.Idk
-	return api.authStore.SaveIdentity(previousIdentity)
+	return ContextAuthStore(api.authStore).SaveIdentityContext(ctx, previousIdentity)
 }
 
-func (api *SqrlSspAPI) removeIdentity(identity *SqrlIdentity) error {
-	err := api.Authenticator.RemoveIdentity(identity)
+func (api *SqrlSspAPI) removeIdentity(ctx context.Context, identity *SqrlIdentity) error {
+	err := ContextAuthenticator(api.Authenticator).RemoveIdentityContext(ctx, identity)
 	if err != nil {
 		return err
 	}
-	return api.authStore.DeleteIdentity(identity.Idk)
+	return ContextAuthStore(api.authStore).DeleteIdentityContext(ctx, identity.Idk)
 }
 
-func (api *SqrlSspAPI) authenticateIdentity(identity *SqrlIdentity, btn int) (string, error) {
-	redirect := api.Authenticator.AuthenticateIdentity(identity)
-	return redirect, api.authStore.SaveIdentity(identity)
+// authenticateIdentity only swaps out previousIdentity, if there is one,
+// and saves the identity if the Authenticator accepts it
+func (api *SqrlSspAPI) authenticateIdentity(ctx context.Context, identity, previousIdentity *SqrlIdentity) (string, error) {
+	redirect, err := api.authenticate(ctx, identity)
+	if err != nil {
+		return "", err
+	}
+	if previousIdentity != nil {
+		err = api.swapIdentities(ctx, previousIdentity, identity)
+		if err != nil {
+			return "", fmt.Errorf("failed swapping identities: %v", err)
+		}
+		log.Printf("Swapped identity %#v for %#v", previousIdentity, identity)
+	}
+	err = ContextAuthStore(api.authStore).SaveIdentityContext(ctx, identity)
+	if err != nil {
+		return "", fmt.Errorf("failed saving identity: %v", err)
+	}
+	return redirect, nil
 }
 
 // HTTPSRoot returns the best guess at the https root URL for this server
@@ -190,15 +335,51 @@ func (api *SqrlSspAPI) HTTPSRoot(r *http.Request) *url.URL {
 
 // RemoteIP gets the remote IP as a string from a request
 // It prefers the X-Forwarded-For header since it's likely
-// this server will be behind a load balancer
+// this server will be behind a load balancer. The port is
+// stripped from Request.RemoteAddr since it changes with each
+// connection and the SQRL client and browser use different ones.
 func (api *SqrlSspAPI) RemoteIP(r *http.Request) string {
+	return remoteIP(r)
+}
+
+func remoteIP(r *http.Request) string {
 	ipAddress := r.Header.Get("X-Forwarded-For")
 	if ipAddress == "" {
-		ipAddress = r.RemoteAddr
+		ipAddress = RemoteAddrIP(r)
 	}
 	return ipAddress
 }
 
+// RemoteAddrIP gets the IP of the connection from Request.RemoteAddr
+// without the port. Unlike SqrlSspAPI.RemoteIP it ignores forwarding
+// headers so the client can't choose the value.
+func RemoteAddrIP(r *http.Request) string {
+	// strip the port since it changes per connection
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// nut produces a Nut from the Tree, passing the remote IP if supported
+func (api *SqrlSspAPI) nut(remoteIP string) (Nut, error) {
+	if ipTree, ok := api.tree.(RemoteIPTree); ok {
+		return ipTree.NutForIP(remoteIP)
+	}
+	return api.tree.Nut()
+}
+
+// verifyNut checks the nut with the Tree if it's supported
+func (api *SqrlSspAPI) verifyNut(nut Nut) error {
+	if verifier, ok := api.tree.(NutExpirationVerifier); ok {
+		return verifier.VerifyExpiration(nut, api.NutExpiration)
+	}
+	if verifier, ok := api.tree.(NutVerifier); ok {
+		return verifier.Verify(nut)
+	}
+	return nil
+}
+
 func (api *SqrlSspAPI) qry(nut Nut) string {
 	return fmt.Sprintf("%v/cli.sqrl?nut=%v", api.RootPath, nut)
 }
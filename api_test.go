@@ -0,0 +1,40 @@
+package ssp
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoteIP(t *testing.T) {
+	api := NewSqrlSspAPI(nil, NewMapHoard(), nil, NewMapAuthStore())
+	defer api.Close()
+	tests := []struct {
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"[2001:db8::1]:1234", "", "2001:db8::1"},
+		{"192.0.2.1", "", "192.0.2.1"},
+		{"192.0.2.1:1234", "198.51.100.1", "198.51.100.1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/nut.sqrl", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if ip := api.RemoteIP(r); ip != test.expected {
+			t.Errorf("Expected %v for %v but got %v", test.expected, test.remoteAddr, ip)
+		}
+	}
+
+	// the browser and SQRL client connect from different ports
+	browser := httptest.NewRequest("GET", "/nut.sqrl", nil)
+	browser.RemoteAddr = "192.0.2.1:1111"
+	client := httptest.NewRequest("POST", "/cli.sqrl", nil)
+	client.RemoteAddr = "192.0.2.1:2222"
+	if api.RemoteIP(browser) != api.RemoteIP(client) {
+		t.Fatalf("Same host should have the same remote IP")
+	}
+}
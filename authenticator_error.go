@@ -0,0 +1,77 @@
+package ssp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// ErrAccountLocked is returned by an AuthenticatorWithError when the
+// user's account is locked. The SQRL client is sent a command failure.
+var ErrAccountLocked = fmt.Errorf("Account Locked")
+
+// ErrUserBanned is returned by an AuthenticatorWithError when the
+// user is banned. The SQRL client is sent a command failure.
+var ErrUserBanned = fmt.Errorf("User Banned")
+
+// ErrTransient is returned by an AuthenticatorWithError when a backend
+// is temporarily unavailable. The SQRL client is sent a transient error
+// so it can retry. Errors with a Temporary method that returns true,
+// like those from NewTransientError, are treated the same way.
+var ErrTransient = fmt.Errorf("Transient Failure")
+
+// AuthenticatorWithError is an optional interface for an Authenticator
+// that can refuse an authentication. If implemented, it's used in place
+// of AuthenticateIdentity. When it returns an error the identity isn't
+// saved and the SQRL client isn't told it succeeded.
+type AuthenticatorWithError interface {
+	AuthenticateIdentityWithError(ctx context.Context, identity *SqrlIdentity) (string, error)
+}
+
+type transientError struct {
+	err error
+}
+
+func (te *transientError) Error() string {
+	return fmt.Sprintf("transient failure: %v", te.err)
+}
+
+func (te *transientError) Temporary() bool {
+	return true
+}
+
+// NewTransientError marks err as a temporary failure
+func NewTransientError(err error) error {
+	return &transientError{err}
+}
+
+// IsTransient returns true for ErrTransient and errors
+// with a Temporary method that returns true
+func IsTransient(err error) bool {
+	if err == ErrTransient {
+		return true
+	}
+	temporary, ok := err.(interface {
+		Temporary() bool
+	})
+	return ok && temporary.Temporary()
+}
+
+// authenticate gets the redirect URL for identity from the Authenticator
+func (api *SqrlSspAPI) authenticate(ctx context.Context, identity *SqrlIdentity) (string, error) {
+	if checked, ok := api.Authenticator.(AuthenticatorWithError); ok {
+		return checked.AuthenticateIdentityWithError(ctx, identity)
+	}
+	return ContextAuthenticator(api.Authenticator).AuthenticateIdentityContext(ctx, identity), nil
+}
+
+// authenticateStatus is the HTTP status for an authenticate error
+func authenticateStatus(err error) int {
+	if IsTransient(err) {
+		return http.StatusServiceUnavailable
+	}
+	if err == ErrAccountLocked || err == ErrUserBanned {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,170 @@
+package ssp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+type refusingAuthenticator struct {
+	contextAuthenticator
+	err error
+}
+
+func (ra *refusingAuthenticator) AuthenticateIdentityWithError(ctx context.Context, identity *SqrlIdentity) (string, error) {
+	if ra.err != nil {
+		return "", ra.err
+	}
+	return "https://example.com/done", nil
+}
+
+func TestAuthenticatorWithError(t *testing.T) {
+	cases := []struct {
+		err    error
+		tif    uint32
+		status int
+	}{
+		{nil, TIFIDMatch | TIFIPMatched, http.StatusOK},
+		{ErrAccountLocked, TIFIDMatch | TIFIPMatched | TIFCommandFailed, http.StatusForbidden},
+		{ErrUserBanned, TIFIDMatch | TIFIPMatched | TIFCommandFailed, http.StatusForbidden},
+		{ErrTransient, TIFIDMatch | TIFIPMatched | TIFCommandFailed | TIFTransientError, http.StatusServiceUnavailable},
+		{NewTransientError(fmt.Errorf("timeout")), TIFIDMatch | TIFIPMatched | TIFCommandFailed | TIFTransientError, http.StatusServiceUnavailable},
+		{fmt.Errorf("unknown"), TIFIDMatch | TIFIPMatched | TIFCommandFailed, http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		store := NewMapAuthStore()
+		authenticator := &refusingAuthenticator{contextAuthenticator{&contextRecorder{t: t}}, c.err}
+		api := NewSqrlSspAPI(nil, NewMapHoard(), authenticator, store)
+
+		w := httptest.NewRecorder()
+		api.Nut(w, httptest.NewRequest("GET", "/nut.sqrl", nil))
+		values, _ := url.ParseQuery(w.Body.String())
+		nut := values.Get("nut")
+
+		_, priv, _ := ed25519.GenerateKey(nil)
+		req := signedCliRequest(nut, "ident", priv)
+		w = httptest.NewRecorder()
+		api.Cli(w, httptest.NewRequest("POST", "/cli.sqrl?nut="+nut, strings.NewReader(req.Encode())))
+		resp, err := ParseCliResponse(w.Body.Bytes())
+		if err != nil {
+			t.Fatalf("Failed parse: %v", err)
+		}
+		if resp.TIF != c.tif {
+			t.Errorf("Expected tif %x for %v but got %x", c.tif, c.err, resp.TIF)
+		}
+		_, err = store.FindIdentity(req.Client.Idk)
+		if c.err == nil && err != nil {
+			t.Errorf("Identity wasn't saved: %v", err)
+		}
+		if c.err != nil && err != ErrNotFound {
+			t.Errorf("Saved identity for %v", c.err)
+		}
+
+		// the pag nut is only authenticated on success
+		w = httptest.NewRecorder()
+		api.Pag(w, httptest.NewRequest("GET", "/pag.sqrl?nut="+nut+"&pag="+values.Get("pag"), nil))
+		expectedPag := http.StatusOK
+		if c.err != nil {
+			expectedPag = http.StatusNotFound
+		}
+		if w.Code != expectedPag {
+			t.Errorf("Expected pag status %v for %v but got %v", expectedPag, c.err, w.Code)
+		}
+		api.Close()
+	}
+}
+
+func TestAuthenticatorRefusedNoChanges(t *testing.T) {
+	recorder := &contextRecorder{t: t}
+	store := &contextAuthStore{NewMapAuthStore(), recorder}
+	authenticator := &refusingAuthenticator{contextAuthenticator{recorder}, ErrAccountLocked}
+	api := NewSqrlSspAPI(nil, NewMapHoard(), authenticator, store)
+	defer api.Close()
+	ctx := context.WithValue(context.Background(), contextKey("test"), "value")
+
+	ident := func(req *CliRequest, nut string) *CliResponse {
+		recorder.calls = nil
+		w := httptest.NewRecorder()
+		api.Cli(w, httptest.NewRequest("POST", "/cli.sqrl?nut="+nut, strings.NewReader(req.Encode())).WithContext(ctx))
+		resp, err := ParseCliResponse(w.Body.Bytes())
+		if err != nil {
+			t.Fatalf("Failed parse: %v", err)
+		}
+		if resp.TIF&TIFCommandFailed == 0 {
+			t.Fatalf("Expected the ident to fail but got tif %x", resp.TIF)
+		}
+		for _, call := range recorder.calls {
+			if call == "SwapIdentities" || call == "SaveIdentity" {
+				t.Fatalf("Called %v for a refused identity: %v", call, recorder.calls)
+			}
+		}
+		return resp
+	}
+	newNut := func() string {
+		w := httptest.NewRecorder()
+		api.Nut(w, httptest.NewRequest("GET", "/nut.sqrl", nil))
+		values, _ := url.ParseQuery(w.Body.String())
+		return values.Get("nut")
+	}
+
+	// a new identity replacing a previous one
+	_, previousKey, _ := ed25519.GenerateKey(nil)
+	previous := &SqrlIdentity{Idk: Sqrl64.EncodeToString(previousKey.Public().(ed25519.PublicKey)), Suk: "suk", Vuk: "vuk"}
+	store.SaveIdentity(previous)
+	nut := newNut()
+	_, priv, _ := ed25519.GenerateKey(nil)
+	req := signedCliRequest(nut, "ident", priv)
+	req.Client.Pidk = previous.Idk
+	req.ClientEncoded = ""
+	req.Ids = Sqrl64.EncodeToString(ed25519.Sign(priv, req.SigningString()))
+	req.Pids = Sqrl64.EncodeToString(ed25519.Sign(previousKey, req.SigningString()))
+	ident(req, nut)
+	if stored, _ := store.FindIdentity(previous.Idk); stored.Rekeyed != "" {
+		t.Fatalf("Previous identity was swapped: %#v", stored)
+	}
+	if _, err := store.FindIdentity(req.Client.Idk); err != ErrNotFound {
+		t.Fatalf("Refused identity was saved: %v", err)
+	}
+
+	// a known identity whose options change
+	nut = newNut()
+	req = signedCliRequest(nut, "ident", priv)
+	store.SaveIdentity(req.Identity())
+	req.Client.Opt["hardlock"] = true
+	req.ClientEncoded = ""
+	req.Ids = Sqrl64.EncodeToString(ed25519.Sign(priv, req.SigningString()))
+	ident(req, nut)
+	if stored, _ := store.FindIdentity(req.Client.Idk); stored.Hardlock {
+		t.Fatalf("Refused identity changes were saved: %#v", stored)
+	}
+}
+
+func TestPagAuthenticatorError(t *testing.T) {
+	for _, c := range []struct {
+		err    error
+		status int
+	}{
+		{ErrAccountLocked, http.StatusForbidden},
+		{ErrTransient, http.StatusServiceUnavailable},
+		{fmt.Errorf("unknown"), http.StatusInternalServerError},
+	} {
+		hoard := NewMapHoard()
+		authenticator := &refusingAuthenticator{contextAuthenticator{&contextRecorder{t: t}}, c.err}
+		api := NewSqrlSspAPI(nil, hoard, authenticator, NewMapAuthStore())
+		// the account was locked after the ident succeeded
+		hoard.Save(Nut("pag"), &HoardCache{OriginalNut: "nut", Identity: &SqrlIdentity{Idk: "idk"}}, api.NutExpiration)
+
+		w := httptest.NewRecorder()
+		api.Pag(w, httptest.NewRequest("GET", "/pag.sqrl?nut=nut&pag=pag", nil))
+		if w.Code != c.status {
+			t.Errorf("Expected status %v for %v but got %v", c.status, c.err, w.Code)
+		}
+		api.Close()
+	}
+}
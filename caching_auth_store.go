@@ -0,0 +1,251 @@
+package ssp
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type cachedIdentity struct {
+	idk     string
+	value   *SqrlIdentity // nil if the identity wasn't found
+	expires time.Time
+}
+
+// CacheStats are the counts of FindIdentity calls that
+// were answered from the cache or went to the inner store
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// CachingAuthStore is a read-through cache in front of another
+// AuthStore. Found identities and identities that weren't found are
+// cached for a TTL, the least recently used entries are dropped past
+// the maximum size, and entries are removed when an identity is saved
+// or deleted through this store. Changes made to the inner store by
+// other servers are only seen once the TTL passes, so it should be
+// short if several servers share a database. FindIdentity returns
+// copies so callers can't modify the cached values.
+type CachingAuthStore struct {
+	store   AuthStore
+	ttl     time.Duration
+	maxSize int
+	hits    uint64
+	misses  uint64
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	now     func() time.Time
+	// generation is bumped by Invalidate and invalidated holds the
+	// generation each idk was last invalidated at so a lookup that
+	// started before then doesn't cache what it found. invalidated
+	// is only needed while lookups are pending.
+	generation  uint64
+	invalidated map[string]uint64
+	pending     int
+}
+
+// NewCachingAuthStore wraps store caching up to maxSize
+// lookups for ttl
+func NewCachingAuthStore(store AuthStore, ttl time.Duration, maxSize int) *CachingAuthStore {
+	return &CachingAuthStore{
+		store:       store,
+		ttl:         ttl,
+		maxSize:     maxSize,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		now:         time.Now,
+		invalidated: make(map[string]uint64),
+	}
+}
+
+// Close implements io.Closer by closing the inner store if it can be
+func (cas *CachingAuthStore) Close() error {
+	return closeIfCloser(cas.store)
+}
+
+// Stats returns the hit and miss counts since the store was created
+func (cas *CachingAuthStore) Stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&cas.hits),
+		Misses: atomic.LoadUint64(&cas.misses),
+	}
+}
+
+// Len returns the number of cached entries
+func (cas *CachingAuthStore) Len() int {
+	cas.mutex.Lock()
+	defer cas.mutex.Unlock()
+	return cas.lru.Len()
+}
+
+func copyIdentity(identity *SqrlIdentity) *SqrlIdentity {
+	if identity == nil {
+		return nil
+	}
+	copied := *identity
+	return &copied
+}
+
+// lookup returns the cached entry for idk if there's an unexpired one
+func (cas *CachingAuthStore) lookup(idk string) (*cachedIdentity, bool) {
+	cas.mutex.Lock()
+	defer cas.mutex.Unlock()
+	elem, ok := cas.entries[idk]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cachedIdentity)
+	if !entry.expires.After(cas.now()) {
+		cas.lru.Remove(elem)
+		delete(cas.entries, idk)
+		return nil, false
+	}
+	cas.lru.MoveToFront(elem)
+	return entry, true
+}
+
+// startLookup records a pending lookup in the inner store
+// and returns the generation to pass to add or endLookup
+func (cas *CachingAuthStore) startLookup() uint64 {
+	cas.mutex.Lock()
+	defer cas.mutex.Unlock()
+	cas.pending++
+	return cas.generation
+}
+
+// endLookup finishes a lookup that isn't cached
+func (cas *CachingAuthStore) endLookup() {
+	cas.mutex.Lock()
+	defer cas.mutex.Unlock()
+	cas.lookupDone()
+}
+
+// lookupDone must be called with the mutex held
+func (cas *CachingAuthStore) lookupDone() {
+	cas.pending--
+	if cas.pending == 0 && len(cas.invalidated) > 0 {
+		cas.invalidated = make(map[string]uint64)
+	}
+}
+
+// add caches the result of a lookup that started at generation
+// unless idk has been invalidated since
+func (cas *CachingAuthStore) add(idk string, identity *SqrlIdentity, generation uint64) {
+	cas.mutex.Lock()
+	defer cas.mutex.Unlock()
+	defer cas.lookupDone()
+	if cas.invalidated[idk] > generation {
+		return
+	}
+	entry := &cachedIdentity{
+		idk:     idk,
+		value:   identity,
+		expires: cas.now().Add(cas.ttl),
+	}
+	if elem, ok := cas.entries[idk]; ok {
+		elem.Value = entry
+		cas.lru.MoveToFront(elem)
+		return
+	}
+	cas.entries[idk] = cas.lru.PushFront(entry)
+	for cas.maxSize > 0 && cas.lru.Len() > cas.maxSize {
+		oldest := cas.lru.Back()
+		cas.lru.Remove(oldest)
+		delete(cas.entries, oldest.Value.(*cachedIdentity).idk)
+	}
+}
+
+// Invalidate removes idk from the cache. Call this when an
+// identity is changed in the inner store by something else.
+func (cas *CachingAuthStore) Invalidate(idk string) {
+	cas.mutex.Lock()
+	defer cas.mutex.Unlock()
+	cas.generation++
+	if cas.pending > 0 {
+		cas.invalidated[idk] = cas.generation
+	}
+	if elem, ok := cas.entries[idk]; ok {
+		cas.lru.Remove(elem)
+		delete(cas.entries, idk)
+	}
+}
+
+// FindIdentity implements AuthStore
+func (cas *CachingAuthStore) FindIdentity(idk string) (*SqrlIdentity, error) {
+	return cas.FindIdentityContext(context.Background(), idk)
+}
+
+// FindIdentityContext implements AuthStoreContext
+func (cas *CachingAuthStore) FindIdentityContext(ctx context.Context, idk string) (*SqrlIdentity, error) {
+	if entry, ok := cas.lookup(idk); ok {
+		atomic.AddUint64(&cas.hits, 1)
+		if entry.value == nil {
+			return nil, ErrNotFound
+		}
+		return copyIdentity(entry.value), nil
+	}
+	atomic.AddUint64(&cas.misses, 1)
+	generation := cas.startLookup()
+	identity, err := ContextAuthStore(cas.store).FindIdentityContext(ctx, idk)
+	if err == ErrNotFound {
+		cas.add(idk, nil, generation)
+		return nil, err
+	}
+	if err != nil {
+		cas.endLookup()
+		return nil, err
+	}
+	cas.add(idk, copyIdentity(identity), generation)
+	return identity, nil
+}
+
+// SaveIdentity implements AuthStore
+func (cas *CachingAuthStore) SaveIdentity(identity *SqrlIdentity) error {
+	return cas.SaveIdentityContext(context.Background(), identity)
+}
+
+// SaveIdentityContext implements AuthStoreContext
+func (cas *CachingAuthStore) SaveIdentityContext(ctx context.Context, identity *SqrlIdentity) error {
+	// invalidate again after so a lookup that read
+	// the old value during the save doesn't cache it
+	cas.Invalidate(identity.Idk)
+	defer cas.Invalidate(identity.Idk)
+	return ContextAuthStore(cas.store).SaveIdentityContext(ctx, identity)
+}
+
+// DeleteIdentity implements AuthStore
+func (cas *CachingAuthStore) DeleteIdentity(idk string) error {
+	return cas.DeleteIdentityContext(context.Background(), idk)
+}
+
+// DeleteIdentityContext implements AuthStoreContext
+func (cas *CachingAuthStore) DeleteIdentityContext(ctx context.Context, idk string) error {
+	cas.Invalidate(idk)
+	defer cas.Invalidate(idk)
+	return ContextAuthStore(cas.store).DeleteIdentityContext(ctx, idk)
+}
+
+// ListIdentities implements IdentityLister if the inner
+// store does. Listing isn't cached.
+func (cas *CachingAuthStore) ListIdentities(filter IdentityFilter, after string, limit int) ([]*SqrlIdentity, error) {
+	lister, ok := cas.store.(IdentityLister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return lister.ListIdentities(filter, after, limit)
+}
+
+// FindIdentitiesByPidk implements IdentityLister if the
+// inner store does. The results aren't cached.
+func (cas *CachingAuthStore) FindIdentitiesByPidk(pidk string) ([]*SqrlIdentity, error) {
+	lister, ok := cas.store.(IdentityLister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return lister.FindIdentitiesByPidk(pidk)
+}
@@ -0,0 +1,144 @@
+package ssp
+
+import (
+	"testing"
+	"time"
+)
+
+// countingAuthStore counts the lookups that reach it
+type countingAuthStore struct {
+	*MapAuthStore
+	finds int
+}
+
+func (cas *countingAuthStore) FindIdentity(idk string) (*SqrlIdentity, error) {
+	cas.finds++
+	return cas.MapAuthStore.FindIdentity(idk)
+}
+
+func TestCachingAuthStore(t *testing.T) {
+	inner := &countingAuthStore{MapAuthStore: NewMapAuthStore()}
+	inner.SaveIdentity(&SqrlIdentity{Idk: "idk", Suk: "suk"})
+	store := NewCachingAuthStore(inner, time.Minute, 10)
+
+	for i := 0; i < 3; i++ {
+		identity, err := store.FindIdentity("idk")
+		if err != nil || identity.Suk != "suk" {
+			t.Fatalf("Failed find: %v %v", identity, err)
+		}
+		// callers can modify what they get without changing the cache
+		identity.Suk = "modified"
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := store.FindIdentity("missing"); err != ErrNotFound {
+			t.Fatalf("Expected not found but got %v", err)
+		}
+	}
+	if inner.finds != 2 {
+		t.Fatalf("Expected 2 inner finds but got %v", inner.finds)
+	}
+	if stats := store.Stats(); stats.Hits != 4 || stats.Misses != 2 {
+		t.Fatalf("Wrong stats %+v", stats)
+	}
+
+	// saving replaces the cached value and the negative entry
+	store.SaveIdentity(&SqrlIdentity{Idk: "idk", Suk: "newsuk"})
+	store.SaveIdentity(&SqrlIdentity{Idk: "missing"})
+	if identity, _ := store.FindIdentity("idk"); identity.Suk != "newsuk" {
+		t.Fatalf("Stale identity after save: %v", identity)
+	}
+	if _, err := store.FindIdentity("missing"); err != nil {
+		t.Fatalf("Stale not found after save: %v", err)
+	}
+
+	store.DeleteIdentity("idk")
+	if _, err := store.FindIdentity("idk"); err != ErrNotFound {
+		t.Fatalf("Stale identity after delete: %v", err)
+	}
+}
+
+func TestCachingAuthStoreExpiry(t *testing.T) {
+	inner := &countingAuthStore{MapAuthStore: NewMapAuthStore()}
+	store := NewCachingAuthStore(inner, time.Minute, 2)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	store.FindIdentity("a")
+	store.FindIdentity("b")
+	store.FindIdentity("a")
+	// c pushes out b which is the least recently used
+	store.FindIdentity("c")
+	if store.Len() != 2 {
+		t.Fatalf("Expected 2 entries but have %v", store.Len())
+	}
+	inner.finds = 0
+	store.FindIdentity("a")
+	store.FindIdentity("b")
+	if inner.finds != 1 {
+		t.Fatalf("Expected only b to be evicted but had %v inner finds", inner.finds)
+	}
+
+	store.now = func() time.Time { return now.Add(2 * time.Minute) }
+	inner.finds = 0
+	store.FindIdentity("b")
+	if inner.finds != 1 {
+		t.Fatalf("Expected expired entry to be looked up again")
+	}
+}
+
+func TestCachingAuthStoreLister(t *testing.T) {
+	testIdentityLister(t, NewCachingAuthStore(NewMapAuthStore(), time.Minute, 10))
+
+	// the inner store only implements AuthStore
+	store := NewCachingAuthStore(struct{ AuthStore }{NewMapAuthStore()}, time.Minute, 10)
+	if _, err := store.ListIdentities(IdentityFilter{}, "", 0); err != ErrNotSupported {
+		t.Fatalf("Expected not supported but got %v", err)
+	}
+}
+
+// racingAuthStore runs during after reading an identity
+// and before returning it
+type racingAuthStore struct {
+	*MapAuthStore
+	during func()
+}
+
+func (ras *racingAuthStore) FindIdentity(idk string) (*SqrlIdentity, error) {
+	identity, err := ras.MapAuthStore.FindIdentity(idk)
+	if ras.during != nil {
+		during := ras.during
+		ras.during = nil
+		during()
+	}
+	return identity, err
+}
+
+func TestCachingAuthStoreConcurrentSave(t *testing.T) {
+	inner := &racingAuthStore{MapAuthStore: NewMapAuthStore()}
+	inner.SaveIdentity(&SqrlIdentity{Idk: "idk", Suk: "old"})
+	store := NewCachingAuthStore(inner, time.Minute, 10)
+
+	// the save finishes while the lookup holds the old value
+	inner.during = func() {
+		store.SaveIdentity(&SqrlIdentity{Idk: "idk", Suk: "new"})
+	}
+	if identity, _ := store.FindIdentity("idk"); identity.Suk != "old" {
+		t.Fatalf("Expected the value read before the save but got %v", identity.Suk)
+	}
+	if identity, _ := store.FindIdentity("idk"); identity.Suk != "new" {
+		t.Fatalf("Stale value was cached: %v", identity.Suk)
+	}
+	if len(store.invalidated) != 0 {
+		t.Fatalf("Invalidations should be dropped once lookups finish")
+	}
+
+	// and the same for a delete
+	inner.SaveIdentity(&SqrlIdentity{Idk: "other"})
+	inner.during = func() {
+		store.DeleteIdentity("other")
+	}
+	store.FindIdentity("other")
+	if _, err := store.FindIdentity("other"); err != ErrNotFound {
+		t.Fatalf("Deleted identity was cached: %v", err)
+	}
+}
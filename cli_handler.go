@@ -1,6 +1,7 @@
 package ssp
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -27,6 +28,15 @@ func (api *SqrlSspAPI) Cli(w http.ResponseWriter, r *http.Request) {
 
 	// response mutates from here depending on available values
 	response := NewCliResponse(Nut(nut), api.qry(nut))
+
+	// reject nuts the tree didn't produce before doing any more work
+	err := api.verifyNut(nut)
+	if err != nil {
+		log.Printf("Rejected nut %v: %v", nut, err)
+		w.Write(response.WithClientFailure().WithCommandFailed().Encode())
+		return
+	}
+
 	req, err := ParseCliRequest(r)
 	if err != nil {
 		log.Printf("Can't parse body or bad signature: %v", err)
@@ -35,13 +45,14 @@ func (api *SqrlSspAPI) Cli(w http.ResponseWriter, r *http.Request) {
 	}
 	// Signature is OK from here on!
 
+	ctx := r.Context()
 	// defer writing the response and saving the new nut
-	defer api.writeResponse(req, response, w)
+	defer api.writeResponse(ctx, req, response, w)
 
 	// TODO remove me
 	spew.Dump(req)
 
-	hoardCache, err := api.getAndDelete(Nut(nut))
+	hoardCache, err := api.getAndDelete(ctx, Nut(nut))
 	if err != nil {
 		if err == ErrNotFound {
 			log.Printf("Nut %v not found", nut)
@@ -60,14 +71,18 @@ func (api *SqrlSspAPI) Cli(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if hoardCache.Sin != "" {
+		response.Sin = hoardCache.Sin
+	}
+
 	if req.Client.Cmd == "query" {
 		tmpIdent := req.Identity()
 		tmpIdent.Btn = -1
-		response.Ask = api.Authenticator.AskResponse(tmpIdent)
+		response.Ask = ContextAuthenticator(api.Authenticator).AskResponseContext(ctx, tmpIdent)
 	}
 
 	// generate new nut
-	nut, err = api.tree.Nut()
+	nut, err = api.nut(req.IPAddress)
 	if err != nil {
 		log.Printf("Error generating nut: %v", err)
 		response.WithCommandFailed()
@@ -80,7 +95,7 @@ func (api *SqrlSspAPI) Cli(w http.ResponseWriter, r *http.Request) {
 
 	// check if the same user has already been authenticated previously
 
-	identity, err := api.authStore.FindIdentity(req.Client.Idk)
+	identity, err := ContextAuthStore(api.authStore).FindIdentityContext(ctx, req.Client.Idk)
 	if err != nil && err != ErrNotFound {
 		log.Printf("Error looking up identity: %v", err)
 		response.WithCommandFailed()
@@ -88,24 +103,22 @@ func (api *SqrlSspAPI) Cli(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check is we know about a previous identity
-	previousIdentity, err := api.checkPreviousIdentity(req, response)
+	previousIdentity, err := api.checkPreviousIdentity(ctx, req, response)
 	if err != nil {
 		return
 	}
 
+	// the previous identity is only swapped if the current identity is new
+	var swapIdentity *SqrlIdentity
 	if identity != nil {
-		err := api.knownIdentity(req, response, identity)
+		err := api.knownIdentity(ctx, req, response, identity)
 		if err != nil {
 			return
 		}
 	} else if req.Client.Cmd == "ident" {
 		// create new identity from the request
 		identity = req.Identity()
-		// handle previous identity swap if the current identity is new
-		err := api.checkPreviousSwap(previousIdentity, identity, response)
-		if err != nil {
-			return
-		}
+		swapIdentity = previousIdentity
 
 		// Do we id match on first auth? grc says nope; PaulF and I think yes
 		response.WithIDMatch()
@@ -113,10 +126,10 @@ func (api *SqrlSspAPI) Cli(w http.ResponseWriter, r *http.Request) {
 	api.setSuk(req, response, identity)
 
 	// Finish authentication and saving
-	api.finishCliResponse(req, response, identity, hoardCache)
+	api.finishCliResponse(ctx, req, response, identity, swapIdentity, hoardCache)
 }
 
-func (api *SqrlSspAPI) writeResponse(req *CliRequest, response *CliResponse, w http.ResponseWriter) {
+func (api *SqrlSspAPI) writeResponse(ctx context.Context, req *CliRequest, response *CliResponse, w http.ResponseWriter) {
 	respBytes := response.Encode()
 	// TODO debug remove me
 	decodedResp, _ := Sqrl64.DecodeString(string(respBytes))
@@ -125,16 +138,20 @@ func (api *SqrlSspAPI) writeResponse(req *CliRequest, response *CliResponse, w h
 
 	// always save back the new nut
 	if response.HoardCache != nil {
-		err := api.hoard.Save(response.Nut, &HoardCache{
+		err := ContextHoard(api.hoard).SaveContext(ctx, response.Nut, &HoardCache{
 			State:        "associated",
 			RemoteIP:     response.HoardCache.RemoteIP,
 			OriginalNut:  response.HoardCache.OriginalNut,
 			PagNut:       response.HoardCache.PagNut,
+			Sin:          response.HoardCache.Sin,
 			LastRequest:  req,
 			LastResponse: respBytes,
 		}, api.NutExpiration)
 		if err != nil {
 			log.Printf("Failed saving to hoard: %v", err)
+			if err == ErrHoardFull {
+				response.WithTransientError()
+			}
 			response.WithCommandFailed()
 			respBytes = response.Encode()
 		} else {
@@ -155,19 +172,29 @@ func (api *SqrlSspAPI) setSuk(req *CliRequest, response *CliResponse, identity *
 	}
 }
 
-func (api *SqrlSspAPI) finishCliResponse(req *CliRequest, response *CliResponse, identity *SqrlIdentity, hoardCache *HoardCache) {
+// finishCliResponse authenticates the identity of an ident or enable.
+// The swap of previousIdentity and saving the identity wait until the
+// Authenticator accepts it so a refused login doesn't change anything.
+func (api *SqrlSspAPI) finishCliResponse(ctx context.Context, req *CliRequest, response *CliResponse, identity, previousIdentity *SqrlIdentity, hoardCache *HoardCache) {
 	accountDisabled := false
 	if identity != nil {
 		accountDisabled = identity.Disabled
 	}
 	if req.IsAuthCommand() && !accountDisabled {
 		log.Printf("Authenticated Idk: %#v", identity)
-		authURL, err := api.authenticateIdentity(identity, req.Client.Btn)
+		authURL, err := api.authenticateIdentity(withAuthenticationInfo(ctx, hoardCache, !req.Client.Opt["cps"]), identity, previousIdentity)
 		if err != nil {
-			log.Printf("Failed saving identity: %v", err)
+			log.Printf("Failed authenticating identity: %v", err)
+			if IsTransient(err) {
+				response.WithTransientError()
+			}
 			response.WithCommandFailed()
 			return
 		}
+		if previousIdentity != nil {
+			// TODO should we clear the PreviousIDMatch here?
+			response.ClearPreviousIDMatch()
+		}
 		if req.Client.Opt["cps"] {
 			log.Printf("Setting CPS Auth: %v", authURL)
 			response.URL = authURL
@@ -182,11 +209,12 @@ func (api *SqrlSspAPI) finishCliResponse(req *CliRequest, response *CliResponse,
 	if req.IsAuthCommand() && !accountDisabled {
 		// for non-CPS we save the state back to the PagNut for redirect on polling
 		if !req.Client.Opt["cps"] {
-			err := api.hoard.Save(hoardCache.PagNut, &HoardCache{
+			err := ContextHoard(api.hoard).SaveContext(ctx, hoardCache.PagNut, &HoardCache{
 				State:       "authenticated",
 				RemoteIP:    hoardCache.RemoteIP,
 				OriginalNut: hoardCache.OriginalNut,
 				PagNut:      hoardCache.PagNut,
+				Sin:         hoardCache.Sin,
 				LastRequest: req,
 				Identity:    identity,
 			}, api.NutExpiration)
@@ -199,26 +227,11 @@ func (api *SqrlSspAPI) finishCliResponse(req *CliRequest, response *CliResponse,
 	}
 }
 
-func (api *SqrlSspAPI) checkPreviousSwap(previousIdentity, identity *SqrlIdentity, response *CliResponse) error {
-	if previousIdentity != nil {
-		err := api.swapIdentities(previousIdentity, identity)
-		if err != nil {
-			log.Printf("Failed swapping identities: %v", err)
-			response.WithCommandFailed()
-			return fmt.Errorf("identity swap error")
-		}
-		log.Printf("Swapped identity %#v for %#v", previousIdentity, identity)
-		// TODO should we clear the PreviousIDMatch here?
-		response.ClearPreviousIDMatch()
-	}
-	return nil
-}
-
-func (api *SqrlSspAPI) checkPreviousIdentity(req *CliRequest, response *CliResponse) (*SqrlIdentity, error) {
+func (api *SqrlSspAPI) checkPreviousIdentity(ctx context.Context, req *CliRequest, response *CliResponse) (*SqrlIdentity, error) {
 	var previousIdentity *SqrlIdentity
 	var err error
 	if req.Client.Pidk != "" {
-		previousIdentity, err = api.authStore.FindIdentity(req.Client.Pidk)
+		previousIdentity, err = ContextAuthStore(api.authStore).FindIdentityContext(ctx, req.Client.Pidk)
 		if err != nil && err != ErrNotFound {
 			log.Printf("Error looking up previous identity: %v", err)
 			response.WithCommandFailed()
@@ -262,6 +275,16 @@ func (api *SqrlSspAPI) requestValidations(hoardCache *HoardCache, req *CliReques
 		return fmt.Errorf("validation error")
 	}
 
+	// validate the secure index if the client was sent a sin
+	if hoardCache.Sin != "" && hoardCache.LastResponse != nil {
+		err := req.ValidateIndex()
+		if err != nil {
+			log.Printf("Invalid secure index: %v", err)
+			response.WithClientFailure().WithCommandFailed()
+			return err
+		}
+	}
+
 	if !supportedCommands[req.Client.Cmd] {
 		response.WithFunctionNotSupported()
 		return fmt.Errorf("Uknown command: %v", req.Client.Cmd)
@@ -270,7 +293,7 @@ func (api *SqrlSspAPI) requestValidations(hoardCache *HoardCache, req *CliReques
 	return nil
 }
 
-func (api *SqrlSspAPI) knownIdentity(req *CliRequest, response *CliResponse, identity *SqrlIdentity) error {
+func (api *SqrlSspAPI) knownIdentity(ctx context.Context, req *CliRequest, response *CliResponse, identity *SqrlIdentity) error {
 	if identity.Rekeyed != "" {
 		response.WithIdentitySuperseded()
 		log.Printf("Attempt to use Rekeyed IDK: %v from %v", identity.Idk, req.IPAddress)
@@ -281,8 +304,10 @@ func (api *SqrlSspAPI) knownIdentity(req *CliRequest, response *CliResponse, ide
 	} else {
 		response.WithIDMatch()
 	}
-	// copy the current Btn value from the request
+	// copy the current Btn and index values from the request
 	identity.Btn = req.Client.Btn
+	identity.Ins = req.Client.Ins
+	identity.Pins = req.Client.Pins
 	changed := false
 	if req.IsAuthCommand() {
 		changed = req.UpdateIdentity(identity)
@@ -303,7 +328,7 @@ func (api *SqrlSspAPI) knownIdentity(req *CliRequest, response *CliResponse, ide
 			identity.Disabled = false
 			changed = true
 		} else if req.Client.Cmd == "remove" {
-			err := api.removeIdentity(identity)
+			err := api.removeIdentity(ctx, identity)
 			if err != nil {
 				log.Printf("Failed removing identity %v: %v", identity.Idk, err)
 				response.WithClientFailure().WithCommandFailed()
@@ -322,8 +347,10 @@ func (api *SqrlSspAPI) knownIdentity(req *CliRequest, response *CliResponse, ide
 		req.Client.Opt["suk"] = true
 		response.WithSQRLDisabled()
 	}
-	if changed {
-		err := api.authStore.SaveIdentity(identity)
+	// an identity that's authenticated is saved by finishCliResponse
+	// once the Authenticator accepts it
+	if changed && (!req.IsAuthCommand() || identity.Disabled) {
+		err := ContextAuthStore(api.authStore).SaveIdentityContext(ctx, identity)
 		if err != nil {
 			log.Printf("Failed saving identity %v: %v", identity.Idk, err)
 			response.WithClientFailure().WithCommandFailed()
@@ -64,6 +64,8 @@ type ClientBody struct {
 	Vuk     string          `json:"vuk"`  // Sqrl64.Encoded
 	Pidk    string          `json:"pidk"` // Sqrl64.Encoded
 	Idk     string          `json:"idk"`  // Sqrl64.Encoded
+	Ins     string          `json:"ins"`  // Sqrl64.Encoded
+	Pins    string          `json:"pins"` // Sqrl64.Encoded
 	// valid values are 0,1,2; -1 means no value
 	Btn int `json:"btn"`
 }
@@ -109,6 +111,14 @@ func (cb *ClientBody) Encode() []byte {
 		b.WriteString(fmt.Sprintf("pidk=%v\r\n", cb.Pidk))
 	}
 
+	if cb.Ins != "" {
+		b.WriteString(fmt.Sprintf("ins=%v\r\n", cb.Ins))
+	}
+
+	if cb.Pins != "" {
+		b.WriteString(fmt.Sprintf("pins=%v\r\n", cb.Pins))
+	}
+
 	encoded := Sqrl64.EncodeToString(b.Bytes())
 	log.Printf("Encoded response: <%v>", encoded)
 	return []byte(encoded)
@@ -161,6 +171,8 @@ func ClientBodyFromParams(params map[string]string) (*ClientBody, error) {
 	cb.Vuk = params["vuk"]
 	cb.Pidk = params["pidk"]
 	cb.Idk = params["idk"]
+	cb.Ins = params["ins"]
+	cb.Pins = params["pins"]
 
 	cb.Btn, err = strconv.Atoi(params["btn"])
 	if err != nil {
@@ -192,6 +204,8 @@ func (cr *CliRequest) Identity() *SqrlIdentity {
 		SQRLOnly: cr.Client.Opt["sqrlonly"],
 		Hardlock: cr.Client.Opt["hardlock"],
 		Btn:      cr.Client.Btn,
+		Ins:      cr.Client.Ins,
+		Pins:     cr.Client.Pins,
 	}
 }
 
@@ -203,13 +217,14 @@ func (cr *CliRequest) SigningString() []byte {
 	return []byte(cr.ClientEncoded + cr.Server)
 }
 
-// UpdateIdentity updates identity from request
+// UpdateIdentity updates identity from request and returns
+// true if the identity changed and needs to be saved
 func (cr *CliRequest) UpdateIdentity(identity *SqrlIdentity) bool {
 	copy := &SqrlIdentity{}
 	*copy = *identity
 	identity.SQRLOnly = cr.Client.Opt["sqrlonly"]
 	identity.Hardlock = cr.Client.Opt["hardlock"]
-	return *identity == *copy
+	return *identity != *copy
 }
 
 // IsAuthCommand is a command that authenticates (ident, enable)
@@ -281,6 +296,39 @@ func (cr *CliRequest) VerifyUrs(vuk string) error {
 	return nil
 }
 
+// ValidateIndex checks that the secure index values requested by a sin
+// are present. The ins is required and the pins is required if there's
+// a pidk. The values can't be verified beyond their size since they're
+// derived from the client's private keys; they are covered by the
+// ids and pids signatures.
+func (cr *CliRequest) ValidateIndex() error {
+	if err := validIndexValue(cr.Client.Ins); err != nil {
+		return fmt.Errorf("invalid ins: %v", err)
+	}
+	if cr.Client.Pidk != "" {
+		if err := validIndexValue(cr.Client.Pins); err != nil {
+			return fmt.Errorf("invalid pins: %v", err)
+		}
+	} else if cr.Client.Pins != "" {
+		return fmt.Errorf("pins without pidk")
+	}
+	return nil
+}
+
+func validIndexValue(value string) error {
+	if value == "" {
+		return fmt.Errorf("missing")
+	}
+	decoded, err := Sqrl64.DecodeString(value)
+	if err != nil {
+		return err
+	}
+	if len(decoded) != 32 {
+		return fmt.Errorf("wrong length %d", len(decoded))
+	}
+	return nil
+}
+
 // ValidateLastResponse checks to make sure the response on this request
 // matches a stored on that's passed in.
 func (cr *CliRequest) ValidateLastResponse(lastRepsonse []byte) bool {
@@ -0,0 +1,25 @@
+package ssp
+
+import "testing"
+
+func TestUpdateIdentity(t *testing.T) {
+	req := &CliRequest{Client: &ClientBody{Cmd: "ident", Opt: map[string]bool{"sqrlonly": true}}}
+	identity := &SqrlIdentity{Idk: "idk"}
+	if !req.UpdateIdentity(identity) {
+		t.Fatalf("Expected change when sqrlonly is turned on")
+	}
+	if !identity.SQRLOnly || identity.Hardlock {
+		t.Fatalf("Wrong options %#v", identity)
+	}
+	if req.UpdateIdentity(identity) {
+		t.Fatalf("Expected no change when options are the same")
+	}
+
+	req.Client.Opt = map[string]bool{"hardlock": true}
+	if !req.UpdateIdentity(identity) {
+		t.Fatalf("Expected change when options are switched")
+	}
+	if identity.SQRLOnly || !identity.Hardlock {
+		t.Fatalf("Wrong options %#v", identity)
+	}
+}
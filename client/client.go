@@ -0,0 +1,283 @@
+// Package client implements a minimal SQRL client. It's intended for
+// exercising an ssp.SqrlSspAPI end-to-end in tests and does not attempt to
+// be a complete or user-friendly client. Identities are held in memory
+// including the identity unlock key which a real client would never do.
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	ssp "github.com/smw1218/sqrl-ssp"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Client holds the identities used to talk to a SQRL server
+type Client struct {
+	Identity *Identity
+	// PreviousIdentity if set is sent as the pidk and signs pids
+	PreviousIdentity *Identity
+	// HTTPClient defaults to http.DefaultClient
+	HTTPClient *http.Client
+	// Rand is the source for random lock keys; defaults to crypto/rand
+	Rand io.Reader
+}
+
+// NewClient creates a client for an identity
+func NewClient(identity *Identity) *Client {
+	return &Client{
+		Identity: identity,
+	}
+}
+
+// Session follows the qry/nut chain for a single sqrl:// URL. Each
+// command posts to the qry of the previous response and sends back
+// the previous response as the server value.
+type Session struct {
+	client   *Client
+	base     *url.URL
+	qry      string
+	server   string
+	domain   string
+	keys     *SiteKeys
+	prevKeys *SiteKeys
+
+	// Opt are the options sent with every command
+	Opt map[string]bool
+	// Last is the most recently received response
+	Last *ssp.CliResponse
+	// LastRequest is the most recently sent request
+	LastRequest *ssp.CliRequest
+}
+
+// NewSession starts a session from a sqrl:// URL like the one
+// encoded in the QR code served from /png.sqrl
+func (c *Client) NewSession(sqrlURL string) (*Session, error) {
+	u, err := url.Parse(sqrlURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sqrl url: %v", err)
+	}
+	if u.Scheme != ssp.SqrlScheme {
+		return nil, fmt.Errorf("not a sqrl url: %v", sqrlURL)
+	}
+	if u.Query().Get("nut") == "" {
+		return nil, fmt.Errorf("sqrl url missing nut")
+	}
+	domain, err := SiteDomain(u)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{
+		client: c,
+		base: &url.URL{
+			Scheme: "https",
+			Host:   u.Host,
+		},
+		qry:    u.RequestURI(),
+		server: ssp.Sqrl64.EncodeToString([]byte(sqrlURL)),
+		domain: domain,
+		keys:   c.Identity.SiteKeys(domain),
+		Opt:    make(map[string]bool),
+	}
+	if c.PreviousIdentity != nil {
+		s.prevKeys = c.PreviousIdentity.SiteKeys(domain)
+	}
+	return s, nil
+}
+
+// SiteDomain returns the string used to derive site keys from a sqrl URL.
+// This is the lowercase host without a port, extended by the first x
+// characters of the path if the x parameter is present.
+func SiteDomain(u *url.URL) (string, error) {
+	host := u.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	domain := strings.ToLower(host)
+	if x := u.Query().Get("x"); x != "" {
+		ext, err := strconv.Atoi(x)
+		if err != nil || ext < 0 || ext > len(u.Path) {
+			return "", fmt.Errorf("invalid x parameter: %v", x)
+		}
+		domain += u.Path[:ext]
+	}
+	return domain, nil
+}
+
+// Idk is the identity key sent by this session
+func (s *Session) Idk() string {
+	return s.keys.Idk()
+}
+
+// Qry is the path and query the next command will be sent to
+func (s *Session) Qry() string {
+	return s.qry
+}
+
+// Query sends the query command
+func (s *Session) Query() (*ssp.CliResponse, error) {
+	return s.Do("query")
+}
+
+// Ident sends the ident command
+func (s *Session) Ident() (*ssp.CliResponse, error) {
+	return s.Do("ident")
+}
+
+// Disable sends the disable command
+func (s *Session) Disable() (*ssp.CliResponse, error) {
+	return s.Do("disable")
+}
+
+// Enable sends the enable command which requires the suk from
+// the last response
+func (s *Session) Enable() (*ssp.CliResponse, error) {
+	return s.Do("enable")
+}
+
+// Remove sends the remove command which requires the suk from
+// the last response
+func (s *Session) Remove() (*ssp.CliResponse, error) {
+	return s.Do("remove")
+}
+
+// Do sends any command to the server and parses the response. A non-nil
+// response is not a successful one; check the TIF.
+func (s *Session) Do(cmd string) (*ssp.CliResponse, error) {
+	req, err := s.NewRequest(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return s.Send(req)
+}
+
+// NewRequest builds and signs a request for a command
+func (s *Session) NewRequest(cmd string) (*ssp.CliRequest, error) {
+	var err error
+	body := &ssp.ClientBody{
+		Version: []int{1},
+		Cmd:     cmd,
+		Opt:     make(map[string]bool, len(s.Opt)),
+		Idk:     s.keys.Idk(),
+		Btn:     -1,
+	}
+	for k, v := range s.Opt {
+		if v {
+			body.Opt[k] = true
+		}
+	}
+	if s.prevKeys != nil {
+		body.Pidk = s.prevKeys.Idk()
+	}
+	// answer a secure index request from the last response
+	if s.Last != nil && s.Last.Sin != "" {
+		body.Ins = s.keys.Ins(s.Last.Sin)
+		if s.prevKeys != nil {
+			body.Pins = s.prevKeys.Ins(s.Last.Sin)
+		}
+	}
+	// send new unlock keys if the server doesn't know this identity
+	if cmd == "ident" && (s.Last == nil || s.Last.TIF&ssp.TIFIDMatch == 0) {
+		body.Suk, body.Vuk, err = s.keys.NewUnlockKeys(s.rand())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req := &ssp.CliRequest{
+		Client: body,
+		Server: s.server,
+	}
+	err = s.Sign(req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// Sign creates the ids, pids and urs signatures for a request. The urs
+// is only created for enable and remove. Sign may be called again after
+// modifying a request to produce valid signatures.
+func (s *Session) Sign(req *ssp.CliRequest) error {
+	req.ClientEncoded = ""
+	req.Ids = s.keys.Sign(req.SigningString())
+	req.Pids = ""
+	if s.prevKeys != nil {
+		req.Pids = s.prevKeys.Sign(req.SigningString())
+	}
+	req.Urs = ""
+	if req.Client.Cmd == "enable" || req.Client.Cmd == "remove" {
+		if s.Last == nil || s.Last.Suk == "" {
+			return fmt.Errorf("%v requires the suk from a previous response", req.Client.Cmd)
+		}
+		ursk, err := s.keys.Ursk(s.Last.Suk)
+		if err != nil {
+			return err
+		}
+		req.Urs = ssp.Sqrl64.EncodeToString(ed25519.Sign(ursk, req.SigningString()))
+	}
+	return nil
+}
+
+// WithIdentity returns a copy of the session that continues the same
+// qry/nut chain but signs with a different identity. This is useful
+// for testing a server's handling of mismatched identities.
+func (s *Session) WithIdentity(identity *Identity) *Session {
+	c := *s
+	c.keys = identity.SiteKeys(s.domain)
+	return &c
+}
+
+// Send posts a request to the current qry and advances the session
+// to the nut in the response.
+func (s *Session) Send(req *ssp.CliRequest) (*ssp.CliResponse, error) {
+	qryURL, err := s.base.Parse(s.qry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid qry %v: %v", s.qry, err)
+	}
+	resp, err := s.httpClient().Post(qryURL.String(), "application/x-www-form-urlencoded", bytes.NewBufferString(req.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed cli request: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %v: %v", resp.StatusCode, string(body))
+	}
+	cliResp, err := ssp.ParseCliResponse(body)
+	if err != nil {
+		return nil, err
+	}
+	s.LastRequest = req
+	s.Last = cliResp
+	s.server = string(body)
+	if cliResp.Qry != "" {
+		s.qry = cliResp.Qry
+	}
+	return cliResp, nil
+}
+
+func (s *Session) httpClient() *http.Client {
+	if s.client.HTTPClient != nil {
+		return s.client.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (s *Session) rand() io.Reader {
+	if s.client.Rand != nil {
+		return s.client.Rand
+	}
+	return rand.Reader
+}
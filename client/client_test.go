@@ -0,0 +1,141 @@
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	ssp "github.com/smw1218/sqrl-ssp"
+	"golang.org/x/crypto/ed25519"
+)
+
+type testAuthenticator struct{}
+
+func (ta *testAuthenticator) AuthenticateIdentity(identity *ssp.SqrlIdentity) string {
+	return "https://example.com/success?idk=" + identity.Idk
+}
+func (ta *testAuthenticator) SwapIdentities(previousIdentity, newIdentity *ssp.SqrlIdentity) error {
+	return nil
+}
+func (ta *testAuthenticator) RemoveIdentity(identity *ssp.SqrlIdentity) error {
+	return nil
+}
+func (ta *testAuthenticator) AskResponse(identity *ssp.SqrlIdentity) *ssp.Ask {
+	return nil
+}
+
+func newTestServer(t *testing.T) (*httptest.Server, *ssp.MapAuthStore) {
+	authStore := ssp.NewMapAuthStore()
+	api := ssp.NewSqrlSspAPI(nil, ssp.NewMapHoard(), &testAuthenticator{}, authStore)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/nut.sqrl", api.Nut)
+	mux.HandleFunc("/cli.sqrl", api.Cli)
+	return httptest.NewTLSServer(mux), authStore
+}
+
+func sqrlURL(t *testing.T, ts *httptest.Server) string {
+	resp, err := ts.Client().Get(ts.URL + "/nut.sqrl")
+	if err != nil {
+		t.Fatalf("Failed nut request: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed reading nut: %v", err)
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		t.Fatalf("Failed parsing nut: %v", err)
+	}
+	u, _ := url.Parse(ts.URL)
+	return "sqrl://" + u.Host + "/cli.sqrl?nut=" + values.Get("nut")
+}
+
+func testIdentity(t *testing.T, seed byte) *Identity {
+	id, err := NewIdentity(bytes.Repeat([]byte{seed}, 32), bytes.Repeat([]byte{seed + 1}, 32))
+	if err != nil {
+		t.Fatalf("Failed creating identity: %v", err)
+	}
+	return id
+}
+
+func TestUnlockKeys(t *testing.T) {
+	keys := testIdentity(t, 1).SiteKeys("example.com")
+	suk, vuk, err := keys.NewUnlockKeys(bytes.NewReader(bytes.Repeat([]byte{7}, 32)))
+	if err != nil {
+		t.Fatalf("Failed unlock keys: %v", err)
+	}
+	ursk, err := keys.Ursk(suk)
+	if err != nil {
+		t.Fatalf("Failed ursk: %v", err)
+	}
+	req := &ssp.CliRequest{ClientEncoded: "client", Server: "server"}
+	req.Urs = keys.Sign(req.SigningString())
+	if req.VerifyUrs(vuk) == nil {
+		t.Fatalf("Site key signature should not verify as urs")
+	}
+	req.Urs = ssp.Sqrl64.EncodeToString(ed25519.Sign(ursk, req.SigningString()))
+	if err := req.VerifyUrs(vuk); err != nil {
+		t.Fatalf("Urs didn't verify against vuk: %v", err)
+	}
+}
+
+func TestSiteDomain(t *testing.T) {
+	for raw, expected := range map[string]string{
+		"sqrl://Example.com:8443/cli.sqrl?nut=a":     "example.com",
+		"sqrl://example.com/demo/cli.sqrl?nut=a&x=5": "example.com/demo",
+	} {
+		u, _ := url.Parse(raw)
+		domain, err := SiteDomain(u)
+		if err != nil {
+			t.Fatalf("Failed domain for %v: %v", raw, err)
+		}
+		if domain != expected {
+			t.Errorf("Expected %v but got %v", expected, domain)
+		}
+	}
+}
+
+func TestClientLifecycle(t *testing.T) {
+	ts, authStore := newTestServer(t)
+	defer ts.Close()
+
+	c := NewClient(testIdentity(t, 1))
+	c.HTTPClient = ts.Client()
+	session, err := c.NewSession(sqrlURL(t, ts))
+	if err != nil {
+		t.Fatalf("Failed session: %v", err)
+	}
+	session.Opt["noiptest"] = true
+	// the suk is needed for enable and remove
+	session.Opt["suk"] = true
+
+	steps := []struct {
+		cmd     string
+		tif     uint32
+		without uint32
+	}{
+		{"query", 0, ssp.TIFIDMatch | ssp.TIFCommandFailed},
+		{"ident", ssp.TIFIDMatch, ssp.TIFCommandFailed},
+		{"disable", ssp.TIFIDMatch | ssp.TIFSQRLDisabled, ssp.TIFCommandFailed},
+		{"enable", ssp.TIFIDMatch, ssp.TIFCommandFailed | ssp.TIFSQRLDisabled},
+		{"query", ssp.TIFIDMatch, ssp.TIFCommandFailed},
+		{"remove", 0, ssp.TIFCommandFailed | ssp.TIFIDMatch},
+	}
+	for _, step := range steps {
+		resp, err := session.Do(step.cmd)
+		if err != nil {
+			t.Fatalf("Failed %v: %v", step.cmd, err)
+		}
+		if resp.TIF&step.tif != step.tif || resp.TIF&step.without != 0 {
+			t.Fatalf("Unexpected tif for %v: %x", step.cmd, resp.TIF)
+		}
+	}
+
+	if _, err := authStore.FindIdentity(session.Idk()); err != ssp.ErrNotFound {
+		t.Fatalf("Identity should be removed: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	ssp "github.com/smw1218/sqrl-ssp"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Identity holds the master keys of a SQRL identity as described
+// in https://www.grc.com/sqrl/idlock.htm. A real client would never
+// keep the IUK in memory; it's held here so that enable and remove
+// can be exercised in tests.
+type Identity struct {
+	imk []byte
+	iuk []byte
+	ilk [32]byte
+}
+
+// NewIdentity creates an Identity from a 32 byte identity master key (IMK)
+// and a 32 byte identity unlock key (IUK). The IUK may be nil in which
+// case the identity can't produce unlock request signatures.
+func NewIdentity(imk, iuk []byte) (*Identity, error) {
+	if len(imk) != 32 {
+		return nil, fmt.Errorf("imk must be 32 bytes")
+	}
+	id := &Identity{
+		imk: imk,
+	}
+	if iuk != nil {
+		if len(iuk) != 32 {
+			return nil, fmt.Errorf("iuk must be 32 bytes")
+		}
+		id.iuk = iuk
+		var iukArr [32]byte
+		copy(iukArr[:], iuk)
+		curve25519.ScalarBaseMult(&id.ilk, &iukArr)
+	}
+	return id, nil
+}
+
+// GenerateIdentity creates a new random Identity
+func GenerateIdentity(rand io.Reader) (*Identity, error) {
+	imk := make([]byte, 32)
+	if _, err := io.ReadFull(rand, imk); err != nil {
+		return nil, fmt.Errorf("failed reading imk: %v", err)
+	}
+	iuk := make([]byte, 32)
+	if _, err := io.ReadFull(rand, iuk); err != nil {
+		return nil, fmt.Errorf("failed reading iuk: %v", err)
+	}
+	return NewIdentity(imk, iuk)
+}
+
+// SiteKeys derives the per-site keys for a domain. The site
+// private key is HMAC-SHA256(IMK, domain) used as an ed25519 seed.
+func (id *Identity) SiteKeys(domain string) *SiteKeys {
+	mac := hmac.New(sha256.New, id.imk)
+	mac.Write([]byte(domain))
+	return &SiteKeys{
+		private:  ed25519.NewKeyFromSeed(mac.Sum(nil)),
+		identity: id,
+	}
+}
+
+// SiteKeys are the keys of an Identity that are specific to a single site
+type SiteKeys struct {
+	private  ed25519.PrivateKey
+	identity *Identity
+}
+
+// Idk is the Sqrl64 encoded site public key
+func (sk *SiteKeys) Idk() string {
+	return ssp.Sqrl64.EncodeToString(sk.private.Public().(ed25519.PublicKey))
+}
+
+// Sign signs a message with the site private key
+func (sk *SiteKeys) Sign(message []byte) string {
+	return ssp.Sqrl64.EncodeToString(ed25519.Sign(sk.private, message))
+}
+
+// Ins computes the secure index for a sin sent by the server.
+// It's HMAC-SHA256(EnHash(site private key), sin).
+func (sk *SiteKeys) Ins(sin string) string {
+	mac := hmac.New(sha256.New, enHash(sk.private.Seed()))
+	mac.Write([]byte(sin))
+	return ssp.Sqrl64.EncodeToString(mac.Sum(nil))
+}
+
+// enHash is 16 chained iterations of SHA256 XORed together
+func enHash(in []byte) []byte {
+	out := make([]byte, sha256.Size)
+	h := in
+	for i := 0; i < 16; i++ {
+		sum := sha256.Sum256(h)
+		h = sum[:]
+		for j := range out {
+			out[j] ^= h[j]
+		}
+	}
+	return out
+}
+
+// Ilk is the Sqrl64 encoded identity lock key
+func (sk *SiteKeys) Ilk() string {
+	return ssp.Sqrl64.EncodeToString(sk.identity.ilk[:])
+}
+
+// NewUnlockKeys creates a random lock key (RLK) and derives the
+// server unlock key (suk) and verify unlock key (vuk) which are
+// both returned Sqrl64 encoded.
+func (sk *SiteKeys) NewUnlockKeys(rand io.Reader) (suk string, vuk string, err error) {
+	if sk.identity.iuk == nil {
+		return "", "", fmt.Errorf("identity has no unlock key")
+	}
+	var rlk, sukArr, shared [32]byte
+	if _, err := io.ReadFull(rand, rlk[:]); err != nil {
+		return "", "", fmt.Errorf("failed reading rlk: %v", err)
+	}
+	curve25519.ScalarBaseMult(&sukArr, &rlk)
+	curve25519.ScalarMult(&shared, &rlk, &sk.identity.ilk)
+	vukKey := ed25519.NewKeyFromSeed(shared[:]).Public().(ed25519.PublicKey)
+	return ssp.Sqrl64.EncodeToString(sukArr[:]), ssp.Sqrl64.EncodeToString(vukKey), nil
+}
+
+// Ursk derives the unlock request signing key from the suk returned by
+// the server. Its public key is the vuk that was created along with the suk.
+func (sk *SiteKeys) Ursk(suk string) (ed25519.PrivateKey, error) {
+	if sk.identity.iuk == nil {
+		return nil, fmt.Errorf("identity has no unlock key")
+	}
+	sukBytes, err := ssp.Sqrl64.DecodeString(suk)
+	if err != nil || len(sukBytes) != 32 {
+		return nil, fmt.Errorf("invalid suk")
+	}
+	var iukArr, sukArr, shared [32]byte
+	copy(iukArr[:], sk.identity.iuk)
+	copy(sukArr[:], sukBytes)
+	curve25519.ScalarMult(&shared, &iukArr, &sukArr)
+	return ed25519.NewKeyFromSeed(shared[:]), nil
+}
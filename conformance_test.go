@@ -0,0 +1,684 @@
+package ssp_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	ssp "github.com/smw1218/sqrl-ssp"
+	"github.com/smw1218/sqrl-ssp/client"
+)
+
+// This suite drives the handlers over https with the reference client and
+// checks the exact TIF bits for the command transitions described in
+// https://www.grc.com/sqrl/semantics.htm
+
+type recordingAuthenticator struct {
+	authenticated []string
+	lastIdentity  *ssp.SqrlIdentity
+	swapped       []string
+	removed       []string
+}
+
+func (ra *recordingAuthenticator) AuthenticateIdentity(identity *ssp.SqrlIdentity) string {
+	ra.authenticated = append(ra.authenticated, identity.Idk)
+	ra.lastIdentity = identity
+	return "https://example.com/success?idk=" + identity.Idk
+}
+func (ra *recordingAuthenticator) SwapIdentities(previousIdentity, newIdentity *ssp.SqrlIdentity) error {
+	ra.swapped = append(ra.swapped, previousIdentity.Idk+">"+newIdentity.Idk)
+	return nil
+}
+func (ra *recordingAuthenticator) RemoveIdentity(identity *ssp.SqrlIdentity) error {
+	ra.removed = append(ra.removed, identity.Idk)
+	return nil
+}
+func (ra *recordingAuthenticator) AskResponse(identity *ssp.SqrlIdentity) *ssp.Ask {
+	return nil
+}
+
+type conformanceEnv struct {
+	t         *testing.T
+	ts        *httptest.Server
+	api       *ssp.SqrlSspAPI
+	authStore *ssp.MapAuthStore
+	auth      *recordingAuthenticator
+}
+
+func newConformanceEnv(t *testing.T) *conformanceEnv {
+	env := &conformanceEnv{
+		t:         t,
+		authStore: ssp.NewMapAuthStore(),
+		auth:      &recordingAuthenticator{},
+	}
+	env.api = ssp.NewSqrlSspAPI(nil, ssp.NewMapHoard(), env.auth, env.authStore)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/nut.sqrl", env.api.Nut)
+	mux.HandleFunc("/png.sqrl", env.api.PNG)
+	mux.HandleFunc("/pag.sqrl", env.api.Pag)
+	mux.HandleFunc("/cli.sqrl", env.api.Cli)
+	env.ts = httptest.NewTLSServer(mux)
+	return env
+}
+
+func (e *conformanceEnv) close() {
+	e.ts.Close()
+}
+
+func (e *conformanceEnv) get(path string, header http.Header) (*http.Response, []byte) {
+	req, err := http.NewRequest("GET", e.ts.URL+path, nil)
+	if err != nil {
+		e.t.Fatalf("Failed creating request: %v", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := e.ts.Client().Do(req)
+	if err != nil {
+		e.t.Fatalf("Failed request %v: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		e.t.Fatalf("Failed reading %v: %v", path, err)
+	}
+	return resp, body
+}
+
+// nut fetches a new nut and pag from /nut.sqrl
+func (e *conformanceEnv) nut() (string, string) {
+	return e.nutFrom("/nut.sqrl")
+}
+
+func (e *conformanceEnv) nutFrom(path string) (string, string) {
+	_, body := e.get(path, nil)
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		e.t.Fatalf("Failed parsing nut response: %v", err)
+	}
+	return values.Get("nut"), values.Get("pag")
+}
+
+func (e *conformanceEnv) session(identity, previous *client.Identity) (*client.Session, string, string) {
+	return e.sessionFrom("/nut.sqrl", identity, previous)
+}
+
+func (e *conformanceEnv) sessionFrom(path string, identity, previous *client.Identity) (*client.Session, string, string) {
+	nut, pag := e.nutFrom(path)
+	u, _ := url.Parse(e.ts.URL)
+	c := client.NewClient(identity)
+	c.PreviousIdentity = previous
+	c.HTTPClient = e.ts.Client()
+	s, err := c.NewSession("sqrl://" + u.Host + "/cli.sqrl?nut=" + nut)
+	if err != nil {
+		e.t.Fatalf("Failed creating session: %v", err)
+	}
+	return s, nut, pag
+}
+
+func (e *conformanceEnv) run(s *client.Session, steps []conformanceStep) {
+	for i, step := range steps {
+		for _, o := range step.opt {
+			s.Opt[o] = true
+		}
+		resp, err := s.Do(step.cmd)
+		if err != nil {
+			e.t.Fatalf("Step %d %v failed: %v", i, step.cmd, err)
+		}
+		if resp.TIF != step.tif {
+			e.t.Fatalf("Step %d %v expected tif %x but got %x", i, step.cmd, step.tif, resp.TIF)
+		}
+		if step.suk != (resp.Suk != "") {
+			e.t.Fatalf("Step %d %v expected suk %v but got %q", i, step.cmd, step.suk, resp.Suk)
+		}
+		if step.url != (resp.URL != "") {
+			e.t.Fatalf("Step %d %v expected url %v but got %q", i, step.cmd, step.url, resp.URL)
+		}
+		for _, o := range step.opt {
+			delete(s.Opt, o)
+		}
+	}
+}
+
+// register runs query and ident for an identity in its own session
+func (e *conformanceEnv) register(identity, previous *client.Identity) {
+	s, _, _ := e.session(identity, previous)
+	if _, err := s.Query(); err != nil {
+		e.t.Fatalf("Failed register query: %v", err)
+	}
+	resp, err := s.Ident()
+	if err != nil {
+		e.t.Fatalf("Failed register ident: %v", err)
+	}
+	if resp.TIF&ssp.TIFCommandFailed != 0 {
+		e.t.Fatalf("Failed register ident tif: %x", resp.TIF)
+	}
+}
+
+type conformanceStep struct {
+	cmd string
+	opt []string
+	tif uint32
+	suk bool
+	url bool
+}
+
+func conformanceIdentity(t *testing.T, seed byte) *client.Identity {
+	id, err := client.NewIdentity(bytes.Repeat([]byte{seed}, 32), bytes.Repeat([]byte{seed + 1}, 32))
+	if err != nil {
+		t.Fatalf("Failed creating identity: %v", err)
+	}
+	return id
+}
+
+const ipMatch = ssp.TIFIPMatched
+
+func TestConformanceCommandTransitions(t *testing.T) {
+	alice := conformanceIdentity(t, 1)
+	bob := conformanceIdentity(t, 10)
+
+	cases := []struct {
+		name     string
+		identity *client.Identity
+		previous *client.Identity
+		setup    func(e *conformanceEnv)
+		steps    []conformanceStep
+		check    func(t *testing.T, e *conformanceEnv)
+	}{
+		{
+			name:     "new identity",
+			identity: alice,
+			steps: []conformanceStep{
+				{cmd: "query", tif: ipMatch},
+				{cmd: "ident", tif: ipMatch | ssp.TIFIDMatch},
+			},
+		},
+		{
+			name:     "new identity cps",
+			identity: alice,
+			steps: []conformanceStep{
+				{cmd: "query", opt: []string{"cps"}, tif: ipMatch},
+				{cmd: "ident", opt: []string{"cps"}, tif: ipMatch | ssp.TIFIDMatch, url: true},
+			},
+		},
+		{
+			name:     "new identity suk",
+			identity: alice,
+			steps: []conformanceStep{
+				{cmd: "query", opt: []string{"suk"}, tif: ipMatch},
+				{cmd: "ident", opt: []string{"suk"}, tif: ipMatch | ssp.TIFIDMatch, suk: true},
+			},
+		},
+		{
+			name:     "ident without query",
+			identity: alice,
+			steps: []conformanceStep{
+				{cmd: "ident", tif: ipMatch | ssp.TIFIDMatch},
+			},
+		},
+		{
+			name:     "no ip test",
+			identity: alice,
+			steps: []conformanceStep{
+				{cmd: "query", opt: []string{"noiptest"}, tif: ipMatch},
+			},
+		},
+		{
+			name:     "known identity",
+			identity: alice,
+			setup:    func(e *conformanceEnv) { e.register(alice, nil) },
+			steps: []conformanceStep{
+				{cmd: "query", tif: ipMatch | ssp.TIFIDMatch},
+				{cmd: "ident", tif: ipMatch | ssp.TIFIDMatch},
+			},
+		},
+		{
+			name:     "disable and enable",
+			identity: alice,
+			setup:    func(e *conformanceEnv) { e.register(alice, nil) },
+			steps: []conformanceStep{
+				{cmd: "query", tif: ipMatch | ssp.TIFIDMatch},
+				{cmd: "disable", tif: ipMatch | ssp.TIFIDMatch | ssp.TIFSQRLDisabled, suk: true},
+				{cmd: "query", tif: ipMatch | ssp.TIFIDMatch | ssp.TIFSQRLDisabled, suk: true},
+				{cmd: "ident", tif: ipMatch | ssp.TIFIDMatch | ssp.TIFSQRLDisabled | ssp.TIFCommandFailed, suk: true},
+				{cmd: "query", tif: ipMatch | ssp.TIFIDMatch | ssp.TIFSQRLDisabled, suk: true},
+				{cmd: "enable", tif: ipMatch | ssp.TIFIDMatch},
+				{cmd: "ident", tif: ipMatch | ssp.TIFIDMatch},
+			},
+		},
+		{
+			name:     "remove",
+			identity: alice,
+			setup:    func(e *conformanceEnv) { e.register(alice, nil) },
+			steps: []conformanceStep{
+				{cmd: "query", opt: []string{"suk"}, tif: ipMatch | ssp.TIFIDMatch, suk: true},
+				{cmd: "remove", opt: []string{"suk"}, tif: ipMatch, suk: true},
+				{cmd: "query", tif: ipMatch},
+			},
+			check: func(t *testing.T, e *conformanceEnv) {
+				if len(e.auth.removed) != 1 {
+					t.Fatalf("Expected one removal but got %v", e.auth.removed)
+				}
+			},
+		},
+		{
+			name:     "rekey",
+			identity: bob,
+			previous: alice,
+			setup:    func(e *conformanceEnv) { e.register(alice, nil) },
+			steps: []conformanceStep{
+				{cmd: "query", tif: ipMatch | ssp.TIFPreviousIDMatch},
+				{cmd: "ident", tif: ipMatch | ssp.TIFIDMatch, suk: true},
+				{cmd: "query", tif: ipMatch | ssp.TIFIDMatch | ssp.TIFPreviousIDMatch, suk: true},
+			},
+			check: func(t *testing.T, e *conformanceEnv) {
+				if len(e.auth.swapped) != 1 {
+					t.Fatalf("Expected one swap but got %v", e.auth.swapped)
+				}
+				previous, err := e.authStore.FindIdentity(e.auth.authenticated[0])
+				if err != nil {
+					t.Fatalf("Previous identity missing: %v", err)
+				}
+				if previous.Rekeyed == "" {
+					t.Fatalf("Previous identity not marked rekeyed")
+				}
+			},
+		},
+		{
+			name:     "superseded",
+			identity: alice,
+			setup: func(e *conformanceEnv) {
+				e.register(alice, nil)
+				e.register(bob, alice)
+			},
+			steps: []conformanceStep{
+				{cmd: "query", tif: ipMatch | ssp.TIFIdentitySuperseded},
+				{cmd: "ident", tif: ipMatch | ssp.TIFIdentitySuperseded | ssp.TIFCommandFailed},
+			},
+		},
+		{
+			name:     "unknown previous identity",
+			identity: bob,
+			previous: alice,
+			steps: []conformanceStep{
+				{cmd: "query", tif: ipMatch},
+				{cmd: "ident", tif: ipMatch | ssp.TIFIDMatch},
+			},
+		},
+		{
+			name:     "unsupported command",
+			identity: alice,
+			steps: []conformanceStep{
+				{cmd: "dance", tif: ipMatch | ssp.TIFFunctionNotSupported},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e := newConformanceEnv(t)
+			defer e.close()
+			if c.setup != nil {
+				c.setup(e)
+			}
+			s, _, _ := e.session(c.identity, c.previous)
+			e.run(s, c.steps)
+			if c.check != nil {
+				c.check(t, e)
+			}
+		})
+	}
+}
+
+func TestConformanceRequestValidation(t *testing.T) {
+	alice := conformanceIdentity(t, 1)
+	bob := conformanceIdentity(t, 10)
+
+	cases := []struct {
+		name string
+		tif  uint32
+		run  func(e *conformanceEnv, s *client.Session) (*ssp.CliResponse, error)
+	}{
+		{
+			name: "replayed nut",
+			tif:  ssp.TIFClientFailure | ssp.TIFCommandFailed,
+			run: func(e *conformanceEnv, s *client.Session) (*ssp.CliResponse, error) {
+				req, err := s.NewRequest("query")
+				if err != nil {
+					return nil, err
+				}
+				replay := *s
+				if _, err := s.Send(req); err != nil {
+					return nil, err
+				}
+				return replay.Send(req)
+			},
+		},
+		{
+			name: "tampered server value",
+			tif:  ssp.TIFCommandFailed,
+			run: func(e *conformanceEnv, s *client.Session) (*ssp.CliResponse, error) {
+				if _, err := s.Query(); err != nil {
+					return nil, err
+				}
+				req, err := s.NewRequest("ident")
+				if err != nil {
+					return nil, err
+				}
+				req.Server = ssp.Sqrl64.EncodeToString([]byte("tampered"))
+				if err := s.Sign(req); err != nil {
+					return nil, err
+				}
+				return s.Send(req)
+			},
+		},
+		{
+			name: "bad signature",
+			tif:  ssp.TIFClientFailure | ssp.TIFCommandFailed,
+			run: func(e *conformanceEnv, s *client.Session) (*ssp.CliResponse, error) {
+				req, err := s.NewRequest("query")
+				if err != nil {
+					return nil, err
+				}
+				req.Client.Cmd = "ident"
+				req.ClientEncoded = ""
+				return s.Send(req)
+			},
+		},
+		{
+			name: "identity changed mid-chain",
+			tif:  ipMatch | ssp.TIFCommandFailed | ssp.TIFClientFailure | ssp.TIFBadIDAssociation,
+			run: func(e *conformanceEnv, s *client.Session) (*ssp.CliResponse, error) {
+				if _, err := s.Query(); err != nil {
+					return nil, err
+				}
+				return s.WithIdentity(bob).Ident()
+			},
+		},
+		{
+			name: "enable with bad urs",
+			tif:  ipMatch | ssp.TIFIDMatch | ssp.TIFSQRLDisabled | ssp.TIFCommandFailed | ssp.TIFClientFailure,
+			run: func(e *conformanceEnv, s *client.Session) (*ssp.CliResponse, error) {
+				e.register(alice, nil)
+				if _, err := s.Disable(); err != nil {
+					return nil, err
+				}
+				req, err := s.NewRequest("enable")
+				if err != nil {
+					return nil, err
+				}
+				req.Urs = req.Ids
+				return s.Send(req)
+			},
+		},
+		{
+			name: "remove without urs",
+			tif:  ipMatch | ssp.TIFIDMatch | ssp.TIFCommandFailed | ssp.TIFClientFailure,
+			run: func(e *conformanceEnv, s *client.Session) (*ssp.CliResponse, error) {
+				e.register(alice, nil)
+				s.Opt["suk"] = true
+				if _, err := s.Query(); err != nil {
+					return nil, err
+				}
+				req, err := s.NewRequest("remove")
+				if err != nil {
+					return nil, err
+				}
+				req.Urs = ""
+				return s.Send(req)
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e := newConformanceEnv(t)
+			defer e.close()
+			s, _, _ := e.session(alice, nil)
+			resp, err := c.run(e, s)
+			if err != nil {
+				t.Fatalf("Failed request: %v", err)
+			}
+			if resp.TIF != c.tif {
+				t.Fatalf("Expected tif %x but got %x", c.tif, resp.TIF)
+			}
+		})
+	}
+}
+
+func TestConformanceIPMismatch(t *testing.T) {
+	e := newConformanceEnv(t)
+	defer e.close()
+	s, _, _ := e.session(conformanceIdentity(t, 1), nil)
+	req, err := s.NewRequest("query")
+	if err != nil {
+		t.Fatalf("Failed request: %v", err)
+	}
+	httpReq, err := http.NewRequest("POST", e.ts.URL+"/cli.sqrl?nut="+nutFromSession(t, s), bytes.NewBufferString(req.Encode()))
+	if err != nil {
+		t.Fatalf("Failed request: %v", err)
+	}
+	httpReq.Header.Set("X-Forwarded-For", "192.0.2.1")
+	resp, err := e.ts.Client().Do(httpReq)
+	if err != nil {
+		t.Fatalf("Failed request: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	cliResp, err := ssp.ParseCliResponse(body)
+	if err != nil {
+		t.Fatalf("Failed parse: %v", err)
+	}
+	if cliResp.TIF != ssp.TIFCommandFailed {
+		t.Fatalf("Expected tif %x but got %x", ssp.TIFCommandFailed, cliResp.TIF)
+	}
+}
+
+func nutFromSession(t *testing.T, s *client.Session) string {
+	u, err := url.Parse(s.Qry())
+	if err != nil {
+		t.Fatalf("Bad qry: %v", err)
+	}
+	return u.Query().Get("nut")
+}
+
+func TestConformanceMissingNut(t *testing.T) {
+	e := newConformanceEnv(t)
+	defer e.close()
+	resp, err := e.ts.Client().Post(e.ts.URL+"/cli.sqrl", "application/x-www-form-urlencoded", bytes.NewBufferString(""))
+	if err != nil {
+		t.Fatalf("Failed request: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	cliResp, err := ssp.ParseCliResponse(body)
+	if err != nil {
+		t.Fatalf("Failed parse: %v", err)
+	}
+	if cliResp.TIF != ssp.TIFClientFailure {
+		t.Fatalf("Expected tif %x but got %x", ssp.TIFClientFailure, cliResp.TIF)
+	}
+}
+
+func TestConformancePag(t *testing.T) {
+	alice := conformanceIdentity(t, 1)
+	e := newConformanceEnv(t)
+	defer e.close()
+
+	s, nut, pag := e.session(alice, nil)
+	resp, _ := e.get("/pag.sqrl?nut="+nut+"&pag="+pag, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected pag not found before ident but got %v", resp.StatusCode)
+	}
+	e.run(s, []conformanceStep{
+		{cmd: "query", tif: ipMatch},
+		{cmd: "ident", tif: ipMatch | ssp.TIFIDMatch},
+	})
+
+	resp, _ = e.get("/pag.sqrl?nut=wrong&pag="+pag, nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected unauthorized for wrong nut but got %v", resp.StatusCode)
+	}
+
+	// the wrong nut consumed the pag; authenticate again
+	s, nut, pag = e.session(alice, nil)
+	e.run(s, []conformanceStep{
+		{cmd: "ident", tif: ipMatch | ssp.TIFIDMatch},
+	})
+	resp, body := e.get("/pag.sqrl?nut="+nut+"&pag="+pag, http.Header{"Accept": {"application/json"}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected pag success but got %v", resp.StatusCode)
+	}
+	if !bytes.Contains(body, []byte(s.Idk())) {
+		t.Fatalf("Expected pag url for identity but got %v", string(body))
+	}
+
+	resp, _ = e.get("/pag.sqrl?nut="+nut+"&pag="+pag, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected pag to be single use but got %v", resp.StatusCode)
+	}
+
+	resp, _ = e.get("/pag.sqrl?nut="+nut, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected bad request without pag but got %v", resp.StatusCode)
+	}
+}
+
+func TestConformancePagCPS(t *testing.T) {
+	e := newConformanceEnv(t)
+	defer e.close()
+	s, nut, pag := e.session(conformanceIdentity(t, 1), nil)
+	e.run(s, []conformanceStep{
+		{cmd: "ident", opt: []string{"cps"}, tif: ipMatch | ssp.TIFIDMatch, url: true},
+	})
+	resp, _ := e.get("/pag.sqrl?nut="+nut+"&pag="+pag, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected no pag for cps but got %v", resp.StatusCode)
+	}
+}
+
+func TestConformancePNG(t *testing.T) {
+	e := newConformanceEnv(t)
+	defer e.close()
+	resp, body := e.get("/png.sqrl", nil)
+	if resp.Header.Get("Content-Type") != "image/png" {
+		t.Fatalf("Wrong content type: %v", resp.Header.Get("Content-Type"))
+	}
+	if resp.Header.Get("Sqrl-Nut") == "" || resp.Header.Get("Sqrl-Pag") == "" || resp.Header.Get("Sqrl-Exp") == "" {
+		t.Fatalf("Missing nut headers: %v", resp.Header)
+	}
+	if !bytes.HasPrefix(body, []byte("\x89PNG")) {
+		t.Fatalf("Body isn't a png")
+	}
+
+	nut, _ := e.nut()
+	resp, _ = e.get("/png.sqrl?nut="+nut, nil)
+	if resp.Header.Get("Sqrl-Nut") != "" {
+		t.Fatalf("Nut headers should not be set when nut is provided")
+	}
+}
+
+func TestConformanceSecureIndex(t *testing.T) {
+	alice := conformanceIdentity(t, 1)
+	bob := conformanceIdentity(t, 10)
+	e := newConformanceEnv(t)
+	defer e.close()
+
+	s, _, _ := e.sessionFrom("/nut.sqrl?sin=0", alice, nil)
+	resp, err := s.Query()
+	if err != nil {
+		t.Fatalf("Failed query: %v", err)
+	}
+	if resp.Sin != "0" {
+		t.Fatalf("Expected sin 0 but got %q", resp.Sin)
+	}
+	resp, err = s.Ident()
+	if err != nil {
+		t.Fatalf("Failed ident: %v", err)
+	}
+	if resp.TIF != ipMatch|ssp.TIFIDMatch {
+		t.Fatalf("Expected tif %x but got %x", ipMatch|ssp.TIFIDMatch, resp.TIF)
+	}
+	ins := s.LastRequest.Client.Ins
+	if ins == "" || e.auth.lastIdentity.Ins != ins {
+		t.Fatalf("Expected ins %q on identity but got %q", ins, e.auth.lastIdentity.Ins)
+	}
+	// the index is per-request and isn't stored
+	stored, err := e.authStore.FindIdentity(e.auth.lastIdentity.Idk)
+	if err != nil || stored.Ins != "" || stored.Pins != "" {
+		t.Fatalf("Expected stored identity without ins but got %#v %v", stored, err)
+	}
+
+	// the index is stable for the same identity and sin
+	s, _, _ = e.sessionFrom("/nut.sqrl?sin=0", alice, nil)
+	e.run(s, []conformanceStep{
+		{cmd: "query", tif: ipMatch | ssp.TIFIDMatch},
+		{cmd: "ident", tif: ipMatch | ssp.TIFIDMatch},
+	})
+	if e.auth.lastIdentity.Ins != ins {
+		t.Fatalf("Expected stable ins %q but got %q", ins, e.auth.lastIdentity.Ins)
+	}
+	// nor kept on the identity found for a known user by a query.
+	// The client only sends ins once it has seen the sin.
+	s, _, _ = e.sessionFrom("/nut.sqrl?sin=0", alice, nil)
+	e.run(s, []conformanceStep{
+		{cmd: "query", tif: ipMatch | ssp.TIFIDMatch},
+		{cmd: "query", tif: ipMatch | ssp.TIFIDMatch},
+	})
+	if s.LastRequest.Client.Ins == "" {
+		t.Fatalf("Expected the query to send ins")
+	}
+	stored, err = e.authStore.FindIdentity(e.auth.lastIdentity.Idk)
+	if err != nil || stored.Ins != "" || stored.Pins != "" {
+		t.Fatalf("Expected known identity without ins after query but got %#v %v", stored, err)
+	}
+
+	// rekeyed identities return the previous index as pins
+	s, _, _ = e.sessionFrom("/nut.sqrl?sin=0", bob, alice)
+	e.run(s, []conformanceStep{
+		{cmd: "query", tif: ipMatch | ssp.TIFPreviousIDMatch},
+		{cmd: "ident", tif: ipMatch | ssp.TIFIDMatch, suk: true},
+	})
+	if e.auth.lastIdentity.Pins != ins {
+		t.Fatalf("Expected pins %q but got %q", ins, e.auth.lastIdentity.Pins)
+	}
+	if e.auth.lastIdentity.Ins == "" || e.auth.lastIdentity.Ins == ins {
+		t.Fatalf("Expected a new ins but got %q", e.auth.lastIdentity.Ins)
+	}
+
+	// the sin is echoed in the signed response so it must be plain
+	for _, sin := range []string{"0%0d%0aurl=https://evil.example.com", "a.b", "01234567890123456"} {
+		resp, _ := e.get("/nut.sqrl?sin="+sin, nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected bad request for sin %q but got %v", sin, resp.StatusCode)
+		}
+		resp, _ = e.get("/png.sqrl?sin="+sin, nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected bad request for png sin %q but got %v", sin, resp.StatusCode)
+		}
+	}
+
+	// a client that ignores the sin fails
+	s, _, _ = e.sessionFrom("/nut.sqrl?sin=1", bob, nil)
+	if _, err := s.Query(); err != nil {
+		t.Fatalf("Failed query: %v", err)
+	}
+	req, err := s.NewRequest("ident")
+	if err != nil {
+		t.Fatalf("Failed request: %v", err)
+	}
+	req.Client.Ins = ""
+	if err := s.Sign(req); err != nil {
+		t.Fatalf("Failed sign: %v", err)
+	}
+	resp, err = s.Send(req)
+	if err != nil {
+		t.Fatalf("Failed ident: %v", err)
+	}
+	if resp.TIF != ipMatch|ssp.TIFClientFailure|ssp.TIFCommandFailed {
+		t.Fatalf("Expected tif %x but got %x", ipMatch|ssp.TIFClientFailure|ssp.TIFCommandFailed, resp.TIF)
+	}
+}
@@ -0,0 +1,146 @@
+package ssp
+
+import (
+	"context"
+	"time"
+)
+
+// AuthenticatorContext is an optional interface for an Authenticator
+// whose methods take the context of the HTTP request. If implemented,
+// it's used in place of the Authenticator methods so cancellation,
+// deadlines and tracing reach the user service.
+type AuthenticatorContext interface {
+	AuthenticateIdentityContext(ctx context.Context, identity *SqrlIdentity) string
+	SwapIdentitiesContext(ctx context.Context, previousIdentity, newIdentity *SqrlIdentity) error
+	RemoveIdentityContext(ctx context.Context, identity *SqrlIdentity) error
+	AskResponseContext(ctx context.Context, identity *SqrlIdentity) *Ask
+}
+
+// HoardContext is an optional interface for a Hoard whose methods
+// take the context of the HTTP request. If implemented, it's used
+// in place of the Hoard methods.
+type HoardContext interface {
+	GetContext(ctx context.Context, nut Nut) (*HoardCache, error)
+	GetAndDeleteContext(ctx context.Context, nut Nut) (*HoardCache, error)
+	SaveContext(ctx context.Context, nut Nut, value *HoardCache, expiration time.Duration) error
+}
+
+// AuthStoreContext is an optional interface for an AuthStore whose
+// methods take the context of the HTTP request. If implemented, it's
+// used in place of the AuthStore methods.
+type AuthStoreContext interface {
+	FindIdentityContext(ctx context.Context, idk string) (*SqrlIdentity, error)
+	SaveIdentityContext(ctx context.Context, identity *SqrlIdentity) error
+	DeleteIdentityContext(ctx context.Context, idk string) error
+}
+
+// AuthenticationInfo describes the login an Authenticator is called
+// for. SqrlSspAPI adds it to the context passed to AuthenticatorContext
+// and AuthenticatorWithError when authenticating an identity.
+type AuthenticationInfo struct {
+	// RemoteIP is the IP of the browser that requested the nut
+	RemoteIP string
+	// Nut is the nut the browser requested from /nut.sqrl
+	Nut Nut
+	// SkipURL is set when the returned URL isn't used. That's the
+	// ident of a client that didn't ask for CPS since the browser gets
+	// its URL from /pag.sqrl instead. Authenticators can skip work like
+	// saving a login token but can still refuse the identity.
+	SkipURL bool
+}
+
+type authenticationInfoKey struct{}
+
+func withAuthenticationInfo(ctx context.Context, hoardCache *HoardCache, skipURL bool) context.Context {
+	return context.WithValue(ctx, authenticationInfoKey{}, &AuthenticationInfo{
+		RemoteIP: hoardCache.RemoteIP,
+		Nut:      hoardCache.OriginalNut,
+		SkipURL:  skipURL,
+	})
+}
+
+// AuthenticationInfoFromContext returns the AuthenticationInfo
+// added by SqrlSspAPI or nil if ctx doesn't have one
+func AuthenticationInfoFromContext(ctx context.Context) *AuthenticationInfo {
+	info, _ := ctx.Value(authenticationInfoKey{}).(*AuthenticationInfo)
+	return info
+}
+
+// ContextAuthenticator returns authenticator as an AuthenticatorContext.
+// If it doesn't implement the interface, the context is ignored.
+func ContextAuthenticator(authenticator Authenticator) AuthenticatorContext {
+	if ac, ok := authenticator.(AuthenticatorContext); ok {
+		return ac
+	}
+	return authenticatorContextAdapter{authenticator}
+}
+
+// ContextHoard returns hoard as a HoardContext. If it
+// doesn't implement the interface, the context is ignored.
+func ContextHoard(hoard Hoard) HoardContext {
+	if hc, ok := hoard.(HoardContext); ok {
+		return hc
+	}
+	return hoardContextAdapter{hoard}
+}
+
+// ContextAuthStore returns store as an AuthStoreContext. If it
+// doesn't implement the interface, the context is ignored.
+func ContextAuthStore(store AuthStore) AuthStoreContext {
+	if sc, ok := store.(AuthStoreContext); ok {
+		return sc
+	}
+	return authStoreContextAdapter{store}
+}
+
+type authenticatorContextAdapter struct {
+	Authenticator
+}
+
+func (a authenticatorContextAdapter) AuthenticateIdentityContext(ctx context.Context, identity *SqrlIdentity) string {
+	return a.AuthenticateIdentity(identity)
+}
+
+func (a authenticatorContextAdapter) SwapIdentitiesContext(ctx context.Context, previousIdentity, newIdentity *SqrlIdentity) error {
+	return a.SwapIdentities(previousIdentity, newIdentity)
+}
+
+func (a authenticatorContextAdapter) RemoveIdentityContext(ctx context.Context, identity *SqrlIdentity) error {
+	return a.RemoveIdentity(identity)
+}
+
+func (a authenticatorContextAdapter) AskResponseContext(ctx context.Context, identity *SqrlIdentity) *Ask {
+	return a.AskResponse(identity)
+}
+
+type hoardContextAdapter struct {
+	Hoard
+}
+
+func (h hoardContextAdapter) GetContext(ctx context.Context, nut Nut) (*HoardCache, error) {
+	return h.Get(nut)
+}
+
+func (h hoardContextAdapter) GetAndDeleteContext(ctx context.Context, nut Nut) (*HoardCache, error) {
+	return h.GetAndDelete(nut)
+}
+
+func (h hoardContextAdapter) SaveContext(ctx context.Context, nut Nut, value *HoardCache, expiration time.Duration) error {
+	return h.Save(nut, value, expiration)
+}
+
+type authStoreContextAdapter struct {
+	AuthStore
+}
+
+func (s authStoreContextAdapter) FindIdentityContext(ctx context.Context, idk string) (*SqrlIdentity, error) {
+	return s.FindIdentity(idk)
+}
+
+func (s authStoreContextAdapter) SaveIdentityContext(ctx context.Context, identity *SqrlIdentity) error {
+	return s.SaveIdentity(identity)
+}
+
+func (s authStoreContextAdapter) DeleteIdentityContext(ctx context.Context, idk string) error {
+	return s.DeleteIdentity(idk)
+}
@@ -0,0 +1,179 @@
+package ssp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+type contextKey string
+
+// contextRecorder records the calls that got the test context
+type contextRecorder struct {
+	t     *testing.T
+	calls []string
+}
+
+func (cr *contextRecorder) record(ctx context.Context, call string) {
+	if ctx.Value(contextKey("test")) != "value" {
+		cr.t.Errorf("%v didn't get the request context", call)
+	}
+	cr.calls = append(cr.calls, call)
+}
+
+type contextHoard struct {
+	*MapHoard
+	*contextRecorder
+}
+
+func (ch *contextHoard) GetContext(ctx context.Context, nut Nut) (*HoardCache, error) {
+	ch.record(ctx, "Get")
+	return ch.Get(nut)
+}
+
+func (ch *contextHoard) GetAndDeleteContext(ctx context.Context, nut Nut) (*HoardCache, error) {
+	ch.record(ctx, "GetAndDelete")
+	return ch.GetAndDelete(nut)
+}
+
+func (ch *contextHoard) SaveContext(ctx context.Context, nut Nut, value *HoardCache, expiration time.Duration) error {
+	ch.record(ctx, "Save")
+	return ch.Save(nut, value, expiration)
+}
+
+type contextAuthStore struct {
+	*MapAuthStore
+	*contextRecorder
+}
+
+func (cs *contextAuthStore) FindIdentityContext(ctx context.Context, idk string) (*SqrlIdentity, error) {
+	cs.record(ctx, "FindIdentity")
+	return cs.FindIdentity(idk)
+}
+
+func (cs *contextAuthStore) SaveIdentityContext(ctx context.Context, identity *SqrlIdentity) error {
+	cs.record(ctx, "SaveIdentity")
+	return cs.SaveIdentity(identity)
+}
+
+func (cs *contextAuthStore) DeleteIdentityContext(ctx context.Context, idk string) error {
+	cs.record(ctx, "DeleteIdentity")
+	return cs.DeleteIdentity(idk)
+}
+
+type contextAuthenticator struct {
+	*contextRecorder
+}
+
+func (ca *contextAuthenticator) AuthenticateIdentity(identity *SqrlIdentity) string {
+	ca.t.Errorf("Called AuthenticateIdentity without context")
+	return ""
+}
+func (ca *contextAuthenticator) SwapIdentities(previousIdentity, newIdentity *SqrlIdentity) error {
+	ca.t.Errorf("Called SwapIdentities without context")
+	return nil
+}
+func (ca *contextAuthenticator) RemoveIdentity(identity *SqrlIdentity) error {
+	ca.t.Errorf("Called RemoveIdentity without context")
+	return nil
+}
+func (ca *contextAuthenticator) AskResponse(identity *SqrlIdentity) *Ask {
+	ca.t.Errorf("Called AskResponse without context")
+	return nil
+}
+func (ca *contextAuthenticator) AuthenticateIdentityContext(ctx context.Context, identity *SqrlIdentity) string {
+	ca.record(ctx, "AuthenticateIdentity")
+	return "https://example.com/done"
+}
+func (ca *contextAuthenticator) SwapIdentitiesContext(ctx context.Context, previousIdentity, newIdentity *SqrlIdentity) error {
+	ca.record(ctx, "SwapIdentities")
+	return nil
+}
+func (ca *contextAuthenticator) RemoveIdentityContext(ctx context.Context, identity *SqrlIdentity) error {
+	ca.record(ctx, "RemoveIdentity")
+	return nil
+}
+func (ca *contextAuthenticator) AskResponseContext(ctx context.Context, identity *SqrlIdentity) *Ask {
+	ca.record(ctx, "AskResponse")
+	return nil
+}
+
+// signedCliRequest creates a first request for nut signed with priv
+func signedCliRequest(nut string, cmd string, priv ed25519.PrivateKey) *CliRequest {
+	req := &CliRequest{
+		Client: &ClientBody{
+			Version: []int{1},
+			Cmd:     cmd,
+			Idk:     Sqrl64.EncodeToString(priv.Public().(ed25519.PublicKey)),
+			Suk:     "suk",
+			Vuk:     "vuk",
+			Opt:     map[string]bool{},
+		},
+		Server: Sqrl64.EncodeToString([]byte("sqrl://example.com/cli.sqrl?nut=" + nut)),
+	}
+	req.Ids = Sqrl64.EncodeToString(ed25519.Sign(priv, req.SigningString()))
+	return req
+}
+
+func TestRequestContext(t *testing.T) {
+	recorder := &contextRecorder{t: t}
+	hoard := &contextHoard{NewMapHoard(), recorder}
+	api := NewSqrlSspAPI(nil, hoard, &contextAuthenticator{recorder}, &contextAuthStore{NewMapAuthStore(), recorder})
+	defer api.Close()
+	ctx := context.WithValue(context.Background(), contextKey("test"), "value")
+
+	w := httptest.NewRecorder()
+	api.Nut(w, httptest.NewRequest("GET", "/nut.sqrl", nil).WithContext(ctx))
+	values, _ := url.ParseQuery(w.Body.String())
+	nut := values.Get("nut")
+
+	_, priv, _ := ed25519.GenerateKey(nil)
+	req := signedCliRequest(nut, "ident", priv)
+	w = httptest.NewRecorder()
+	api.Cli(w, httptest.NewRequest("POST", "/cli.sqrl?nut="+nut, strings.NewReader(req.Encode())).WithContext(ctx))
+	resp, err := ParseCliResponse(w.Body.Bytes())
+	if err != nil || resp.TIF&TIFCommandFailed != 0 {
+		t.Fatalf("Failed ident: %v %v", resp, err)
+	}
+
+	w = httptest.NewRecorder()
+	api.Pag(w, httptest.NewRequest("GET", "/pag.sqrl?nut="+nut+"&pag="+values.Get("pag"), nil).WithContext(ctx))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed pag: %v", w.Code)
+	}
+
+	expected := "Save GetAndDelete FindIdentity AuthenticateIdentity SaveIdentity Save Save GetAndDelete AuthenticateIdentity"
+	if calls := strings.Join(recorder.calls, " "); calls != expected {
+		t.Fatalf("Wrong calls %v expected %v", calls, expected)
+	}
+}
+
+func TestContextAdapters(t *testing.T) {
+	mapHoard := NewMapHoard()
+	defer mapHoard.Close()
+	hoard := ContextHoard(mapHoard)
+	ctx := context.Background()
+	if err := hoard.SaveContext(ctx, Nut("nut"), &HoardCache{}, time.Minute); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	if _, err := hoard.GetAndDeleteContext(ctx, Nut("nut")); err != nil {
+		t.Fatalf("Failed get and delete: %v", err)
+	}
+
+	store := ContextAuthStore(NewMapAuthStore())
+	store.SaveIdentityContext(ctx, &SqrlIdentity{Idk: "idk"})
+	if _, err := store.FindIdentityContext(ctx, "idk"); err != nil {
+		t.Fatalf("Failed find: %v", err)
+	}
+
+	contextStore := &contextAuthStore{}
+	if ContextAuthStore(contextStore) != AuthStoreContext(contextStore) {
+		t.Fatalf("Wrapped a store that implements AuthStoreContext")
+	}
+}
@@ -0,0 +1,73 @@
+package ssp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// CounterStore persists the high-water mark of a GrcTree counter so
+// that a restarted server never reissues a counter value. The GrcTree
+// reserves blocks of values and saves the end of each block before
+// issuing any value from it.
+type CounterStore interface {
+	// Load returns the last saved high-water mark or 0 if none was saved
+	Load() (uint64, error)
+	// Save durably stores a new high-water mark
+	Save(highWater uint64) error
+}
+
+// FileCounterStore is a CounterStore that keeps the high-water
+// mark in a local file. Saves write a temp file and rename it
+// over the old one so a crash never leaves a partial value.
+type FileCounterStore struct {
+	path string
+}
+
+// NewFileCounterStore stores the counter at path
+func NewFileCounterStore(path string) *FileCounterStore {
+	return &FileCounterStore{path: path}
+}
+
+// Load implements CounterStore
+func (fcs *FileCounterStore) Load() (uint64, error) {
+	b, err := ioutil.ReadFile(fcs.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed reading counter file: %v", err)
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid counter file %v: %v", fcs.path, err)
+	}
+	return value, nil
+}
+
+// Save implements CounterStore
+func (fcs *FileCounterStore) Save(highWater uint64) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(fcs.path), filepath.Base(fcs.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed creating counter file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(strconv.FormatUint(highWater, 10) + "\n")
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed writing counter file: %v", err)
+	}
+	err = os.Rename(tmp.Name(), fcs.path)
+	if err != nil {
+		return fmt.Errorf("failed replacing counter file: %v", err)
+	}
+	return nil
+}
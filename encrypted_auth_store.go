@@ -0,0 +1,189 @@
+package ssp
+
+import (
+	"context"
+	"fmt"
+)
+
+// EncryptedAuthStore is an AuthStore that encrypts the Suk and Vuk
+// (and optionally Pidk) of identities before saving them in another
+// AuthStore and decrypts them when they're found. These keys gate
+// the enable and remove commands so they shouldn't be stored in the
+// clear. Each value is bound to its Idk and field so encrypted
+// values can't be swapped between identities.
+//
+// An encrypted key is sealedKeyLength (96) characters so the inner
+// store must allow for that. SQLAuthStore's suk, vuk and pidk
+// columns hold 128.
+type EncryptedAuthStore struct {
+	store       AuthStore
+	keyRing     *AEADKeyRing
+	encryptPidk bool
+}
+
+// sealedKeyLength is the Sqrl64 length of a sealed 32 byte key: the
+// key ID, a 12 byte GCM nonce, the 43 character key and a 16 byte tag
+const sealedKeyLength = (1 + 12 + 43 + 16) * 4 / 3
+
+// NewEncryptedAuthStore wraps store. If encryptPidk is set the Pidk
+// is encrypted too, which prevents the inner store from looking up
+// identities by Pidk. Identities already in the store that weren't
+// encrypted can't be read.
+func NewEncryptedAuthStore(store AuthStore, keyRing *AEADKeyRing, encryptPidk bool) *EncryptedAuthStore {
+	return &EncryptedAuthStore{
+		store:       store,
+		keyRing:     keyRing,
+		encryptPidk: encryptPidk,
+	}
+}
+
+// Close implements io.Closer by closing the inner store if it can be
+func (eas *EncryptedAuthStore) Close() error {
+	return closeIfCloser(eas.store)
+}
+
+func (eas *EncryptedAuthStore) seal(idk, field, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	sealed, err := eas.keyRing.Seal([]byte(value), []byte(field+":"+idk))
+	if err != nil {
+		return "", err
+	}
+	return Sqrl64.EncodeToString(sealed), nil
+}
+
+func (eas *EncryptedAuthStore) open(idk, field, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	sealed, err := Sqrl64.DecodeString(value)
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	plaintext, err := eas.keyRing.Open(sealed, []byte(field+":"+idk))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// encrypt returns an encrypted copy of identity
+func (eas *EncryptedAuthStore) encrypt(identity *SqrlIdentity) (*SqrlIdentity, error) {
+	encrypted := *identity
+	var err error
+	encrypted.Suk, err = eas.seal(identity.Idk, "suk", identity.Suk)
+	if err != nil {
+		return nil, err
+	}
+	encrypted.Vuk, err = eas.seal(identity.Idk, "vuk", identity.Vuk)
+	if err != nil {
+		return nil, err
+	}
+	if eas.encryptPidk {
+		encrypted.Pidk, err = eas.seal(identity.Idk, "pidk", identity.Pidk)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &encrypted, nil
+}
+
+// decrypt returns a decrypted copy of identity
+func (eas *EncryptedAuthStore) decrypt(identity *SqrlIdentity) (*SqrlIdentity, error) {
+	decrypted := *identity
+	var err error
+	decrypted.Suk, err = eas.open(identity.Idk, "suk", identity.Suk)
+	if err != nil {
+		return nil, fmt.Errorf("failed decrypting suk of %v: %v", identity.Idk, err)
+	}
+	decrypted.Vuk, err = eas.open(identity.Idk, "vuk", identity.Vuk)
+	if err != nil {
+		return nil, fmt.Errorf("failed decrypting vuk of %v: %v", identity.Idk, err)
+	}
+	if eas.encryptPidk {
+		decrypted.Pidk, err = eas.open(identity.Idk, "pidk", identity.Pidk)
+		if err != nil {
+			return nil, fmt.Errorf("failed decrypting pidk of %v: %v", identity.Idk, err)
+		}
+	}
+	return &decrypted, nil
+}
+
+// FindIdentity implements AuthStore
+func (eas *EncryptedAuthStore) FindIdentity(idk string) (*SqrlIdentity, error) {
+	return eas.FindIdentityContext(context.Background(), idk)
+}
+
+// FindIdentityContext implements AuthStoreContext
+func (eas *EncryptedAuthStore) FindIdentityContext(ctx context.Context, idk string) (*SqrlIdentity, error) {
+	identity, err := ContextAuthStore(eas.store).FindIdentityContext(ctx, idk)
+	if err != nil {
+		return nil, err
+	}
+	return eas.decrypt(identity)
+}
+
+// SaveIdentity implements AuthStore. The identity passed
+// in is not modified.
+func (eas *EncryptedAuthStore) SaveIdentity(identity *SqrlIdentity) error {
+	return eas.SaveIdentityContext(context.Background(), identity)
+}
+
+// SaveIdentityContext implements AuthStoreContext
+func (eas *EncryptedAuthStore) SaveIdentityContext(ctx context.Context, identity *SqrlIdentity) error {
+	encrypted, err := eas.encrypt(identity)
+	if err != nil {
+		return err
+	}
+	return ContextAuthStore(eas.store).SaveIdentityContext(ctx, encrypted)
+}
+
+// DeleteIdentity implements AuthStore
+func (eas *EncryptedAuthStore) DeleteIdentity(idk string) error {
+	return eas.DeleteIdentityContext(context.Background(), idk)
+}
+
+// DeleteIdentityContext implements AuthStoreContext
+func (eas *EncryptedAuthStore) DeleteIdentityContext(ctx context.Context, idk string) error {
+	return ContextAuthStore(eas.store).DeleteIdentityContext(ctx, idk)
+}
+
+// ListIdentities implements IdentityLister if the inner store does
+func (eas *EncryptedAuthStore) ListIdentities(filter IdentityFilter, after string, limit int) ([]*SqrlIdentity, error) {
+	lister, ok := eas.store.(IdentityLister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	identities, err := lister.ListIdentities(filter, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	return eas.decryptAll(identities)
+}
+
+// FindIdentitiesByPidk implements IdentityLister if the inner
+// store does and the Pidk isn't encrypted
+func (eas *EncryptedAuthStore) FindIdentitiesByPidk(pidk string) ([]*SqrlIdentity, error) {
+	lister, ok := eas.store.(IdentityLister)
+	if !ok || eas.encryptPidk {
+		return nil, ErrNotSupported
+	}
+	identities, err := lister.FindIdentitiesByPidk(pidk)
+	if err != nil {
+		return nil, err
+	}
+	return eas.decryptAll(identities)
+}
+
+func (eas *EncryptedAuthStore) decryptAll(identities []*SqrlIdentity) ([]*SqrlIdentity, error) {
+	decrypted := make([]*SqrlIdentity, len(identities))
+	for i, identity := range identities {
+		var err error
+		decrypted[i], err = eas.decrypt(identity)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return decrypted, nil
+}
@@ -0,0 +1,135 @@
+package ssp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncryptedAuthStore(t *testing.T) {
+	inner := NewMapAuthStore()
+	kr, _ := NewAEADKeyRing(1, testAEADKey(1))
+	store := NewEncryptedAuthStore(inner, kr, true)
+
+	identity := &SqrlIdentity{
+		Idk:      "idk",
+		Suk:      "suk",
+		Vuk:      "vuk",
+		Pidk:     "pidk",
+		Hardlock: true,
+	}
+	original := *identity
+	if err := store.SaveIdentity(identity); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	if *identity != original {
+		t.Fatalf("Save modified the identity: %#v", identity)
+	}
+
+	stored, _ := inner.FindIdentity("idk")
+	if stored.Suk == "suk" || stored.Vuk == "vuk" || stored.Pidk == "pidk" || stored.Suk == stored.Vuk {
+		t.Fatalf("Identity stored in the clear: %#v", stored)
+	}
+	if stored.Idk != "idk" || !stored.Hardlock {
+		t.Fatalf("Unencrypted fields changed: %#v", stored)
+	}
+
+	found, err := store.FindIdentity("idk")
+	if err != nil {
+		t.Fatalf("Failed find: %v", err)
+	}
+	if *found != original {
+		t.Fatalf("Wrong identity %#v expected %#v", found, original)
+	}
+	if _, err := store.FindIdentity("missing"); err != ErrNotFound {
+		t.Fatalf("Expected not found but got %v", err)
+	}
+
+	// encrypted values can't be moved to another identity
+	swapped := *stored
+	swapped.Idk = "other"
+	inner.SaveIdentity(&swapped)
+	if _, err := store.FindIdentity("other"); err == nil {
+		t.Fatalf("Decrypted values moved from another identity")
+	}
+
+	if err := store.DeleteIdentity("idk"); err != nil {
+		t.Fatalf("Failed delete: %v", err)
+	}
+	if _, err := inner.FindIdentity("idk"); err != ErrNotFound {
+		t.Fatalf("Expected not found after delete but got %v", err)
+	}
+}
+
+func TestEncryptedAuthStoreSQL(t *testing.T) {
+	db := openTestSQLite(t)
+	defer db.Close()
+	// an identity saved before the columns were widened
+	if err := migrateSQL(db, SQLPlaceholderQuestion, "authstore", sqlAuthStoreMigrations[:2]); err != nil {
+		t.Fatalf("Failed migrate: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO sqrl_identities (` + sqlIdentityColumns + `) VALUES ('old', 'suk', 'vuk', '', 0, 0, 0, '')`); err != nil {
+		t.Fatalf("Failed insert: %v", err)
+	}
+
+	inner, err := NewSQLAuthStore(db, SQLPlaceholderQuestion)
+	if err != nil {
+		t.Fatalf("Failed creating store: %v", err)
+	}
+	var schema string
+	db.QueryRow(`SELECT sql FROM sqlite_master WHERE name = 'sqrl_identities'`).Scan(&schema)
+	if strings.Count(schema, "VARCHAR(128)") != 3 {
+		t.Fatalf("Columns weren't widened: %v", schema)
+	}
+	if old, err := inner.FindIdentity("old"); err != nil || old.Suk != "suk" {
+		t.Fatalf("Identity lost in migration: %#v %v", old, err)
+	}
+
+	kr, _ := NewAEADKeyRing(1, testAEADKey(1))
+	store := NewEncryptedAuthStore(inner, kr, true)
+	// keys are 32 bytes, 43 characters in Sqrl64
+	identity := &SqrlIdentity{
+		Idk:  "-hBaX3BE36R0dkRNSmmur9vNFuMwZG4FCEgcmKkrunM",
+		Suk:  "yVBzTI2Q4HGBmWSMAc2DuoSx3ZubZweAdIKplTia4mI",
+		Vuk:  "GdEBlxqMeZeHhjmEnWInBQTs0zcO6wkqc23o2oATfiw",
+		Pidk: "Ae_29FXOQRfEC69pvNafTgbdf6xgOrIiy44EBQrI4Xs",
+	}
+	if err := store.SaveIdentity(identity); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	stored, _ := inner.FindIdentity(identity.Idk)
+	for _, value := range []string{stored.Suk, stored.Vuk, stored.Pidk} {
+		if len(value) != sealedKeyLength || len(value) > 128 {
+			t.Fatalf("Expected encrypted values of %v characters that fit the columns: %#v", sealedKeyLength, stored)
+		}
+	}
+	found, err := store.FindIdentity(identity.Idk)
+	if err != nil || *found != *identity {
+		t.Fatalf("Wrong identity %#v: %v", found, err)
+	}
+}
+
+func TestEncryptedAuthStorePlainPidk(t *testing.T) {
+	inner := NewMapAuthStore()
+	kr, _ := NewAEADKeyRing(1, testAEADKey(1))
+	store := NewEncryptedAuthStore(inner, kr, false)
+
+	store.SaveIdentity(&SqrlIdentity{Idk: "idk", Suk: "suk", Vuk: "vuk", Pidk: "pidk"})
+	stored, _ := inner.FindIdentity("idk")
+	if stored.Pidk != "pidk" || stored.Suk == "suk" {
+		t.Fatalf("Wrong fields encrypted: %#v", stored)
+	}
+	found, err := store.FindIdentity("idk")
+	if err != nil || found.Pidk != "pidk" || found.Suk != "suk" {
+		t.Fatalf("Failed find: %#v %v", found, err)
+	}
+}
+
+func TestEncryptedAuthStoreLister(t *testing.T) {
+	kr, _ := NewAEADKeyRing(1, testAEADKey(1))
+	testIdentityLister(t, NewEncryptedAuthStore(NewMapAuthStore(), kr, false))
+
+	store := NewEncryptedAuthStore(NewMapAuthStore(), kr, true)
+	if _, err := store.FindIdentitiesByPidk("pidk"); err != ErrNotSupported {
+		t.Fatalf("Expected not supported with encrypted pidk but got %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package ssp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// EncryptedHoard is a Hoard that seals values before storing them in
+// another Hoard so a compromised cache doesn't leak pending
+// authentications. The nut is authenticated along with the value so
+// sealed values can't be moved to a different nut.
+type EncryptedHoard struct {
+	hoard   Hoard
+	keyRing *AEADKeyRing
+}
+
+// NewEncryptedHoard wraps hoard. Values already in the hoard that
+// weren't sealed can't be read.
+func NewEncryptedHoard(hoard Hoard, keyRing *AEADKeyRing) *EncryptedHoard {
+	return &EncryptedHoard{
+		hoard:   hoard,
+		keyRing: keyRing,
+	}
+}
+
+// Close implements io.Closer by closing the inner hoard if it can be
+func (eh *EncryptedHoard) Close() error {
+	return closeIfCloser(eh.hoard)
+}
+
+// sealedStatePrefix starts the HoardCache.State of a sealedValue
+const sealedStatePrefix = "sealed:"
+
+// sealedValue is an encrypted HoardCache. It's stored in the inner
+// hoard as the State of an otherwise empty HoardCache so any Hoard
+// that can store a HoardCache can store it.
+type sealedValue []byte
+
+func (sv sealedValue) hoardCache() *HoardCache {
+	return &HoardCache{State: sealedStatePrefix + Sqrl64.EncodeToString(sv)}
+}
+
+// sealedValueFrom gets the sealedValue stored in hoardCache
+func sealedValueFrom(hoardCache *HoardCache) (sealedValue, error) {
+	if !strings.HasPrefix(hoardCache.State, sealedStatePrefix) {
+		return nil, fmt.Errorf("hoard value isn't sealed")
+	}
+	return Sqrl64.DecodeString(strings.TrimPrefix(hoardCache.State, sealedStatePrefix))
+}
+
+func (eh *EncryptedHoard) open(nut Nut, stored *HoardCache) (*HoardCache, error) {
+	sealed, err := sealedValueFrom(stored)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hoard value for %v: %v", nut, err)
+	}
+	plaintext, err := eh.keyRing.Open(sealed, []byte(nut))
+	if err != nil {
+		return nil, fmt.Errorf("failed opening hoard value for %v: %v", nut, err)
+	}
+	value := &HoardCache{}
+	err = json.Unmarshal(plaintext, value)
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding hoard value: %v", err)
+	}
+	return value, nil
+}
+
+// Get implements Hoard
+func (eh *EncryptedHoard) Get(nut Nut) (*HoardCache, error) {
+	return eh.GetContext(context.Background(), nut)
+}
+
+// GetContext implements HoardContext
+func (eh *EncryptedHoard) GetContext(ctx context.Context, nut Nut) (*HoardCache, error) {
+	sealed, err := ContextHoard(eh.hoard).GetContext(ctx, nut)
+	if err != nil {
+		return nil, err
+	}
+	return eh.open(nut, sealed)
+}
+
+// GetAndDelete implements Hoard
+func (eh *EncryptedHoard) GetAndDelete(nut Nut) (*HoardCache, error) {
+	return eh.GetAndDeleteContext(context.Background(), nut)
+}
+
+// GetAndDeleteContext implements HoardContext
+func (eh *EncryptedHoard) GetAndDeleteContext(ctx context.Context, nut Nut) (*HoardCache, error) {
+	sealed, err := ContextHoard(eh.hoard).GetAndDeleteContext(ctx, nut)
+	if err != nil {
+		return nil, err
+	}
+	return eh.open(nut, sealed)
+}
+
+// Save implements Hoard
+func (eh *EncryptedHoard) Save(nut Nut, value *HoardCache, expiration time.Duration) error {
+	return eh.SaveContext(context.Background(), nut, value, expiration)
+}
+
+// SaveContext implements HoardContext
+func (eh *EncryptedHoard) SaveContext(ctx context.Context, nut Nut, value *HoardCache, expiration time.Duration) error {
+	plaintext, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed encoding hoard value: %v", err)
+	}
+	sealed, err := eh.keyRing.Seal(plaintext, []byte(nut))
+	if err != nil {
+		return err
+	}
+	return ContextHoard(eh.hoard).SaveContext(ctx, nut, sealedValue(sealed).hoardCache(), expiration)
+}
@@ -0,0 +1,64 @@
+package ssp
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestEncryptedHoard(t *testing.T) {
+	inner := NewMapHoard()
+	kr, _ := NewAEADKeyRing(1, testAEADKey(1))
+	h := NewEncryptedHoard(inner, kr)
+	defer h.Close()
+
+	hoardCache := &HoardCache{
+		State:        "authenticated",
+		RemoteIP:     "192.0.2.1",
+		OriginalNut:  "orig",
+		PagNut:       "pag",
+		Identity:     &SqrlIdentity{Idk: "idk", Suk: "secretsuk", Vuk: "secretvuk"},
+		LastResponse: []byte("response"),
+	}
+	if err := h.Save(Nut("nut"), hoardCache, time.Minute); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+
+	stored, _ := inner.Get(Nut("nut"))
+	sealed, err := sealedValueFrom(stored)
+	if err != nil || stored.Identity != nil || stored.RemoteIP != "" || stored.LastResponse != nil {
+		t.Fatalf("Inner hoard value isn't sealed: %#v %v", stored, err)
+	}
+	if bytes.Contains(sealed, []byte("secretsuk")) {
+		t.Fatalf("Sealed value contains plaintext")
+	}
+
+	val, err := h.Get(Nut("nut"))
+	if err != nil {
+		t.Fatalf("Failed get: %v", err)
+	}
+	expected, _ := json.Marshal(hoardCache)
+	actual, _ := json.Marshal(val)
+	if !bytes.Equal(expected, actual) {
+		t.Fatalf("Wrong value %s expected %s", actual, expected)
+	}
+
+	// a sealed value moved to another nut isn't accepted
+	inner.Save(Nut("other"), stored, time.Minute)
+	if _, err := h.GetAndDelete(Nut("other")); err == nil {
+		t.Fatalf("Opened value under a different nut")
+	}
+	// nor is an unsealed value
+	inner.Save(Nut("plain"), hoardCache, time.Minute)
+	if _, err := h.Get(Nut("plain")); err == nil {
+		t.Fatalf("Accepted unsealed value")
+	}
+
+	if _, err := h.GetAndDelete(Nut("nut")); err != nil {
+		t.Fatalf("Failed get and delete: %v", err)
+	}
+	if _, err := h.GetAndDelete(Nut("nut")); err != ErrNotFound {
+		t.Fatalf("Expected not found but got %v", err)
+	}
+}
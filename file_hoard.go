@@ -0,0 +1,310 @@
+package ssp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// compact the log once it has this many more records than live values
+const fileHoardCompactThreshold = 1000
+
+type fileHoardRecord struct {
+	Nut        Nut         `json:"nut"`
+	Expiration int64       `json:"exp,omitempty"` // unix nanoseconds
+	Value      *HoardCache `json:"value,omitempty"`
+	Deleted    bool        `json:"del,omitempty"`
+}
+
+type valExpire struct {
+	value      *HoardCache
+	expiration time.Time
+}
+
+func (ve valExpire) Expired() bool {
+	return ve.expiration.Before(time.Now())
+}
+
+// FileHoard implements a Hoard that keeps its values in memory and
+// persists every change to an append-only log file so in-flight
+// authentications survive a restart. The log is replayed when the
+// hoard is opened and is periodically compacted to only hold the
+// values that haven't expired. It's intended for single servers;
+// the file must not be shared between processes.
+type FileHoard struct {
+	// SyncWrites calls fsync after every write. Without it changes
+	// survive a process restart but may be lost if the machine crashes.
+	SyncWrites bool
+
+	path    string
+	file    *os.File
+	writer  *bufio.Writer
+	cache   map[Nut]*valExpire
+	records int
+	mutex   *sync.Mutex
+	cancel  context.CancelFunc
+	stopped chan struct{}
+}
+
+// NewFileHoard opens or creates the log file at path. Call Close to
+// stop the background cleanup and close the file.
+func NewFileHoard(path string) (*FileHoard, error) {
+	return NewFileHoardContext(context.Background(), path)
+}
+
+// NewFileHoardContext is like NewFileHoard but the background
+// cleanup stops when ctx is done. The file is still closed by Close.
+func NewFileHoardContext(ctx context.Context, path string) (*FileHoard, error) {
+	fh := &FileHoard{
+		path:    path,
+		cache:   make(map[Nut]*valExpire),
+		mutex:   &sync.Mutex{},
+		stopped: make(chan struct{}),
+	}
+	err := fh.replay()
+	if err != nil {
+		return nil, err
+	}
+	// start with a compacted log so the replayed history isn't kept forever
+	err = fh.compact()
+	if err != nil {
+		return nil, err
+	}
+	ctx, fh.cancel = context.WithCancel(ctx)
+	go fh.cleaner(ctx)
+	return fh, nil
+}
+
+func (fh *FileHoard) replay() error {
+	f, err := os.Open(fh.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed opening hoard file: %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		record := &fileHoardRecord{}
+		err := json.Unmarshal(scanner.Bytes(), record)
+		if err != nil {
+			// a crash during a write can leave a partial last record
+			log.Printf("Stopped hoard replay at invalid record %v:%d: %v", fh.path, line, err)
+			break
+		}
+		if record.Deleted {
+			delete(fh.cache, record.Nut)
+			continue
+		}
+		fh.cache[record.Nut] = &valExpire{
+			value:      record.Value,
+			expiration: time.Unix(0, record.Expiration),
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Stopped hoard replay of %v: %v", fh.path, err)
+	}
+	for nut, value := range fh.cache {
+		if value.Expired() {
+			delete(fh.cache, nut)
+		}
+	}
+	return nil
+}
+
+// compact rewrites the log with only the unexpired values.
+// It must be called with the mutex held.
+func (fh *FileHoard) compact() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(fh.path), filepath.Base(fh.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed creating hoard file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	writer := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(writer)
+	for nut, value := range fh.cache {
+		if value.Expired() {
+			delete(fh.cache, nut)
+			continue
+		}
+		err = enc.Encode(&fileHoardRecord{
+			Nut:        nut,
+			Expiration: value.expiration.UnixNano(),
+			Value:      value.value,
+		})
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed writing hoard file: %v", err)
+	}
+	err = os.Rename(tmp.Name(), fh.path)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed replacing hoard file: %v", err)
+	}
+	if fh.file != nil {
+		fh.file.Close()
+	}
+	fh.file = tmp
+	fh.writer = bufio.NewWriter(tmp)
+	fh.records = len(fh.cache)
+	return nil
+}
+
+// Compact rewrites the log file with only the unexpired values.
+// This is done automatically in the background as the log grows.
+func (fh *FileHoard) Compact() error {
+	fh.mutex.Lock()
+	defer fh.mutex.Unlock()
+	if fh.file == nil {
+		return fmt.Errorf("hoard is closed")
+	}
+	return fh.compact()
+}
+
+// Close implements io.Closer. It stops the background cleanup
+// and closes the log file. The hoard can't be used after Close.
+func (fh *FileHoard) Close() error {
+	fh.cancel()
+	<-fh.stopped
+	fh.mutex.Lock()
+	defer fh.mutex.Unlock()
+	if fh.file == nil {
+		return nil
+	}
+	err := fh.writer.Flush()
+	if closeErr := fh.file.Close(); err == nil {
+		err = closeErr
+	}
+	fh.file = nil
+	return err
+}
+
+func (fh *FileHoard) cleaner(ctx context.Context) {
+	defer close(fh.stopped)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fh.mutex.Lock()
+		for nut, value := range fh.cache {
+			if value.Expired() {
+				delete(fh.cache, nut)
+			}
+		}
+		if fh.file != nil && fh.records-len(fh.cache) > fileHoardCompactThreshold && fh.records > 2*len(fh.cache) {
+			err := fh.compact()
+			if err != nil {
+				log.Printf("Failed compacting hoard: %v", err)
+			}
+		}
+		fh.mutex.Unlock()
+	}
+}
+
+// write appends a record to the log. It must be called with the mutex held.
+func (fh *FileHoard) write(record *fileHoardRecord) error {
+	if fh.file == nil {
+		return fmt.Errorf("hoard is closed")
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed encoding hoard record: %v", err)
+	}
+	b = append(b, '\n')
+	_, err = fh.writer.Write(b)
+	if err == nil {
+		err = fh.writer.Flush()
+	}
+	if err == nil && fh.SyncWrites {
+		err = fh.file.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("failed writing hoard record: %v", err)
+	}
+	fh.records++
+	return nil
+}
+
+// Get implements Hoard
+func (fh *FileHoard) Get(nut Nut) (*HoardCache, error) {
+	fh.mutex.Lock()
+	defer fh.mutex.Unlock()
+	if value, ok := fh.cache[nut]; ok {
+		if !value.Expired() {
+			return value.value, nil
+		}
+		// expired values are dropped from the log on compaction
+		delete(fh.cache, nut)
+	}
+	return nil, ErrNotFound
+}
+
+// GetAndDelete implements Hoard
+func (fh *FileHoard) GetAndDelete(nut Nut) (*HoardCache, error) {
+	fh.mutex.Lock()
+	defer fh.mutex.Unlock()
+	value, ok := fh.cache[nut]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	delete(fh.cache, nut)
+	if value.Expired() {
+		return nil, ErrNotFound
+	}
+	err := fh.write(&fileHoardRecord{Nut: nut, Deleted: true})
+	if err != nil {
+		// put it back so the value isn't lost from memory
+		// while it's still in the log
+		fh.cache[nut] = value
+		return nil, err
+	}
+	return value.value, nil
+}
+
+// Save implements Hoard
+func (fh *FileHoard) Save(nut Nut, value *HoardCache, expiration time.Duration) error {
+	if nut == "" {
+		return fmt.Errorf("empty nuts are not allowed")
+	}
+	expires := time.Now().Add(expiration)
+	fh.mutex.Lock()
+	defer fh.mutex.Unlock()
+	err := fh.write(&fileHoardRecord{
+		Nut:        nut,
+		Expiration: expires.UnixNano(),
+		Value:      value,
+	})
+	if err != nil {
+		return err
+	}
+	fh.cache[nut] = &valExpire{
+		value:      value,
+		expiration: expires,
+	}
+	return nil
+}
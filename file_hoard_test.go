@@ -0,0 +1,124 @@
+package ssp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tempHoardPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "filehoard")
+	if err != nil {
+		t.Fatalf("Failed creating temp dir: %v", err)
+	}
+	return filepath.Join(dir, "hoard.log")
+}
+
+func TestFileHoardRestart(t *testing.T) {
+	path := tempHoardPath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	h, err := NewFileHoard(path)
+	if err != nil {
+		t.Fatalf("Failed open: %v", err)
+	}
+	kept := &HoardCache{
+		State:       "associated",
+		RemoteIP:    "192.0.2.1",
+		OriginalNut: "orig",
+		LastRequest: &CliRequest{
+			Client: &ClientBody{Cmd: "query", Idk: "idk", Opt: map[string]bool{"cps": true}},
+		},
+		LastResponse: []byte("response"),
+	}
+	h.Save(Nut("kept"), kept, time.Minute)
+	h.Save(Nut("deleted"), &HoardCache{}, time.Minute)
+	h.Save(Nut("expired"), &HoardCache{}, 0)
+	if _, err := h.GetAndDelete(Nut("deleted")); err != nil {
+		t.Fatalf("Failed get and delete: %v", err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatalf("Failed close: %v", err)
+	}
+	if err := h.Save(Nut("closed"), &HoardCache{}, time.Minute); err == nil {
+		t.Fatalf("Saved to closed hoard")
+	}
+
+	h, err = NewFileHoard(path)
+	if err != nil {
+		t.Fatalf("Failed reopen: %v", err)
+	}
+	defer h.Close()
+	val, err := h.GetAndDelete(Nut("kept"))
+	if err != nil {
+		t.Fatalf("Failed get after restart: %v", err)
+	}
+	if val.State != kept.State || val.RemoteIP != kept.RemoteIP || val.OriginalNut != kept.OriginalNut ||
+		val.LastRequest.Client.Idk != "idk" || !val.LastRequest.Client.Opt["cps"] || string(val.LastResponse) != "response" {
+		t.Fatalf("Wrong value after restart: %#v", val)
+	}
+	for _, nut := range []Nut{"deleted", "expired"} {
+		if _, err := h.Get(nut); err != ErrNotFound {
+			t.Errorf("Expected %v to be gone but got %v", nut, err)
+		}
+	}
+}
+
+func TestFileHoardPartialRecord(t *testing.T) {
+	path := tempHoardPath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	h, _ := NewFileHoard(path)
+	h.Save(Nut("nut"), &HoardCache{State: "issued"}, time.Minute)
+	h.Close()
+
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString(`{"nut":"torn","exp":`)
+	f.Close()
+
+	h, err := NewFileHoard(path)
+	if err != nil {
+		t.Fatalf("Failed reopen: %v", err)
+	}
+	defer h.Close()
+	if val, err := h.Get(Nut("nut")); err != nil || val.State != "issued" {
+		t.Fatalf("Failed get after partial record: %v %v", val, err)
+	}
+	// the next write must not be joined to the partial record
+	h.Save(Nut("after"), &HoardCache{}, time.Minute)
+	b, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(b), "torn") {
+		t.Fatalf("Partial record not compacted away")
+	}
+}
+
+func TestFileHoardCompact(t *testing.T) {
+	path := tempHoardPath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	h, _ := NewFileHoard(path)
+	defer h.Close()
+	for i := 0; i < 100; i++ {
+		h.Save(Nut("nut"), &HoardCache{}, time.Minute)
+	}
+	before, _ := os.Stat(path)
+	if err := h.Compact(); err != nil {
+		t.Fatalf("Failed compact: %v", err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		t.Fatalf("Compact didn't shrink the file %v >= %v", after.Size(), before.Size())
+	}
+	if _, err := h.Get(Nut("nut")); err != nil {
+		t.Fatalf("Lost value on compact: %v", err)
+	}
+	// writes after compacting still go to the file
+	h.Save(Nut("other"), &HoardCache{}, time.Minute)
+	b, _ := ioutil.ReadFile(path)
+	if !strings.Contains(string(b), "other") {
+		t.Fatalf("Write after compact is missing")
+	}
+}
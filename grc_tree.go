@@ -1,42 +1,482 @@
 package ssp
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
+	"net"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/blowfish"
 )
 
 // GrcTree Creates a 64-bit nut based on the GRC spec using a monotonic counter
-// and blowfish cipher
+// and blowfish cipher. NewGrcTree128 creates the 128-bit variant which uses AES
+// and also embeds the time and requester's IP as described in
+// https://www.grc.com/sqrl/server.htm
+//
+// In key-ring mode (see EnableKeyRing) nuts are prefixed with the ID of the
+// key that encrypted them so keys can be rotated without invalidating
+// outstanding nuts.
+//
+// In cluster mode (see EnableCluster) the top bits of the counter hold a
+// node ID so servers sharing a key and Hoard issue disjoint counter values.
+// Nuts also carry an HMAC tag so nodes can reject forged nuts from the
+// ranges of other nodes whose counters they don't know.
 type GrcTree struct {
 	monotonicCounter uint64
-	cipher           *blowfish.Cipher
+	cipher           cipher.Block
+	tagKey           []byte
 	key              []byte
+	newCipher        func(key []byte) (cipher.Block, error)
+	now              func() time.Time
+
+	// key-ring mode
+	keyRing   bool
+	keys      map[byte]cipher.Block
+	tagKeys   map[byte][]byte
+	activeKey byte
+	keyMutex  sync.RWMutex
+
+	// Expiration if set is checked by Verify for 128-bit nuts.
+	// SqrlSspAPI calls VerifyExpiration with it's NutExpiration
+	// instead so this is only for other callers.
+	Expiration time.Duration
+
+	// cluster mode; only used if nodeBits > 0
+	nodeID   uint64
+	nodeBits uint
+
+	// counter checkpointing; only used if store is set
+	store     CounterStore
+	blockSize uint64
+	reserved  uint64
+	mutex     sync.Mutex
+}
+
+// GrcNutInfo is the decrypted content of a nut from a GrcTree.
+// Issued and IP are only set for 128-bit nuts. In cluster mode
+// Counter is the counter of the node that issued the nut.
+type GrcNutInfo struct {
+	Counter uint64
+	NodeID  uint64
+	Issued  time.Time
+	IP      net.IP
+}
+
+// maximum number of bits that can be used for the node ID
+const grcMaxNodeBits = 16
+
+// size of the HMAC tag appended to nuts in cluster mode
+const grcTagSize = 4
+
+// grcTagKey derives the key for cluster mode tags from a cipher key
+func grcTagKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("sqrl-ssp grc nut tag"))
+	return mac.Sum(nil)
+}
+
+// grcTag is the cluster mode tag for an encrypted nut
+func grcTag(tagKey []byte, encrypted []byte) []byte {
+	mac := hmac.New(sha256.New, tagKey)
+	mac.Write(encrypted)
+	return mac.Sum(nil)[:grcTagSize]
 }
 
 // NewGrcTree takes an initial counter value (in the case of reboot) and
 // a blowfish key (use a max key of random 56 bytes)
 // https://godoc.org/golang.org/x/crypto/blowfish
 func NewGrcTree(counterInit uint64, blowfishKey []byte) (*GrcTree, error) {
-	cipher, err := blowfish.NewCipher(blowfishKey)
+	return newGrcTree(counterInit, blowfishKey, newBlowfishCipher)
+}
+
+func newBlowfishCipher(key []byte) (cipher.Block, error) {
+	cipher, err := blowfish.NewCipher(key)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't initialize blowfish cipher: %v", err)
 	}
+	return cipher, nil
+}
+
+// NewGrcTree128 takes an initial counter value and an AES key (16, 24 or
+// 32 bytes). The 128-bit nuts hold the requester's IP, the issue time,
+// the low 32 bits of the counter and 32 random bits.
+func NewGrcTree128(counterInit uint64, aesKey []byte) (*GrcTree, error) {
+	return newGrcTree(counterInit, aesKey, newAESCipher)
+}
+
+func newAESCipher(key []byte) (cipher.Block, error) {
+	cipher, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't initialize aes cipher: %v", err)
+	}
+	return cipher, nil
+}
+
+func newGrcTree(counterInit uint64, key []byte, newCipher func(key []byte) (cipher.Block, error)) (*GrcTree, error) {
+	cipher, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
 	return &GrcTree{
 		monotonicCounter: counterInit,
 		cipher:           cipher,
-		key:              blowfishKey,
+		tagKey:           grcTagKey(key),
+		key:              key,
+		newCipher:        newCipher,
+		now:              time.Now,
 	}, nil
 }
 
+// EnableKeyRing switches the tree to key-ring mode and registers the key
+// the tree was created with under keyID as the active key. This changes the
+// format of the nuts so it must be called before any nuts are issued.
+func (gt *GrcTree) EnableKeyRing(keyID byte) {
+	gt.keyMutex.Lock()
+	defer gt.keyMutex.Unlock()
+	gt.keyRing = true
+	gt.keys = map[byte]cipher.Block{keyID: gt.cipher}
+	gt.tagKeys = map[byte][]byte{keyID: gt.tagKey}
+	gt.activeKey = keyID
+}
+
+// AddKey registers a new key in key-ring mode. The key must be valid for
+// the tree's cipher. Nuts encrypted with it are accepted immediately but
+// it isn't used for new nuts until it's activated.
+func (gt *GrcTree) AddKey(keyID byte, key []byte) error {
+	cipher, err := gt.newCipher(key)
+	if err != nil {
+		return err
+	}
+	gt.keyMutex.Lock()
+	defer gt.keyMutex.Unlock()
+	if !gt.keyRing {
+		return fmt.Errorf("key ring is not enabled")
+	}
+	if _, ok := gt.keys[keyID]; ok {
+		return fmt.Errorf("key %d already exists", keyID)
+	}
+	gt.keys[keyID] = cipher
+	gt.tagKeys[keyID] = grcTagKey(key)
+	return nil
+}
+
+// ActivateKey sets the key that's used for new nuts
+func (gt *GrcTree) ActivateKey(keyID byte) error {
+	gt.keyMutex.Lock()
+	defer gt.keyMutex.Unlock()
+	cipher, ok := gt.keys[keyID]
+	if !ok {
+		return fmt.Errorf("unknown key %d", keyID)
+	}
+	gt.cipher = cipher
+	gt.tagKey = gt.tagKeys[keyID]
+	gt.activeKey = keyID
+	return nil
+}
+
+// RetireKey removes a key so nuts encrypted with it are no longer
+// accepted. The active key can't be retired.
+func (gt *GrcTree) RetireKey(keyID byte) error {
+	gt.keyMutex.Lock()
+	defer gt.keyMutex.Unlock()
+	if _, ok := gt.keys[keyID]; !ok {
+		return fmt.Errorf("unknown key %d", keyID)
+	}
+	if keyID == gt.activeKey {
+		return fmt.Errorf("can't retire the active key %d", keyID)
+	}
+	delete(gt.keys, keyID)
+	delete(gt.tagKeys, keyID)
+	return nil
+}
+
+// activeCipher returns the cipher for new nuts, it's key-ring
+// prefix and the key for cluster mode tags
+func (gt *GrcTree) activeCipher() (cipher.Block, []byte, []byte) {
+	gt.keyMutex.RLock()
+	defer gt.keyMutex.RUnlock()
+	if gt.keyRing {
+		return gt.cipher, []byte{gt.activeKey}, gt.tagKey
+	}
+	return gt.cipher, nil, gt.tagKey
+}
+
+// decryptCipher strips the key-ring prefix from an encrypted nut
+// and returns the cipher to decrypt the rest and the tag key
+func (gt *GrcTree) decryptCipher(encrypted []byte) (cipher.Block, []byte, []byte, error) {
+	gt.keyMutex.RLock()
+	defer gt.keyMutex.RUnlock()
+	if !gt.keyRing {
+		return gt.cipher, encrypted, gt.tagKey, nil
+	}
+	if len(encrypted) == 0 {
+		return nil, nil, nil, ErrInvalidNut
+	}
+	cipher, ok := gt.keys[encrypted[0]]
+	if !ok {
+		return nil, nil, nil, ErrInvalidNut
+	}
+	return cipher, encrypted[1:], gt.tagKeys[encrypted[0]], nil
+}
+
+// NewGrcTreeWithStore creates a GrcTree that resumes from the high-water
+// mark in store. Counter values are reserved in blocks of blockSize and the
+// end of each block is saved before any value from it is used, so after
+// a crash at most blockSize values are skipped but none are reused.
+func NewGrcTreeWithStore(store CounterStore, blockSize uint64, blowfishKey []byte) (*GrcTree, error) {
+	gt, err := NewGrcTree(0, blowfishKey)
+	if err != nil {
+		return nil, err
+	}
+	err = gt.UseCounterStore(store, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	return gt, nil
+}
+
+// UseCounterStore makes the tree checkpoint it's counter to store as
+// described in NewGrcTreeWithStore. The counter resumes from the saved
+// high-water mark if it's above the current value. This must be called
+// before any nuts are issued.
+func (gt *GrcTree) UseCounterStore(store CounterStore, blockSize uint64) error {
+	if blockSize == 0 {
+		return fmt.Errorf("block size must be greater than 0")
+	}
+	highWater, err := store.Load()
+	if err != nil {
+		return fmt.Errorf("couldn't load counter: %v", err)
+	}
+	if highWater > gt.monotonicCounter {
+		gt.monotonicCounter = highWater
+	}
+	gt.store = store
+	gt.blockSize = blockSize
+	gt.reserved = gt.monotonicCounter
+	return nil
+}
+
+// EnableCluster reserves the top nodeBits (1-16) bits of the counter
+// for nodeID so each server in a cluster issues values from its own
+// range. For 128-bit nuts this comes out of the 32 bit counter field.
+// Every node must use the same nodeBits and a unique nodeID.
+//
+// It changes the counter and adds a 4 byte HMAC tag to nuts so it must
+// be called before any nuts are issued. A CounterStore only needs to be
+// per-node since it saves the node's own counter.
+func (gt *GrcTree) EnableCluster(nodeID uint64, nodeBits uint) error {
+	if nodeBits == 0 || nodeBits > grcMaxNodeBits {
+		return fmt.Errorf("node bits must be between 1 and %d", grcMaxNodeBits)
+	}
+	if nodeID >= 1<<nodeBits {
+		return fmt.Errorf("node ID %d doesn't fit in %d bits", nodeID, nodeBits)
+	}
+	gt.nodeID = nodeID
+	gt.nodeBits = nodeBits
+	return nil
+}
+
+// counterMask is the mask for this node's counter in a counter
+// field of width bits
+func (gt *GrcTree) counterMask(width uint) uint64 {
+	localBits := width - gt.nodeBits
+	if localBits == 64 {
+		return ^uint64(0)
+	}
+	return uint64(1)<<localBits - 1
+}
+
+// counterField combines the node ID with a node's counter value
+func (gt *GrcTree) counterField(counter uint64, width uint) (uint64, error) {
+	if gt.nodeBits == 0 {
+		return counter, nil
+	}
+	mask := gt.counterMask(width)
+	// 128-bit nuts wrap like the unclustered counter does
+	if width == 64 && counter > mask {
+		return 0, fmt.Errorf("node counter exhausted")
+	}
+	return gt.nodeID<<(width-gt.nodeBits) | counter&mask, nil
+}
+
+// splitCounterField separates the node ID and the node's counter
+func (gt *GrcTree) splitCounterField(field uint64, width uint) (uint64, uint64) {
+	if gt.nodeBits == 0 {
+		return 0, field
+	}
+	return field >> (width - gt.nodeBits), field & gt.counterMask(width)
+}
+
+// counterWidth is the number of counter bits in a nut for a block size
+func counterWidth(blockSize int) uint {
+	if blockSize == 8 {
+		return 64
+	}
+	return 32
+}
+
 // Nut Create a nut based on the GRC spec.
 func (gt *GrcTree) Nut() (Nut, error) {
+	return gt.NutForIP("")
+}
+
+// NutForIP implements RemoteIPTree. The IP is only included in 128-bit nuts.
+func (gt *GrcTree) NutForIP(remoteIP string) (Nut, error) {
 	nextValue := atomic.AddUint64(&gt.monotonicCounter, 1)
-	nextValueBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(nextValueBytes, nextValue)
-	encrypted := make([]byte, 8)
-	gt.cipher.Encrypt(encrypted, nextValueBytes)
+	if gt.store != nil {
+		err := gt.reserve(nextValue)
+		if err != nil {
+			return "", err
+		}
+	}
+	block, prefix, tagKey := gt.activeCipher()
+	plain := make([]byte, block.BlockSize())
+	field, err := gt.counterField(nextValue, counterWidth(len(plain)))
+	if err != nil {
+		return "", err
+	}
+	if len(plain) == 8 {
+		binary.LittleEndian.PutUint64(plain, field)
+	} else {
+		copy(plain[0:4], ipBits(remoteIP))
+		binary.BigEndian.PutUint32(plain[4:8], uint32(gt.now().Unix()))
+		binary.BigEndian.PutUint32(plain[8:12], uint32(field))
+		_, err := rand.Read(plain[12:16])
+		if err != nil {
+			return "", fmt.Errorf("error reading random bytes: %v", err)
+		}
+	}
+	encrypted := make([]byte, len(prefix)+len(plain))
+	copy(encrypted, prefix)
+	block.Encrypt(encrypted[len(prefix):], plain)
+	if gt.nodeBits > 0 {
+		encrypted = append(encrypted, grcTag(tagKey, encrypted)...)
+	}
 	return Nut(Sqrl64.EncodeToString(encrypted)), nil
 }
+
+// ipBits is the IPv4 address or the first 32 bits of an IPv6 address
+func ipBits(remoteIP string) []byte {
+	ip := net.ParseIP(remoteIP)
+	if ip == nil {
+		return make([]byte, 4)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip[:4]
+}
+
+// reserve makes sure value is below a saved high-water mark
+func (gt *GrcTree) reserve(value uint64) error {
+	if value <= atomic.LoadUint64(&gt.reserved) {
+		return nil
+	}
+	gt.mutex.Lock()
+	defer gt.mutex.Unlock()
+	if value <= gt.reserved {
+		return nil
+	}
+	highWater := value + gt.blockSize - 1
+	err := gt.store.Save(highWater)
+	if err != nil {
+		return fmt.Errorf("couldn't save counter: %v", err)
+	}
+	atomic.StoreUint64(&gt.reserved, highWater)
+	return nil
+}
+
+// Decode decrypts a nut and returns it's counter value. 128-bit
+// nuts only hold the low 32 bits of the counter. In cluster mode
+// this is the counter of the node that issued it.
+func (gt *GrcTree) Decode(nut Nut) (uint64, error) {
+	info, err := gt.Inspect(nut)
+	if err != nil {
+		return 0, err
+	}
+	return info.Counter, nil
+}
+
+// Inspect decrypts a nut and returns all of it's content
+func (gt *GrcTree) Inspect(nut Nut) (*GrcNutInfo, error) {
+	decoded, err := Sqrl64.DecodeString(string(nut))
+	if err != nil {
+		return nil, ErrInvalidNut
+	}
+	block, encrypted, tagKey, err := gt.decryptCipher(decoded)
+	if err != nil {
+		return nil, err
+	}
+	if gt.nodeBits > 0 {
+		if len(encrypted) != block.BlockSize()+grcTagSize {
+			return nil, ErrInvalidNut
+		}
+		tagged := len(decoded) - grcTagSize
+		if !hmac.Equal(decoded[tagged:], grcTag(tagKey, decoded[:tagged])) {
+			return nil, ErrInvalidNut
+		}
+		encrypted = encrypted[:block.BlockSize()]
+	}
+	if len(encrypted) != block.BlockSize() {
+		return nil, ErrInvalidNut
+	}
+	plain := make([]byte, len(encrypted))
+	block.Decrypt(plain, encrypted)
+	info := &GrcNutInfo{}
+	width := counterWidth(len(plain))
+	if len(plain) == 8 {
+		info.NodeID, info.Counter = gt.splitCounterField(binary.LittleEndian.Uint64(plain), width)
+	} else {
+		info.IP = net.IP(plain[0:4])
+		info.Issued = time.Unix(int64(binary.BigEndian.Uint32(plain[4:8])), 0)
+		info.NodeID, info.Counter = gt.splitCounterField(uint64(binary.BigEndian.Uint32(plain[8:12])), width)
+	}
+	return info, nil
+}
+
+// Verify implements NutVerifier. A nut is invalid if it decrypts to a
+// counter value that hasn't been issued yet. In cluster mode only nuts
+// from this node can be checked this way; nuts from other nodes are
+// checked by their tag. 128-bit nuts are also checked against Expiration.
+func (gt *GrcTree) Verify(nut Nut) error {
+	return gt.VerifyExpiration(nut, gt.Expiration)
+}
+
+// VerifyExpiration implements NutExpirationVerifier. It's the same as
+// Verify except 128-bit nuts are checked against expiration.
+func (gt *GrcTree) VerifyExpiration(nut Nut, expiration time.Duration) error {
+	info, err := gt.Inspect(nut)
+	if err != nil {
+		return err
+	}
+	current := atomic.LoadUint64(&gt.monotonicCounter)
+	// 128-bit nuts only hold part of the counter so the check
+	// can't be done once the counter wraps
+	width := uint(64)
+	if !info.Issued.IsZero() {
+		width = 32
+	}
+	if info.NodeID == gt.nodeID && current <= gt.counterMask(width) {
+		if info.Counter == 0 || info.Counter > current {
+			return ErrInvalidNut
+		}
+	}
+	if !info.Issued.IsZero() {
+		now := gt.now()
+		if info.Issued.After(now.Add(nutMaxClockSkew)) {
+			return ErrInvalidNut
+		}
+		if expiration > 0 && now.Sub(info.Issued) > expiration+time.Second {
+			return ErrExpiredNut
+		}
+	}
+	return nil
+}
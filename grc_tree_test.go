@@ -1,6 +1,15 @@
 package ssp
 
-import "testing"
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
 
 func TestGrcStaticGenerate(t *testing.T) {
 	tree, err := NewGrcTree(10, []byte{1, 2, 3, 4})
@@ -45,3 +54,291 @@ func TestGrcUniqueGenerate(t *testing.T) {
 		t.Fatalf("didn't find expected value for 10: xi6Qzk1Kmrg in genereated nuts")
 	}
 }
+
+type failingCounterStore struct{}
+
+func (fcs *failingCounterStore) Load() (uint64, error) {
+	return 0, nil
+}
+
+func (fcs *failingCounterStore) Save(highWater uint64) error {
+	return fmt.Errorf("disk full")
+}
+
+func TestGrcCounterStoreResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grctree")
+	if err != nil {
+		t.Fatalf("Failed creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileCounterStore(filepath.Join(dir, "counter"))
+
+	values := make(map[Nut]struct{})
+	for run := 0; run < 3; run++ {
+		// each run simulates a crash and restart
+		tree, err := NewGrcTreeWithStore(store, 10, []byte{1, 2, 3, 4})
+		if err != nil {
+			t.Fatalf("Error creating tree: %v", err)
+		}
+		for i := 0; i < 25; i++ {
+			nut, err := tree.Nut()
+			if err != nil {
+				t.Fatalf("Error creating nut: %v", err)
+			}
+			if _, ok := values[nut]; ok {
+				t.Fatalf("Found duplicate %v in run %d", nut, run)
+			}
+			values[nut] = struct{}{}
+		}
+		highWater, err := store.Load()
+		if err != nil {
+			t.Fatalf("Failed load: %v", err)
+		}
+		if highWater < tree.monotonicCounter {
+			t.Fatalf("High-water mark %d is below issued counter %d", highWater, tree.monotonicCounter)
+		}
+	}
+}
+
+func TestGrcCounterStoreFailure(t *testing.T) {
+	tree, err := NewGrcTreeWithStore(&failingCounterStore{}, 10, []byte{1, 2, 3, 4})
+	if err != nil {
+		t.Fatalf("Error creating tree: %v", err)
+	}
+	_, err = tree.Nut()
+	if err == nil {
+		t.Fatalf("Expected error when the counter can't be saved")
+	}
+}
+
+func TestGrcDecode(t *testing.T) {
+	tree, err := NewGrcTree(9, []byte{1, 2, 3, 4})
+	if err != nil {
+		t.Fatalf("Error creating tree: %v", err)
+	}
+	counter, err := tree.Decode("xi6Qzk1Kmrg")
+	if err != nil {
+		t.Fatalf("Error decoding nut: %v", err)
+	}
+	if counter != 11 {
+		t.Fatalf("Expected counter 11 but got %d", counter)
+	}
+
+	// not issued yet
+	if err := tree.Verify("xi6Qzk1Kmrg"); err != ErrInvalidNut {
+		t.Fatalf("Expected invalid nut but got %v", err)
+	}
+	nut, _ := tree.Nut()
+	if err := tree.Verify(nut); err != nil {
+		t.Fatalf("Failed verify: %v", err)
+	}
+	if _, err := tree.Decode("short"); err != ErrInvalidNut {
+		t.Fatalf("Expected invalid nut but got %v", err)
+	}
+}
+
+func TestGrc128Inspect(t *testing.T) {
+	tree, err := NewGrcTree128(41, []byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("Error creating tree: %v", err)
+	}
+	issued := time.Unix(1500000000, 0)
+	tree.now = func() time.Time { return issued }
+	tree.Expiration = time.Minute
+
+	nut, err := tree.NutForIP("192.0.2.1")
+	if err != nil {
+		t.Fatalf("Error creating nut: %v", err)
+	}
+	if checkByteSize(nut) != 16 {
+		t.Fatalf("Wrong size expected 16 but got %d", checkByteSize(nut))
+	}
+	info, err := tree.Inspect(nut)
+	if err != nil {
+		t.Fatalf("Error inspecting nut: %v", err)
+	}
+	if info.Counter != 42 {
+		t.Errorf("Expected counter 42 but got %d", info.Counter)
+	}
+	if !info.IP.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("Wrong ip: %v", info.IP)
+	}
+	if !info.Issued.Equal(issued) {
+		t.Errorf("Wrong issue time: %v", info.Issued)
+	}
+
+	if err := tree.Verify(nut); err != nil {
+		t.Fatalf("Failed verify: %v", err)
+	}
+	tree.now = func() time.Time { return issued.Add(2 * time.Minute) }
+	if err := tree.Verify(nut); err != ErrExpiredNut {
+		t.Fatalf("Expected expired nut but got %v", err)
+	}
+}
+
+func TestGrcKeyRotation(t *testing.T) {
+	tree, err := NewGrcTree(0, []byte{1, 2, 3, 4})
+	if err != nil {
+		t.Fatalf("Error creating tree: %v", err)
+	}
+	tree.EnableKeyRing(1)
+	oldNut, _ := tree.Nut()
+	if checkByteSize(oldNut) != 9 {
+		t.Fatalf("Wrong size expected 9 but got %d", checkByteSize(oldNut))
+	}
+
+	if err := tree.AddKey(2, []byte{5, 6, 7, 8}); err != nil {
+		t.Fatalf("Failed adding key: %v", err)
+	}
+	if err := tree.AddKey(2, []byte{5, 6, 7, 8}); err == nil {
+		t.Fatalf("Expected error adding duplicate key")
+	}
+	if err := tree.ActivateKey(2); err != nil {
+		t.Fatalf("Failed activating key: %v", err)
+	}
+	newNut, _ := tree.Nut()
+
+	for nut, expected := range map[Nut]uint64{oldNut: 1, newNut: 2} {
+		counter, err := tree.Decode(nut)
+		if err != nil {
+			t.Fatalf("Failed decode of %v: %v", nut, err)
+		}
+		if counter != expected {
+			t.Fatalf("Expected counter %d but got %d", expected, counter)
+		}
+		if err := tree.Verify(nut); err != nil {
+			t.Fatalf("Failed verify of %v: %v", nut, err)
+		}
+	}
+
+	if err := tree.RetireKey(2); err == nil {
+		t.Fatalf("Expected error retiring the active key")
+	}
+	if err := tree.RetireKey(1); err != nil {
+		t.Fatalf("Failed retiring key: %v", err)
+	}
+	if err := tree.Verify(oldNut); err != ErrInvalidNut {
+		t.Fatalf("Expected retired key nut to be invalid but got %v", err)
+	}
+	if err := tree.Verify(newNut); err != nil {
+		t.Fatalf("Failed verify: %v", err)
+	}
+}
+
+func TestGrcCluster(t *testing.T) {
+	key := []byte{1, 2, 3, 4}
+	node1, _ := NewGrcTree(0, key)
+	node2, _ := NewGrcTree(0, key)
+	if err := node1.EnableCluster(1, 4); err != nil {
+		t.Fatalf("Failed enabling cluster: %v", err)
+	}
+	if err := node2.EnableCluster(2, 4); err != nil {
+		t.Fatalf("Failed enabling cluster: %v", err)
+	}
+	if err := node1.EnableCluster(16, 4); err == nil {
+		t.Fatalf("Expected error for node ID that doesn't fit")
+	}
+
+	values := make(map[Nut]struct{})
+	for i := 0; i < 10; i++ {
+		for _, node := range []*GrcTree{node1, node2} {
+			nut, err := node.Nut()
+			if err != nil {
+				t.Fatalf("Error creating nut: %v", err)
+			}
+			if _, ok := values[nut]; ok {
+				t.Fatalf("Found duplicate %v", nut)
+			}
+			values[nut] = struct{}{}
+		}
+	}
+
+	nut, _ := node2.Nut()
+	info, err := node1.Inspect(nut)
+	if err != nil {
+		t.Fatalf("Failed inspect: %v", err)
+	}
+	if info.NodeID != 2 || info.Counter != 11 {
+		t.Fatalf("Expected node 2 counter 11 but got %d %d", info.NodeID, info.Counter)
+	}
+	// node1 can't check the counter of node2
+	if err := node1.Verify(nut); err != nil {
+		t.Fatalf("Failed verify from other node: %v", err)
+	}
+	if err := node2.Verify(nut); err != nil {
+		t.Fatalf("Failed verify: %v", err)
+	}
+
+	// random values in the range of another node fail the tag check
+	accepted := 0
+	for i := 0; i < 1000; i++ {
+		forged := make([]byte, 8+grcTagSize)
+		rand.Read(forged)
+		if node1.Verify(Nut(Sqrl64.EncodeToString(forged))) == nil {
+			accepted++
+		}
+	}
+	if accepted > 0 {
+		t.Fatalf("Accepted %d forged nuts", accepted)
+	}
+	decoded, _ := Sqrl64.DecodeString(string(nut))
+	decoded[0] ^= 1
+	if err := node1.Verify(Nut(Sqrl64.EncodeToString(decoded))); err != ErrInvalidNut {
+		t.Fatalf("Expected invalid nut for modified nut but got %v", err)
+	}
+	// a nut without a tag isn't accepted in cluster mode
+	plain, _ := NewGrcTree(0, key)
+	untagged, _ := plain.Nut()
+	if err := node1.Verify(untagged); err != ErrInvalidNut {
+		t.Fatalf("Expected invalid nut without tag but got %v", err)
+	}
+}
+
+func TestGrc128Cluster(t *testing.T) {
+	tree, _ := NewGrcTree128(0, []byte("0123456789abcdef"))
+	if err := tree.EnableCluster(5, 8); err != nil {
+		t.Fatalf("Failed enabling cluster: %v", err)
+	}
+	tree.EnableKeyRing(1)
+	if err := tree.AddKey(2, []byte("fedcba9876543210")); err != nil {
+		t.Fatalf("Failed adding key: %v", err)
+	}
+	old, _ := tree.NutForIP("192.0.2.1")
+	tree.ActivateKey(2)
+	if err := tree.Verify(old); err != nil {
+		t.Fatalf("Failed verify of nut from previous key: %v", err)
+	}
+	nut, _ := tree.NutForIP("192.0.2.1")
+	info, err := tree.Inspect(nut)
+	if err != nil {
+		t.Fatalf("Failed inspect: %v", err)
+	}
+	if info.NodeID != 5 || info.Counter != 2 {
+		t.Fatalf("Expected node 5 counter 2 but got %d %d", info.NodeID, info.Counter)
+	}
+	if err := tree.Verify(nut); err != nil {
+		t.Fatalf("Failed verify: %v", err)
+	}
+}
+
+func TestGrc128APIExpiration(t *testing.T) {
+	tree, _ := NewGrcTree128(0, []byte("0123456789abcdef"))
+	issued := time.Unix(1500000000, 0)
+	tree.now = func() time.Time { return issued }
+	api := NewSqrlSspAPI(tree, NewMapHoard(), nil, NewMapAuthStore())
+	defer api.Close()
+	api.NutExpiration = time.Minute
+
+	nut, _ := tree.NutForIP("192.0.2.1")
+	if err := api.verifyNut(nut); err != nil {
+		t.Fatalf("Failed verify: %v", err)
+	}
+	// the API's expiration is used without setting tree.Expiration
+	tree.now = func() time.Time { return issued.Add(2 * time.Minute) }
+	if err := api.verifyNut(nut); err != ErrExpiredNut {
+		t.Fatalf("Expected expired nut but got %v", err)
+	}
+	if err := tree.Verify(nut); err != nil {
+		t.Fatalf("Expected no expiration check without Expiration but got %v", err)
+	}
+}
@@ -1,11 +1,13 @@
 package ssp
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
+	"regexp"
 
 	qrcode "github.com/skip2/go-qrcode"
 )
@@ -16,13 +18,14 @@ type nutJSON struct {
 	Expiration int `json:"exp"`
 }
 
-// Nut implements the /nut.sqrl endpoint
-// TODO sin, ask and 1-9 params
+// Nut implements the /nut.sqrl endpoint. The optional sin
+// parameter requests a secure index from the client.
+// TODO ask and 1-9 params
 func (api *SqrlSspAPI) Nut(w http.ResponseWriter, r *http.Request) {
 	hoardCache, err := api.createAndSaveNut(r)
 	if err != nil {
 		log.Print(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(saveNutStatus(err))
 		return
 	}
 
@@ -58,33 +61,76 @@ func (api *SqrlSspAPI) Nut(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// the sin is echoed in the CRLF delimited client response so only
+// a short alphanumeric value is accepted
+var validSin = regexp.MustCompile("^[0-9A-Za-z]{1,16}$")
+
+// errInvalidSin is returned by createAndSaveNut for a bad sin parameter
+var errInvalidSin = fmt.Errorf("Invalid sin parameter")
+
+// errTooManyNuts is returned by createAndSaveNut when
+// the requester has reached SqrlSspAPI.MaxNutsPerIP
+var errTooManyNuts = fmt.Errorf("Too many nuts requested")
+
 func (api *SqrlSspAPI) createAndSaveNut(r *http.Request) (*HoardCache, error) {
-	nut, err := api.tree.Nut()
+	sin := r.URL.Query().Get("sin")
+	if sin != "" && !validSin.MatchString(sin) {
+		return nil, errInvalidSin
+	}
+	if api.MaxNutsPerIP > 0 {
+		trustedIP := api.TrustedIP
+		if trustedIP == nil {
+			trustedIP = RemoteAddrIP
+		}
+		if !api.nutQuota.allow(trustedIP(r), api.MaxNutsPerIP, api.NutExpiration) {
+			return nil, errTooManyNuts
+		}
+	}
+	remoteIP := api.RemoteIP(r)
+	nut, err := api.nut(remoteIP)
 	if err != nil {
 		return nil, fmt.Errorf("Failed generating nut: %v", err)
 	}
-	pagnut, err := api.tree.Nut()
+	pagnut, err := api.nut(remoteIP)
 	if err != nil {
 		return nil, fmt.Errorf("Failed generating nut: %v", err)
 	}
 
 	hoardCache := &HoardCache{
 		State:       "issued",
-		RemoteIP:    api.RemoteIP(r),
+		RemoteIP:    remoteIP,
 		OriginalNut: nut,
 		PagNut:      pagnut,
+		Sin:         sin,
 	}
 	// store the nut in the hoard
-	api.hoard.Save(nut, hoardCache, api.NutExpiration)
+	err = ContextHoard(api.hoard).SaveContext(r.Context(), nut, hoardCache, api.NutExpiration)
 	if err != nil {
+		if err == ErrHoardFull {
+			return nil, err
+		}
 		return nil, fmt.Errorf("Failed to save a nut: %v", err)
 	}
 	log.Printf("Saved nut %v in hoard from %v", nut, hoardCache.RemoteIP)
 	return hoardCache, nil
 }
 
-func (api *SqrlSspAPI) getAndDelete(nut Nut) (*HoardCache, error) {
-	hoardCache, err := api.hoard.GetAndDelete(Nut(nut))
+// saveNutStatus is the HTTP status for a createAndSaveNut error
+func saveNutStatus(err error) int {
+	if err == ErrHoardFull {
+		return http.StatusServiceUnavailable
+	}
+	if err == errInvalidSin {
+		return http.StatusBadRequest
+	}
+	if err == errTooManyNuts {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+func (api *SqrlSspAPI) getAndDelete(ctx context.Context, nut Nut) (*HoardCache, error) {
+	hoardCache, err := ContextHoard(api.hoard).GetAndDeleteContext(ctx, nut)
 	if err != nil {
 		return nil, err
 	}
@@ -100,7 +146,8 @@ func (api *SqrlSspAPI) PNG(w http.ResponseWriter, r *http.Request) {
 		// create a nut
 		hoardCache, err = api.createAndSaveNut(r)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			log.Print(err)
+			w.WriteHeader(saveNutStatus(err))
 			return
 		}
 		nut = string(hoardCache.OriginalNut)
@@ -152,7 +199,14 @@ func (api *SqrlSspAPI) Pag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hoardCache, err := api.getAndDelete(Nut(pagnut))
+	err := api.verifyNut(Nut(pagnut))
+	if err != nil {
+		log.Printf("Rejected pag nut: %v", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	hoardCache, err := api.getAndDelete(r.Context(), Nut(pagnut))
 	if err != nil {
 		if err == ErrNotFound {
 			w.WriteHeader(http.StatusNotFound)
@@ -177,10 +231,17 @@ func (api *SqrlSspAPI) Pag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	authURL, err := api.authenticate(withAuthenticationInfo(r.Context(), hoardCache, false), hoardCache.Identity)
+	if err != nil {
+		log.Printf("Failed authenticating identity: %v", err)
+		w.WriteHeader(authenticateStatus(err))
+		return
+	}
+
 	if r.Header.Get("Accept") == "application/json" {
 		w.Header().Add("Content-Type", "application/json")
 		respObj := &pagJSON{
-			URL: api.Authenticator.AuthenticateIdentity(hoardCache.Identity),
+			URL: authURL,
 		}
 		enc, err := json.Marshal(respObj)
 		if err != nil {
@@ -192,5 +253,5 @@ func (api *SqrlSspAPI) Pag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Write([]byte(api.Authenticator.AuthenticateIdentity(hoardCache.Identity)))
+	w.Write([]byte(authURL))
 }
@@ -0,0 +1,131 @@
+package ssp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	hmacNutPayloadSize = 16
+	hmacNutMACSize     = 8
+	hmacNutSize        = hmacNutPayloadSize + hmacNutMACSize
+)
+
+// HMACTree produces stateless Nuts that embed their issue time,
+// a truncated hash of the requester's IP and a node ID. Nuts are
+// authenticated with an HMAC so forged or expired nuts can be
+// rejected with Verify before touching the Hoard.
+//
+// All nodes that share a Hoard must use the same key. The node ID
+// only serves to tell where a nut came from.
+type HMACTree struct {
+	key        []byte
+	nodeID     uint16
+	expiration time.Duration
+	now        func() time.Time
+}
+
+// HMACNutInfo holds the metadata embedded in a Nut from an HMACTree
+type HMACNutInfo struct {
+	Issued time.Time
+	NodeID uint16
+	IPHash uint32
+}
+
+// NewHMACTree takes a secret key of at least 16 bytes, the ID of
+// this node and how long nuts are valid. The expiration is only
+// checked by Verify; SqrlSspAPI calls VerifyExpiration with its
+// NutExpiration instead.
+func NewHMACTree(key []byte, nodeID uint16, expiration time.Duration) (*HMACTree, error) {
+	if len(key) < 16 {
+		return nil, fmt.Errorf("HMAC key must be at least 16 bytes")
+	}
+	return &HMACTree{
+		key:        key,
+		nodeID:     nodeID,
+		expiration: expiration,
+		now:        time.Now,
+	}, nil
+}
+
+// Nut implements Tree. The nut has no IP hash.
+func (ht *HMACTree) Nut() (Nut, error) {
+	return ht.NutForIP("")
+}
+
+// NutForIP implements RemoteIPTree
+func (ht *HMACTree) NutForIP(remoteIP string) (Nut, error) {
+	nut := make([]byte, hmacNutSize)
+	binary.BigEndian.PutUint32(nut[0:4], uint32(ht.now().Unix()))
+	binary.BigEndian.PutUint32(nut[4:8], ht.IPHash(remoteIP))
+	binary.BigEndian.PutUint16(nut[8:10], ht.nodeID)
+	_, err := rand.Read(nut[10:hmacNutPayloadSize])
+	if err != nil {
+		return "", fmt.Errorf("error reading random bytes: %v", err)
+	}
+	copy(nut[hmacNutPayloadSize:], ht.mac(nut[:hmacNutPayloadSize]))
+	return Nut(Sqrl64.EncodeToString(nut)), nil
+}
+
+// IPHash is the truncated keyed hash of an IP address that is embedded in nuts
+func (ht *HMACTree) IPHash(remoteIP string) uint32 {
+	if remoteIP == "" {
+		return 0
+	}
+	mac := hmac.New(sha256.New, ht.key)
+	mac.Write([]byte("ip:"))
+	mac.Write([]byte(remoteIP))
+	return binary.BigEndian.Uint32(mac.Sum(nil))
+}
+
+func (ht *HMACTree) mac(payload []byte) []byte {
+	mac := hmac.New(sha256.New, ht.key)
+	mac.Write([]byte("nut:"))
+	mac.Write(payload)
+	return mac.Sum(nil)[:hmacNutMACSize]
+}
+
+// Inspect checks the nut's HMAC and returns the embedded metadata.
+// It does not check the expiration.
+func (ht *HMACTree) Inspect(nut Nut) (*HMACNutInfo, error) {
+	decoded, err := Sqrl64.DecodeString(string(nut))
+	if err != nil || len(decoded) != hmacNutSize {
+		return nil, ErrInvalidNut
+	}
+	if !hmac.Equal(decoded[hmacNutPayloadSize:], ht.mac(decoded[:hmacNutPayloadSize])) {
+		return nil, ErrInvalidNut
+	}
+	return &HMACNutInfo{
+		Issued: time.Unix(int64(binary.BigEndian.Uint32(decoded[0:4])), 0),
+		IPHash: binary.BigEndian.Uint32(decoded[4:8]),
+		NodeID: binary.BigEndian.Uint16(decoded[8:10]),
+	}, nil
+}
+
+// Verify implements NutVerifier. Nuts are checked against
+// the expiration the tree was created with.
+func (ht *HMACTree) Verify(nut Nut) error {
+	return ht.VerifyExpiration(nut, ht.expiration)
+}
+
+// VerifyExpiration implements NutExpirationVerifier. It's the
+// same as Verify except nuts are checked against expiration.
+func (ht *HMACTree) VerifyExpiration(nut Nut, expiration time.Duration) error {
+	info, err := ht.Inspect(nut)
+	if err != nil {
+		return err
+	}
+	now := ht.now()
+	if info.Issued.After(now.Add(nutMaxClockSkew)) {
+		return ErrInvalidNut
+	}
+	// the issue time is truncated to the second
+	if expiration > 0 && now.Sub(info.Issued) > expiration+time.Second {
+		return ErrExpiredNut
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package ssp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestHMACGenerate(t *testing.T) {
+	tree, err := NewHMACTree([]byte("0123456789abcdef"), 7, time.Minute)
+	if err != nil {
+		t.Fatalf("Error creating tree: %v", err)
+	}
+	issued := time.Unix(1500000000, 0)
+	tree.now = func() time.Time { return issued }
+
+	nut, err := tree.NutForIP("192.0.2.1")
+	if err != nil {
+		t.Fatalf("Error creating nut: %v", err)
+	}
+	if checkByteSize(nut) != hmacNutSize {
+		t.Fatalf("Wrong size expected %d but got %d", hmacNutSize, checkByteSize(nut))
+	}
+	if err := tree.Verify(nut); err != nil {
+		t.Fatalf("Failed verify: %v", err)
+	}
+
+	info, err := tree.Inspect(nut)
+	if err != nil {
+		t.Fatalf("Failed inspect: %v", err)
+	}
+	if !info.Issued.Equal(issued) {
+		t.Errorf("Wrong issue time: %v", info.Issued)
+	}
+	if info.NodeID != 7 {
+		t.Errorf("Wrong node id: %v", info.NodeID)
+	}
+	if info.IPHash != tree.IPHash("192.0.2.1") || info.IPHash == tree.IPHash("192.0.2.2") {
+		t.Errorf("Wrong ip hash: %v", info.IPHash)
+	}
+
+	other, _ := tree.NutForIP("192.0.2.1")
+	if other == nut {
+		t.Errorf("Found duplicate %v", nut)
+	}
+}
+
+func TestHMACVerifyRejects(t *testing.T) {
+	tree, _ := NewHMACTree([]byte("0123456789abcdef"), 1, time.Minute)
+	otherTree, _ := NewHMACTree([]byte("fedcba9876543210"), 1, time.Minute)
+	now := time.Now()
+	tree.now = func() time.Time { return now }
+
+	nut, _ := tree.Nut()
+	forged, _ := otherTree.Nut()
+	decoded, _ := Sqrl64.DecodeString(string(nut))
+	decoded[9] ^= 1
+	tampered := Nut(Sqrl64.EncodeToString(decoded))
+
+	for _, bad := range []Nut{forged, tampered, "garbage", ""} {
+		if err := tree.Verify(bad); err != ErrInvalidNut {
+			t.Errorf("Expected invalid nut for %v but got %v", bad, err)
+		}
+	}
+
+	tree.now = func() time.Time { return now.Add(2 * time.Minute) }
+	if err := tree.Verify(nut); err != ErrExpiredNut {
+		t.Errorf("Expected expired nut but got %v", err)
+	}
+	tree.now = func() time.Time { return now.Add(-2 * time.Minute) }
+	if err := tree.Verify(nut); err != ErrInvalidNut {
+		t.Errorf("Expected invalid future nut but got %v", err)
+	}
+}
+
+func TestHMACAPIExpiration(t *testing.T) {
+	tree, _ := NewHMACTree([]byte("0123456789abcdef"), 1, time.Hour)
+	issued := time.Unix(1500000000, 0)
+	tree.now = func() time.Time { return issued }
+	api := NewSqrlSspAPI(tree, NewMapHoard(), nil, NewMapAuthStore())
+	defer api.Close()
+	api.NutExpiration = time.Minute
+
+	nut, _ := tree.NutForIP("192.0.2.1")
+	if err := api.verifyNut(nut); err != nil {
+		t.Fatalf("Failed verify: %v", err)
+	}
+	// the API's expiration is used in place of the tree's
+	tree.now = func() time.Time { return issued.Add(2 * time.Minute) }
+	if err := api.verifyNut(nut); err != ErrExpiredNut {
+		t.Fatalf("Expected expired nut but got %v", err)
+	}
+	if err := tree.Verify(nut); err != nil {
+		t.Fatalf("Expected the tree's expiration for Verify but got %v", err)
+	}
+}
+
+type failingHoard struct {
+	t *testing.T
+}
+
+func (fh *failingHoard) Get(nut Nut) (*HoardCache, error) {
+	fh.t.Fatalf("Unexpected hoard get for %v", nut)
+	return nil, nil
+}
+func (fh *failingHoard) GetAndDelete(nut Nut) (*HoardCache, error) {
+	fh.t.Fatalf("Unexpected hoard get for %v", nut)
+	return nil, nil
+}
+func (fh *failingHoard) Save(nut Nut, value *HoardCache, expiration time.Duration) error {
+	fh.t.Fatalf("Unexpected hoard save for %v", nut)
+	return nil
+}
+
+func TestHMACRejectsBeforeHoard(t *testing.T) {
+	tree, _ := NewHMACTree([]byte("0123456789abcdef"), 1, time.Minute)
+	api := NewSqrlSspAPI(tree, &failingHoard{t}, nil, NewMapAuthStore())
+
+	// a correctly signed request with a forged nut
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	req := &CliRequest{
+		Client: &ClientBody{
+			Version: []int{1},
+			Cmd:     "query",
+			Idk:     Sqrl64.EncodeToString(pub),
+		},
+		Server: Sqrl64.EncodeToString([]byte("sqrl://example.com/cli.sqrl?nut=forged")),
+	}
+	req.Ids = Sqrl64.EncodeToString(ed25519.Sign(priv, req.SigningString()))
+
+	w := httptest.NewRecorder()
+	api.Cli(w, httptest.NewRequest("POST", "/cli.sqrl?nut=forged", strings.NewReader(req.Encode())))
+	resp, err := ParseCliResponse(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("Failed parse: %v", err)
+	}
+	if resp.TIF != TIFClientFailure|TIFCommandFailed {
+		t.Errorf("Expected tif %x but got %x", TIFClientFailure|TIFCommandFailed, resp.TIF)
+	}
+
+	w = httptest.NewRecorder()
+	api.Pag(w, httptest.NewRequest("GET", "/pag.sqrl?nut=forged&pag=forged", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected not found but got %v", w.Code)
+	}
+}
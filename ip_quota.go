@@ -0,0 +1,32 @@
+package ssp
+
+import (
+	"sync"
+	"time"
+)
+
+// ipQuota counts requests per IP in fixed windows. All
+// the counts are dropped when a window ends so memory is
+// bounded by the IPs seen in one window.
+type ipQuota struct {
+	mutex  sync.Mutex
+	start  time.Time
+	counts map[string]int
+}
+
+// allow counts a request from ip and returns false if there
+// have already been max requests from it in the current window
+func (q *ipQuota) allow(ip string, max int, window time.Duration) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	now := time.Now()
+	if q.counts == nil || now.Sub(q.start) >= window {
+		q.start = now
+		q.counts = make(map[string]int)
+	}
+	if q.counts[ip] >= max {
+		return false
+	}
+	q.counts[ip]++
+	return true
+}
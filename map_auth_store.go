@@ -3,6 +3,7 @@ package ssp
 import (
 	"fmt"
 	"log"
+	"sort"
 	"sync"
 )
 
@@ -18,21 +19,26 @@ func NewMapAuthStore() *MapAuthStore {
 	return &MapAuthStore{&sync.Map{}}
 }
 
-// FindIdentity implements AuthStore
+// FindIdentity implements AuthStore. It returns a copy so
+// callers can't change the stored identity without saving it.
 func (m *MapAuthStore) FindIdentity(idk string) (*SqrlIdentity, error) {
 	if knownUser, ok := m.store.Load(idk); ok {
 		log.Printf("Found existing identity: %#v", knownUser)
 		if identity, ok := knownUser.(*SqrlIdentity); ok {
-			return identity, nil
+			return copyIdentity(identity), nil
 		}
 		return nil, fmt.Errorf("Wrong type for identity %t", knownUser)
 	}
 	return nil, ErrNotFound
 }
 
-// SaveIdentity implements AuthStore
+// SaveIdentity implements AuthStore. A copy is stored
+// without the per-request Ins and Pins values.
 func (m *MapAuthStore) SaveIdentity(identity *SqrlIdentity) error {
-	m.store.Store(identity.Idk, identity)
+	stored := *identity
+	stored.Ins = ""
+	stored.Pins = ""
+	m.store.Store(identity.Idk, &stored)
 	return nil
 }
 
@@ -41,3 +47,36 @@ func (m *MapAuthStore) DeleteIdentity(idk string) error {
 	m.store.Delete(idk)
 	return nil
 }
+
+// ListIdentities implements IdentityLister
+func (m *MapAuthStore) ListIdentities(filter IdentityFilter, after string, limit int) ([]*SqrlIdentity, error) {
+	identities := m.matching(func(identity *SqrlIdentity) bool {
+		return identity.Idk > after && filter.Matches(identity)
+	})
+	if limit > 0 && len(identities) > limit {
+		identities = identities[:limit]
+	}
+	return identities, nil
+}
+
+// FindIdentitiesByPidk implements IdentityLister
+func (m *MapAuthStore) FindIdentitiesByPidk(pidk string) ([]*SqrlIdentity, error) {
+	return m.matching(func(identity *SqrlIdentity) bool {
+		return identity.Pidk == pidk
+	}), nil
+}
+
+// matching returns copies of the identities selected by match ordered by Idk
+func (m *MapAuthStore) matching(match func(identity *SqrlIdentity) bool) []*SqrlIdentity {
+	identities := make([]*SqrlIdentity, 0)
+	m.store.Range(func(key, value interface{}) bool {
+		if identity, ok := value.(*SqrlIdentity); ok && match(identity) {
+			identities = append(identities, copyIdentity(identity))
+		}
+		return true
+	})
+	sort.Slice(identities, func(i, j int) bool {
+		return identities[i].Idk < identities[j].Idk
+	})
+	return identities
+}
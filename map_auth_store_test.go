@@ -0,0 +1,99 @@
+package ssp
+
+import (
+	"testing"
+)
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func listedIdks(identities []*SqrlIdentity) string {
+	idks := ""
+	for _, identity := range identities {
+		idks += identity.Idk
+	}
+	return idks
+}
+
+// testIdentityLister checks an AuthStore that implements IdentityLister
+func testIdentityLister(t *testing.T, store AuthStore) {
+	lister, ok := store.(IdentityLister)
+	if !ok {
+		t.Fatalf("%T doesn't implement IdentityLister", store)
+	}
+	for _, identity := range []*SqrlIdentity{
+		{Idk: "a", Suk: "suk", Vuk: "vuk", Rekeyed: "c"},
+		{Idk: "b", Suk: "suk", Vuk: "vuk", Disabled: true},
+		{Idk: "c", Suk: "suk", Vuk: "vuk", Pidk: "a", SQRLOnly: true},
+		{Idk: "d", Suk: "suk", Vuk: "vuk", Pidk: "a", Disabled: true, SQRLOnly: true},
+		{Idk: "e", Suk: "suk", Vuk: "vuk"},
+	} {
+		if err := store.SaveIdentity(identity); err != nil {
+			t.Fatalf("Failed save: %v", err)
+		}
+	}
+
+	cases := []struct {
+		filter IdentityFilter
+		after  string
+		limit  int
+		idks   string
+	}{
+		{IdentityFilter{}, "", 0, "abcde"},
+		{IdentityFilter{}, "", 2, "ab"},
+		{IdentityFilter{}, "b", 2, "cd"},
+		{IdentityFilter{Disabled: boolPtr(true)}, "", 0, "bd"},
+		{IdentityFilter{Disabled: boolPtr(false)}, "", 0, "ace"},
+		{IdentityFilter{Rekeyed: boolPtr(true)}, "", 0, "a"},
+		{IdentityFilter{Rekeyed: boolPtr(false)}, "a", 0, "bcde"},
+		{IdentityFilter{SQRLOnly: boolPtr(true), Disabled: boolPtr(false)}, "", 0, "c"},
+	}
+	for _, c := range cases {
+		identities, err := lister.ListIdentities(c.filter, c.after, c.limit)
+		if err != nil {
+			t.Fatalf("Failed list: %v", err)
+		}
+		if idks := listedIdks(identities); idks != c.idks {
+			t.Errorf("Expected %v for %+v after %q limit %d but got %v", c.idks, c.filter, c.after, c.limit, idks)
+		}
+	}
+	identities, _ := lister.ListIdentities(IdentityFilter{}, "d", 0)
+	if len(identities) != 1 || identities[0].Suk != "suk" {
+		t.Fatalf("Wrong listed identity: %#v", identities)
+	}
+
+	identities, err := lister.FindIdentitiesByPidk("a")
+	if err != nil {
+		t.Fatalf("Failed find by pidk: %v", err)
+	}
+	if idks := listedIdks(identities); idks != "cd" {
+		t.Fatalf("Expected cd for pidk but got %v", idks)
+	}
+	identities, _ = lister.FindIdentitiesByPidk("missing")
+	if len(identities) != 0 {
+		t.Fatalf("Expected no identities but got %v", listedIdks(identities))
+	}
+}
+
+func TestMapAuthStoreLister(t *testing.T) {
+	testIdentityLister(t, NewMapAuthStore())
+}
+
+func TestMapAuthStoreCopies(t *testing.T) {
+	store := NewMapAuthStore()
+	store.SaveIdentity(&SqrlIdentity{Idk: "idk", Pidk: "pidk"})
+
+	found, _ := store.FindIdentity("idk")
+	found.Ins = "ins"
+	found.Suk = "changed"
+	listed, _ := store.ListIdentities(IdentityFilter{}, "", 0)
+	listed[0].Ins = "ins"
+	byPidk, _ := store.FindIdentitiesByPidk("pidk")
+	byPidk[0].Ins = "ins"
+
+	found, _ = store.FindIdentity("idk")
+	if found.Ins != "" || found.Suk != "" {
+		t.Fatalf("Changes to a found identity were stored: %#v", found)
+	}
+}
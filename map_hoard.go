@@ -1,54 +1,80 @@
 package ssp
 
 import (
+	"container/heap"
+	"context"
 	"fmt"
-	"sync"
 	"time"
 )
 
-type valExpire struct {
-	value      *HoardCache
-	expiration time.Time
-}
-
-func (ve valExpire) Expired() bool {
-	return ve.expiration.Before(time.Now())
-}
-
-// MapHoard implements a Hoard that is backed by an in-memory map
+// MapHoard implements a Hoard that is backed by an in-memory map.
+// Entries are also kept in a heap ordered by expiration so expired
+// values are removed without scanning the whole map.
 type MapHoard struct {
-	cache map[Nut]*valExpire
-	mutex *sync.Mutex
+	hoardShard
+	cancel     context.CancelFunc
+	stopped    chan struct{}
+	maxEntries int
 }
 
-// NewMapHoard creates a new MapHoard
+// NewMapHoard creates a new MapHoard. Call Close to
+// stop the background cleanup of expired values.
 func NewMapHoard() *MapHoard {
+	return NewMapHoardContext(context.Background())
+}
+
+// NewMapHoardContext creates a new MapHoard whose background
+// cleanup stops when ctx is done or Close is called.
+func NewMapHoardContext(ctx context.Context) *MapHoard {
+	ctx, cancel := context.WithCancel(ctx)
 	mh := &MapHoard{
-		cache: make(map[Nut]*valExpire),
-		mutex: &sync.Mutex{},
+		hoardShard: hoardShard{
+			cache: make(map[Nut]*hoardEntry),
+		},
+		cancel:  cancel,
+		stopped: make(chan struct{}),
 	}
-	go mh.cleaner()
+	go mh.cleaner(ctx)
 	return mh
 }
 
-func (mh *MapHoard) cleaner() {
+// NewBoundedMapHoard creates a new MapHoard that holds at most
+// maxEntries values. A limit of zero or less is unlimited. When the
+// limit is reached, expired values are removed and if there's still
+// no room Save returns ErrHoardFull. Use SqrlSspAPI.MaxNutsPerIP to
+// stop one client from filling it.
+func NewBoundedMapHoard(maxEntries int) *MapHoard {
+	mh := NewMapHoard()
+	mh.maxEntries = maxEntries
+	return mh
+}
+
+// Close implements io.Closer. It stops the background cleanup
+// and waits for it to finish. The hoard can still be used but
+// expired values are only removed when they're accessed.
+func (mh *MapHoard) Close() error {
+	mh.cancel()
+	<-mh.stopped
+	return nil
+}
+
+func (mh *MapHoard) cleaner(ctx context.Context) {
+	defer close(mh.stopped)
 	ticker := time.NewTicker(100 * time.Millisecond)
-	for start := range ticker.C {
-		mh.mutex.Lock()
-		i := 0
-		for k, v := range mh.cache {
-			if v.Expired() {
-				delete(mh.cache, k)
-			}
-			i++
-			// check for going over time
-			if i%100 == 0 {
-				if time.Now().Sub(start) > 50*time.Millisecond {
-					break
-				}
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
+		// release the lock between batches so callers aren't stalled
+		for mh.clean(now) {
+			if ctx.Err() != nil {
+				return
 			}
 		}
-		mh.mutex.Unlock()
 	}
 }
 
@@ -56,11 +82,11 @@ func (mh *MapHoard) cleaner() {
 func (mh *MapHoard) Get(nut Nut) (*HoardCache, error) {
 	mh.mutex.Lock()
 	defer mh.mutex.Unlock()
-	if value, ok := mh.cache[nut]; ok {
-		if !value.Expired() {
-			return value.value, nil
+	if entry, ok := mh.cache[nut]; ok {
+		if !entry.expired(time.Now()) {
+			return entry.value, nil
 		}
-		delete(mh.cache, nut)
+		mh.remove(entry)
 	}
 	return nil, ErrNotFound
 }
@@ -69,10 +95,10 @@ func (mh *MapHoard) Get(nut Nut) (*HoardCache, error) {
 func (mh *MapHoard) GetAndDelete(nut Nut) (*HoardCache, error) {
 	mh.mutex.Lock()
 	defer mh.mutex.Unlock()
-	if value, ok := mh.cache[nut]; ok {
-		delete(mh.cache, nut)
-		if !value.Expired() {
-			return value.value, nil
+	if entry, ok := mh.cache[nut]; ok {
+		mh.remove(entry)
+		if !entry.expired(time.Now()) {
+			return entry.value, nil
 		}
 	}
 	return nil, ErrNotFound
@@ -83,11 +109,37 @@ func (mh *MapHoard) Save(nut Nut, value *HoardCache, expiration time.Duration) e
 	if nut == "" {
 		return fmt.Errorf("empty nuts are not allowed")
 	}
+	now := time.Now()
+	entry := &hoardEntry{
+		nut:        nut,
+		value:      value,
+		expiration: now.Add(expiration),
+	}
 	mh.mutex.Lock()
 	defer mh.mutex.Unlock()
-	mh.cache[nut] = &valExpire{
-		value:      value,
-		expiration: time.Now().Add(expiration),
+	if previous, ok := mh.cache[nut]; ok {
+		mh.remove(previous)
+	}
+	if !mh.hasRoom() {
+		// only the oldest entries are looked at since they expire first
+		mh.removeExpired(now)
+		if !mh.hasRoom() {
+			return ErrHoardFull
+		}
 	}
+	mh.cache[nut] = entry
+	heap.Push(&mh.expires, entry)
 	return nil
 }
+
+// Len returns the number of values in the hoard including
+// expired values that haven't been cleaned up yet
+func (mh *MapHoard) Len() int {
+	mh.mutex.Lock()
+	defer mh.mutex.Unlock()
+	return len(mh.cache)
+}
+
+func (mh *MapHoard) hasRoom() bool {
+	return mh.maxEntries <= 0 || len(mh.cache) < mh.maxEntries
+}
@@ -1,6 +1,9 @@
 package ssp
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 )
@@ -90,3 +93,178 @@ func TestMapHoardExpired(t *testing.T) {
 		t.Fatalf("Value should be nil: %v", val)
 	}
 }
+
+func TestMapHoardClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	h := NewMapHoardContext(ctx)
+	cancel()
+	select {
+	case <-h.stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("Cleaner didn't stop on context cancel")
+	}
+
+	h = NewMapHoard()
+	if err := h.Close(); err != nil {
+		t.Fatalf("Failed close: %v", err)
+	}
+	// closing twice is fine
+	if err := h.Close(); err != nil {
+		t.Fatalf("Failed second close: %v", err)
+	}
+
+	// still usable after close
+	hoardCache := &HoardCache{}
+	h.Save(Nut("nut"), hoardCache, time.Second)
+	val, err := h.GetAndDelete(Nut("nut"))
+	if err != nil || val != hoardCache {
+		t.Fatalf("Failed get after close: %v %v", val, err)
+	}
+}
+
+func TestBoundedMapHoard(t *testing.T) {
+	h := NewBoundedMapHoard(2)
+	defer h.Close()
+
+	if err := h.Save(Nut("a"), &HoardCache{}, time.Minute); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	if err := h.Save(Nut("b"), &HoardCache{}, time.Minute); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	if err := h.Save(Nut("c"), &HoardCache{}, time.Minute); err != ErrHoardFull {
+		t.Fatalf("Expected max entries but got: %v", err)
+	}
+	// replacing a value doesn't count against the limit
+	if err := h.Save(Nut("b"), &HoardCache{}, time.Minute); err != nil {
+		t.Fatalf("Failed replace: %v", err)
+	}
+
+	// deleting makes room again
+	h.GetAndDelete(Nut("a"))
+	if err := h.Save(Nut("c"), &HoardCache{}, time.Minute); err != nil {
+		t.Fatalf("Failed save after delete: %v", err)
+	}
+}
+
+func TestBoundedMapHoardEvictsExpired(t *testing.T) {
+	h := NewBoundedMapHoard(2)
+	h.Close()
+
+	h.Save(Nut("old1"), &HoardCache{}, 0)
+	h.Save(Nut("old2"), &HoardCache{}, 0)
+	time.Sleep(time.Microsecond)
+	if err := h.Save(Nut("new"), &HoardCache{}, time.Minute); err != nil {
+		t.Fatalf("Expected expired values to be evicted: %v", err)
+	}
+	if h.Len() != 1 || len(h.expires) != 1 {
+		t.Fatalf("Expected 1 value but got %v in the map and %v in the heap", h.Len(), len(h.expires))
+	}
+	h.GetAndDelete(Nut("new"))
+	if len(h.expires) != 0 {
+		t.Fatalf("Expected deleted value to be removed from the heap")
+	}
+}
+
+func TestHoardFullUnavailable(t *testing.T) {
+	hoard := NewBoundedMapHoard(1)
+	api := NewSqrlSspAPI(nil, hoard, nil, NewMapAuthStore())
+	defer api.Close()
+
+	w := httptest.NewRecorder()
+	api.Nut(w, httptest.NewRequest("GET", "/nut.sqrl", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected ok but got %v", w.Code)
+	}
+	w = httptest.NewRecorder()
+	api.Nut(w, httptest.NewRequest("GET", "/nut.sqrl", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected unavailable but got %v", w.Code)
+	}
+	w = httptest.NewRecorder()
+	api.PNG(w, httptest.NewRequest("GET", "/png.sqrl", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected unavailable but got %v", w.Code)
+	}
+}
+
+func TestMaxNutsPerIP(t *testing.T) {
+	hoard := NewMapHoard()
+	defer hoard.Close()
+	api := NewSqrlSspAPI(nil, hoard, nil, NewMapAuthStore())
+	defer api.Close()
+	api.MaxNutsPerIP = 2
+
+	request := func(handler http.HandlerFunc, remoteAddr, forwardedFor string) int {
+		r := httptest.NewRequest("GET", "/nut.sqrl", nil)
+		r.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+	// a client can't get around the limit by changing X-Forwarded-For
+	if code := request(api.Nut, "192.0.2.1:1000", "198.51.100.1"); code != http.StatusOK {
+		t.Fatalf("Expected ok but got %v", code)
+	}
+	if code := request(api.PNG, "192.0.2.1:1001", "198.51.100.2"); code != http.StatusOK {
+		t.Fatalf("Expected ok but got %v", code)
+	}
+	if code := request(api.Nut, "192.0.2.1:1002", "198.51.100.3"); code != http.StatusTooManyRequests {
+		t.Fatalf("Expected too many requests but got %v", code)
+	}
+	if code := request(api.PNG, "192.0.2.1:1003", ""); code != http.StatusTooManyRequests {
+		t.Fatalf("Expected too many requests but got %v", code)
+	}
+	// other IPs aren't affected
+	if code := request(api.Nut, "192.0.2.2:1000", ""); code != http.StatusOK {
+		t.Fatalf("Expected ok but got %v", code)
+	}
+	// rejected requests don't save a nut
+	if hoard.Len() != 3 {
+		t.Fatalf("Expected 3 nuts but got %v", hoard.Len())
+	}
+
+	api.TrustedIP = func(r *http.Request) string { return r.Header.Get("X-Forwarded-For") }
+	if code := request(api.Nut, "192.0.2.1:1004", "198.51.100.4"); code != http.StatusOK {
+		t.Fatalf("Expected TrustedIP to be used but got %v", code)
+	}
+}
+
+func TestMaxNutsPerIPBehindProxy(t *testing.T) {
+	hoard := NewMapHoard()
+	defer hoard.Close()
+	api := NewSqrlSspAPI(nil, hoard, nil, NewMapAuthStore())
+	defer api.Close()
+	api.MaxNutsPerIP = 1
+
+	// every request comes from the proxy which sets X-Real-IP
+	request := func(realIP string) int {
+		r := httptest.NewRequest("GET", "/nut.sqrl", nil)
+		r.RemoteAddr = "10.0.0.1:1000"
+		r.Header.Set("X-Real-IP", realIP)
+		w := httptest.NewRecorder()
+		api.Nut(w, r)
+		return w.Code
+	}
+	// by default the clients share the proxy's limit
+	if code := request("198.51.100.1"); code != http.StatusOK {
+		t.Fatalf("Expected ok but got %v", code)
+	}
+	if code := request("198.51.100.2"); code != http.StatusTooManyRequests {
+		t.Fatalf("Expected the proxy to be limited but got %v", code)
+	}
+
+	api.TrustedIP = func(r *http.Request) string { return r.Header.Get("X-Real-IP") }
+	if code := request("198.51.100.3"); code != http.StatusOK {
+		t.Fatalf("Expected ok but got %v", code)
+	}
+	if code := request("198.51.100.4"); code != http.StatusOK {
+		t.Fatalf("Expected clients to have their own limit but got %v", code)
+	}
+	if code := request("198.51.100.3"); code != http.StatusTooManyRequests {
+		t.Fatalf("Expected too many requests but got %v", code)
+	}
+}
@@ -1,6 +1,7 @@
 package ssp
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
 	"log"
@@ -11,39 +12,76 @@ import (
 type RandomTree struct {
 	byteSize  int
 	valueChan chan Nut
+	ctx       context.Context
+	cancel    context.CancelFunc
+	stopped   chan struct{}
 }
 
 // NewRandomTree takes a bytesize between 8 and 20
 // Shorter nuts are preferred; but if you think your
 // deployment would require more bits to be unique you
-// can create larger ones
+// can create larger ones. Call Close to stop the
+// background generation of values.
 func NewRandomTree(byteSize int) (*RandomTree, error) {
+	return NewRandomTreeContext(context.Background(), byteSize)
+}
+
+// NewRandomTreeContext is like NewRandomTree but the background
+// generation of values stops when ctx is done or Close is called.
+func NewRandomTreeContext(ctx context.Context, byteSize int) (*RandomTree, error) {
 	if byteSize < 8 || byteSize > 20 {
 		return nil, fmt.Errorf("Valid sizes are between 8 and 20 bytes")
 	}
+	ctx, cancel := context.WithCancel(ctx)
 	rt := &RandomTree{
 		byteSize:  byteSize,
 		valueChan: make(chan Nut, 1000), // buffer a thousand values to smooth out load on the enrtopy source
+		ctx:       ctx,
+		cancel:    cancel,
+		stopped:   make(chan struct{}),
 	}
 	go rt.valueReader()
 	return rt, nil
 }
 
+// Close implements io.Closer. It stops the background generation
+// of values and waits for it to finish. Nut returns an error
+// after the tree is closed.
+func (rt *RandomTree) Close() error {
+	rt.cancel()
+	<-rt.stopped
+	return nil
+}
+
 func (rt *RandomTree) valueReader() {
+	defer close(rt.stopped)
 	for {
 		valueBytes := make([]byte, rt.byteSize)
 		_, err := rand.Read(valueBytes)
 		if err != nil {
 			log.Printf("error reading random bytes: %v", err)
-			time.Sleep(time.Millisecond * 10)
+			select {
+			case <-rt.ctx.Done():
+				return
+			case <-time.After(time.Millisecond * 10):
+			}
 			continue
 		}
-		rt.valueChan <- Nut(Sqrl64.EncodeToString(valueBytes))
+		select {
+		case <-rt.ctx.Done():
+			return
+		case rt.valueChan <- Nut(Sqrl64.EncodeToString(valueBytes)):
+		}
 	}
 }
 
 // Nut Create a pure random nut
 func (rt *RandomTree) Nut() (Nut, error) {
+	select {
+	case <-rt.ctx.Done():
+		return "", fmt.Errorf("random tree is closed")
+	default:
+	}
 	select {
 	case val := <-rt.valueChan:
 		return val, nil
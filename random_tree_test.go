@@ -1,6 +1,10 @@
 package ssp
 
-import "testing"
+import (
+	"context"
+	"testing"
+	"time"
+)
 
 func TestRandomGenerate(t *testing.T) {
 	numBytes := 16
@@ -45,3 +49,53 @@ func checkByteSize(nut Nut) int {
 	bytes, _ := Sqrl64.DecodeString(string(nut))
 	return len(bytes)
 }
+
+func TestRandomClose(t *testing.T) {
+	tree, err := NewRandomTree(8)
+	if err != nil {
+		t.Fatalf("Error creating tree: %v", err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed close: %v", err)
+	}
+	if _, err := tree.Nut(); err == nil {
+		t.Fatalf("Expected error from closed tree")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tree, _ = NewRandomTreeContext(ctx, 8)
+	cancel()
+	select {
+	case <-tree.stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("Reader didn't stop on context cancel")
+	}
+}
+
+func TestAPIClose(t *testing.T) {
+	hoard := NewMapHoard()
+	defer hoard.Close()
+	tree, _ := NewRandomTree(8)
+	defer tree.Close()
+	api := NewSqrlSspAPI(nil, hoard, nil, NewMapAuthStore())
+	if err := api.Close(); err != nil {
+		t.Fatalf("Failed close: %v", err)
+	}
+	if _, err := api.tree.Nut(); err == nil {
+		t.Fatalf("Default tree wasn't closed")
+	}
+	// the caller's hoard is left running
+	select {
+	case <-hoard.stopped:
+		t.Fatalf("Caller's hoard was closed")
+	default:
+	}
+
+	api = NewSqrlSspAPI(tree, hoard, nil, NewMapAuthStore())
+	if err := api.Close(); err != nil {
+		t.Fatalf("Failed close: %v", err)
+	}
+	if _, err := tree.Nut(); err != nil {
+		t.Fatalf("Caller's tree was closed: %v", err)
+	}
+}
@@ -0,0 +1,331 @@
+package ssp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisHoard is a Hoard backed by Redis or any server that speaks the
+// Redis protocol (RESP). Values are stored as HoardCache JSON with
+// SET ... PX and GetAndDelete uses GETDEL so a nut can only be used
+// once across all servers sharing the hoard. GETDEL requires Redis 6.2.
+type RedisHoard struct {
+	// KeyPrefix is prepended to nuts to form the Redis keys
+	KeyPrefix string
+	// Password is sent with AUTH on new connections if set
+	Password string
+	// DB is selected on new connections if not 0
+	DB int
+	// Timeout bounds dialing and each command. The deadline of
+	// the context passed to the HoardContext methods is used
+	// instead if it's sooner.
+	Timeout time.Duration
+
+	addr   string
+	pool   chan *respConn
+	mutex  sync.Mutex
+	closed bool
+}
+
+// NewRedisHoard creates a hoard for the server at addr (host:port).
+// Up to maxIdle connections are kept open for reuse.
+func NewRedisHoard(addr string, maxIdle int) *RedisHoard {
+	return &RedisHoard{
+		KeyPrefix: "sqrl:nut:",
+		Timeout:   5 * time.Second,
+		addr:      addr,
+		pool:      make(chan *respConn, maxIdle),
+	}
+}
+
+// Close implements io.Closer. It closes the idle connections
+// and later commands fail instead of opening new ones.
+func (rh *RedisHoard) Close() error {
+	rh.mutex.Lock()
+	rh.closed = true
+	rh.mutex.Unlock()
+	for {
+		select {
+		case conn := <-rh.pool:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// Get implements Hoard
+func (rh *RedisHoard) Get(nut Nut) (*HoardCache, error) {
+	return rh.GetContext(context.Background(), nut)
+}
+
+// GetContext implements HoardContext. The command is
+// abandoned when ctx is done or its deadline passes.
+func (rh *RedisHoard) GetContext(ctx context.Context, nut Nut) (*HoardCache, error) {
+	return rh.getCommand(ctx, "GET", nut)
+}
+
+// GetAndDelete implements Hoard
+func (rh *RedisHoard) GetAndDelete(nut Nut) (*HoardCache, error) {
+	return rh.GetAndDeleteContext(context.Background(), nut)
+}
+
+// GetAndDeleteContext implements HoardContext
+func (rh *RedisHoard) GetAndDeleteContext(ctx context.Context, nut Nut) (*HoardCache, error) {
+	return rh.getCommand(ctx, "GETDEL", nut)
+}
+
+func (rh *RedisHoard) getCommand(ctx context.Context, cmd string, nut Nut) (*HoardCache, error) {
+	reply, err := rh.do(ctx, cmd, rh.KeyPrefix+string(nut))
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrNotFound
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected %v reply: %v", cmd, reply)
+	}
+	hoardCache := &HoardCache{}
+	err = json.Unmarshal(value, hoardCache)
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding hoard value: %v", err)
+	}
+	return hoardCache, nil
+}
+
+// Save implements Hoard
+func (rh *RedisHoard) Save(nut Nut, value *HoardCache, expiration time.Duration) error {
+	return rh.SaveContext(context.Background(), nut, value, expiration)
+}
+
+// SaveContext implements HoardContext
+func (rh *RedisHoard) SaveContext(ctx context.Context, nut Nut, value *HoardCache, expiration time.Duration) error {
+	if nut == "" {
+		return fmt.Errorf("empty nuts are not allowed")
+	}
+	key := rh.KeyPrefix + string(nut)
+	millis := int64(expiration / time.Millisecond)
+	if millis <= 0 {
+		// already expired; make sure an older value isn't left behind
+		_, err := rh.do(ctx, "DEL", key)
+		return err
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed encoding hoard value: %v", err)
+	}
+	reply, err := rh.do(ctx, "SET", key, string(encoded), "PX", strconv.FormatInt(millis, 10))
+	if err != nil {
+		return err
+	}
+	if reply != "OK" {
+		return fmt.Errorf("unexpected SET reply: %v", reply)
+	}
+	return nil
+}
+
+// deadline is the earlier of Timeout from now and the deadline
+// of ctx. It's zero if neither is set.
+func (rh *RedisHoard) deadline(ctx context.Context) time.Time {
+	var deadline time.Time
+	if rh.Timeout > 0 {
+		deadline = time.Now().Add(rh.Timeout)
+	}
+	if ctxDeadline, ok := ctx.Deadline(); ok && (deadline.IsZero() || ctxDeadline.Before(deadline)) {
+		deadline = ctxDeadline
+	}
+	return deadline
+}
+
+func (rh *RedisHoard) do(ctx context.Context, args ...string) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("redis %v failed: %v", args[0], err)
+	}
+	deadline := rh.deadline(ctx)
+	conn, err := rh.conn(ctx, deadline)
+	if err != nil {
+		return nil, err
+	}
+	stop := conn.cancelOnDone(ctx)
+	reply, err := conn.do(deadline, args...)
+	stop()
+	if _, ok := err.(respError); err != nil && !ok {
+		// the connection state is unknown so don't reuse it
+		conn.Close()
+	} else {
+		rh.release(conn)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("redis %v failed: %v", args[0], err)
+	}
+	return reply, nil
+}
+
+func (rh *RedisHoard) conn(ctx context.Context, deadline time.Time) (*respConn, error) {
+	rh.mutex.Lock()
+	closed := rh.closed
+	rh.mutex.Unlock()
+	if closed {
+		return nil, fmt.Errorf("redis hoard is closed")
+	}
+	select {
+	case conn := <-rh.pool:
+		return conn, nil
+	default:
+	}
+	dialer := &net.Dialer{Deadline: deadline}
+	netConn, err := dialer.DialContext(ctx, "tcp", rh.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed connecting to redis: %v", err)
+	}
+	conn := &respConn{
+		Conn:   netConn,
+		reader: bufio.NewReader(netConn),
+	}
+	if rh.Password != "" {
+		_, err = conn.do(deadline, "AUTH", rh.Password)
+	}
+	if err == nil && rh.DB != 0 {
+		_, err = conn.do(deadline, "SELECT", strconv.Itoa(rh.DB))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed setting up redis connection: %v", err)
+	}
+	return conn, nil
+}
+
+func (rh *RedisHoard) release(conn *respConn) {
+	rh.mutex.Lock()
+	defer rh.mutex.Unlock()
+	if rh.closed {
+		conn.Close()
+		return
+	}
+	select {
+	case rh.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// respError is an error reply from the server. The
+// connection is still usable after one of these.
+type respError string
+
+func (re respError) Error() string {
+	return string(re)
+}
+
+type respConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// cancelOnDone interrupts the connection when ctx is done. The
+// returned func stops watching ctx and must be called before the
+// connection is reused.
+func (rc *respConn) cancelOnDone(ctx context.Context) func() {
+	done := ctx.Done()
+	if done == nil {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-done:
+			// a deadline in the past fails the pending read or write
+			rc.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+func (rc *respConn) do(deadline time.Time, args ...string) (interface{}, error) {
+	rc.SetDeadline(deadline)
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	_, err := rc.Write(buf)
+	if err != nil {
+		return nil, err
+	}
+	return readRESP(rc.reader)
+}
+
+// readRESP reads a single reply. Simple strings are returned as a
+// string, bulk strings as []byte, integers as int64 and arrays as
+// []interface{}. Null bulk strings and arrays are nil.
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("invalid reply line %q", line)
+	}
+	body := line[1 : len(line)-2]
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, respError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk length %q", body)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		size, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid array length %q", body)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, size)
+		for i := range values {
+			values[i], err = readRESP(r)
+			if err != nil {
+				if _, ok := err.(respError); !ok {
+					return nil, err
+				}
+				values[i] = err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unknown reply type %q", line[0])
+}
@@ -0,0 +1,318 @@
+package ssp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// respServer is a tiny in-process stand-in for Redis that supports
+// the commands used by RedisHoard
+type respServer struct {
+	listener net.Listener
+	password string
+	mutex    sync.Mutex
+	values   map[string]string
+	expires  map[string]time.Time
+	commands []string
+	conns    []net.Conn
+}
+
+func newRESPServer(t *testing.T, password string) *respServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed listen: %v", err)
+	}
+	rs := &respServer{
+		listener: listener,
+		password: password,
+		values:   make(map[string]string),
+		expires:  make(map[string]time.Time),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			rs.mutex.Lock()
+			rs.conns = append(rs.conns, conn)
+			rs.mutex.Unlock()
+			go rs.serve(conn)
+		}
+	}()
+	return rs
+}
+
+func (rs *respServer) Addr() string {
+	return rs.listener.Addr().String()
+}
+
+func (rs *respServer) lastCommand() (string, []string) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	keys := make([]string, 0, len(rs.values))
+	for key := range rs.values {
+		keys = append(keys, key)
+	}
+	return rs.commands[len(rs.commands)-1], keys
+}
+
+func (rs *respServer) Close() {
+	rs.listener.Close()
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	for _, conn := range rs.conns {
+		conn.Close()
+	}
+}
+
+func (rs *respServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authed := rs.password == ""
+	for {
+		request, err := readRESP(reader)
+		if err != nil {
+			return
+		}
+		parts, ok := request.([]interface{})
+		if !ok || len(parts) == 0 {
+			conn.Write([]byte("-ERR invalid request\r\n"))
+			continue
+		}
+		args := make([]string, len(parts))
+		for i, part := range parts {
+			b, _ := part.([]byte)
+			args[i] = string(b)
+		}
+		cmd := strings.ToUpper(args[0])
+		if cmd == "AUTH" {
+			if len(args) == 2 && args[1] == rs.password {
+				authed = true
+				conn.Write([]byte("+OK\r\n"))
+			} else {
+				conn.Write([]byte("-WRONGPASS invalid password\r\n"))
+			}
+			continue
+		}
+		if !authed {
+			conn.Write([]byte("-NOAUTH Authentication required.\r\n"))
+			continue
+		}
+		conn.Write(rs.command(cmd, args[1:]))
+	}
+}
+
+func (rs *respServer) command(cmd string, args []string) []byte {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	rs.commands = append(rs.commands, cmd)
+	for key, expires := range rs.expires {
+		if !expires.After(time.Now()) {
+			delete(rs.values, key)
+			delete(rs.expires, key)
+		}
+	}
+	switch {
+	case cmd == "PING":
+		return []byte("+PONG\r\n")
+	case cmd == "SELECT" && len(args) == 1:
+		return []byte("+OK\r\n")
+	case cmd == "SET" && len(args) == 4 && strings.ToUpper(args[2]) == "PX":
+		millis, err := strconv.Atoi(args[3])
+		if err != nil || millis <= 0 {
+			return []byte("-ERR invalid expire time in 'set' command\r\n")
+		}
+		rs.values[args[0]] = args[1]
+		rs.expires[args[0]] = time.Now().Add(time.Duration(millis) * time.Millisecond)
+		return []byte("+OK\r\n")
+	case (cmd == "GET" || cmd == "GETDEL") && len(args) == 1:
+		value, ok := rs.values[args[0]]
+		if !ok {
+			return []byte("$-1\r\n")
+		}
+		if cmd == "GETDEL" {
+			delete(rs.values, args[0])
+			delete(rs.expires, args[0])
+		}
+		return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(value), value))
+	case cmd == "DEL":
+		deleted := 0
+		for _, key := range args {
+			if _, ok := rs.values[key]; ok {
+				delete(rs.values, key)
+				delete(rs.expires, key)
+				deleted++
+			}
+		}
+		return []byte(fmt.Sprintf(":%d\r\n", deleted))
+	}
+	return []byte(fmt.Sprintf("-ERR unknown command '%v'\r\n", cmd))
+}
+
+func TestRedisHoard(t *testing.T) {
+	server := newRESPServer(t, "")
+	defer server.Close()
+	h := NewRedisHoard(server.Addr(), 2)
+	defer h.Close()
+
+	hoardCache := &HoardCache{
+		State:       "associated",
+		RemoteIP:    "192.0.2.1",
+		OriginalNut: "orig",
+		PagNut:      "pag",
+		Sin:         "0",
+		LastRequest: &CliRequest{
+			Client: &ClientBody{Cmd: "query", Idk: "idk", Opt: map[string]bool{"suk": true}},
+			Server: "server",
+		},
+		Identity:     &SqrlIdentity{Idk: "idk", Suk: "suk", Disabled: true},
+		LastResponse: []byte("response"),
+	}
+	if err := h.Save(Nut("nut"), hoardCache, time.Minute); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	if _, keys := server.lastCommand(); len(keys) != 1 || keys[0] != "sqrl:nut:nut" {
+		t.Fatalf("Value not saved with key prefix: %v", keys)
+	}
+
+	val, err := h.Get(Nut("nut"))
+	if err != nil {
+		t.Fatalf("Failed get: %v", err)
+	}
+	if val.State != hoardCache.State || val.RemoteIP != hoardCache.RemoteIP || val.OriginalNut != hoardCache.OriginalNut ||
+		val.PagNut != hoardCache.PagNut || val.Sin != hoardCache.Sin || string(val.LastResponse) != "response" ||
+		val.LastRequest.Client.Idk != "idk" || !val.LastRequest.Client.Opt["suk"] || val.LastRequest.Server != "server" ||
+		*val.Identity != *hoardCache.Identity {
+		t.Fatalf("Wrong value %#v", val)
+	}
+
+	val, err = h.GetAndDelete(Nut("nut"))
+	if err != nil || val.OriginalNut != "orig" {
+		t.Fatalf("Failed get and delete: %v %v", val, err)
+	}
+	if _, err := h.GetAndDelete(Nut("nut")); err != ErrNotFound {
+		t.Fatalf("Expected not found but got %v", err)
+	}
+	if cmd, _ := server.lastCommand(); cmd != "GETDEL" {
+		t.Fatalf("Expected GETDEL but got %v", cmd)
+	}
+}
+
+func TestRedisHoardExpired(t *testing.T) {
+	server := newRESPServer(t, "")
+	defer server.Close()
+	h := NewRedisHoard(server.Addr(), 2)
+	defer h.Close()
+
+	h.Save(Nut("nut"), &HoardCache{State: "issued"}, time.Minute)
+	// an already expired save removes the old value
+	if err := h.Save(Nut("nut"), &HoardCache{}, 0); err != nil {
+		t.Fatalf("Failed expired save: %v", err)
+	}
+	if _, err := h.Get(Nut("nut")); err != ErrNotFound {
+		t.Fatalf("Expected not found but got %v", err)
+	}
+
+	h.Save(Nut("short"), &HoardCache{}, 5*time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	if _, err := h.GetAndDelete(Nut("short")); err != ErrNotFound {
+		t.Fatalf("Expected expired but got %v", err)
+	}
+}
+
+func TestRedisHoardAuth(t *testing.T) {
+	server := newRESPServer(t, "secret")
+	defer server.Close()
+
+	noAuth := NewRedisHoard(server.Addr(), 2)
+	defer noAuth.Close()
+	if err := noAuth.Save(Nut("nut"), &HoardCache{}, time.Minute); err == nil {
+		t.Fatalf("Expected error without auth")
+	}
+
+	h := NewRedisHoard(server.Addr(), 2)
+	defer h.Close()
+	h.Password = "secret"
+	h.DB = 2
+	if err := h.Save(Nut("nut"), &HoardCache{}, time.Minute); err != nil {
+		t.Fatalf("Failed save with auth: %v", err)
+	}
+	if _, err := h.Get(Nut("nut")); err != nil {
+		t.Fatalf("Failed get with auth: %v", err)
+	}
+}
+
+func TestRedisHoardConnectionFailure(t *testing.T) {
+	server := newRESPServer(t, "")
+	h := NewRedisHoard(server.Addr(), 2)
+	h.Timeout = time.Second
+	defer h.Close()
+	h.Save(Nut("nut"), &HoardCache{}, time.Minute)
+	server.Close()
+
+	if _, err := h.Get(Nut("nut")); err == nil || err == ErrNotFound {
+		t.Fatalf("Expected connection error but got %v", err)
+	}
+}
+
+func TestRedisHoardContext(t *testing.T) {
+	// a server that accepts connections but never replies
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	h := NewRedisHoard(listener.Addr().String(), 2)
+	h.Timeout = time.Minute
+	defer h.Close()
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := h.GetContext(ctx, Nut("nut")); err == nil {
+		t.Fatalf("Expected error past the context deadline")
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if err := h.SaveContext(ctx, Nut("nut"), &HoardCache{}, time.Minute); err == nil {
+		t.Fatalf("Expected error from canceled context")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("Commands weren't abandoned with the context")
+	}
+}
+
+func TestRedisHoardClosed(t *testing.T) {
+	server := newRESPServer(t, "")
+	defer server.Close()
+	h := NewRedisHoard(server.Addr(), 2)
+	h.Save(Nut("nut"), &HoardCache{}, time.Minute)
+	h.Close()
+
+	if _, err := h.Get(Nut("nut")); err == nil || err == ErrNotFound {
+		t.Fatalf("Expected error after close but got %v", err)
+	}
+	server.mutex.Lock()
+	conns := len(server.conns)
+	server.mutex.Unlock()
+	if conns != 1 {
+		t.Fatalf("Expected no new connections after close but got %v", conns-1)
+	}
+}
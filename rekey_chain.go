@@ -0,0 +1,106 @@
+package ssp
+
+import (
+	"context"
+	"fmt"
+)
+
+// ErrRekeyCycle is returned when following the rekey links
+// of identities comes back to an identity already visited
+var ErrRekeyCycle = fmt.Errorf("Rekey Cycle")
+
+// CurrentIdentity follows the Rekeyed links from idk to the identity
+// that's in use now. This allows references to an old idk to be
+// migrated. If idk hasn't been rekeyed, its own identity is returned.
+// ErrNotFound is returned if idk or one of its successors doesn't exist.
+func (api *SqrlSspAPI) CurrentIdentity(idk string) (*SqrlIdentity, error) {
+	return api.CurrentIdentityContext(context.Background(), idk)
+}
+
+// CurrentIdentityContext is like CurrentIdentity but
+// passes ctx to the AuthStore
+func (api *SqrlSspAPI) CurrentIdentityContext(ctx context.Context, idk string) (*SqrlIdentity, error) {
+	authStore := ContextAuthStore(api.authStore)
+	identity, err := authStore.FindIdentityContext(ctx, idk)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{identity.Idk: true}
+	for identity.Rekeyed != "" {
+		if seen[identity.Rekeyed] {
+			return nil, ErrRekeyCycle
+		}
+		seen[identity.Rekeyed] = true
+		identity, err = authStore.FindIdentityContext(ctx, identity.Rekeyed)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return identity, nil
+}
+
+// RekeyChain returns the history of the identity idk, from the oldest
+// known identity to the newest. Earlier identities are found through
+// Pidk and are only included if they were rekeyed to the following
+// identity. Later identities are found through Rekeyed. If a successor
+// has been deleted the chain ends with an identity that has Rekeyed set.
+// ErrRekeyCycle is returned if either walk comes back to an identity.
+func (api *SqrlSspAPI) RekeyChain(idk string) ([]*SqrlIdentity, error) {
+	return api.RekeyChainContext(context.Background(), idk)
+}
+
+// RekeyChainContext is like RekeyChain but passes ctx to the AuthStore
+func (api *SqrlSspAPI) RekeyChainContext(ctx context.Context, idk string) ([]*SqrlIdentity, error) {
+	authStore := ContextAuthStore(api.authStore)
+	identity, err := authStore.FindIdentityContext(ctx, idk)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{identity.Idk: true}
+
+	// walk backwards through the previous identities
+	previous := make([]*SqrlIdentity, 0)
+	for current := identity; current.Pidk != ""; {
+		prev, err := authStore.FindIdentityContext(ctx, current.Pidk)
+		if err == ErrNotFound {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if prev.Rekeyed != current.Idk {
+			// the pidk was sent but never swapped for this identity
+			break
+		}
+		if seen[prev.Idk] {
+			return nil, ErrRekeyCycle
+		}
+		seen[prev.Idk] = true
+		previous = append(previous, prev)
+		current = prev
+	}
+
+	chain := make([]*SqrlIdentity, 0, len(previous)+1)
+	for i := len(previous) - 1; i >= 0; i-- {
+		chain = append(chain, previous[i])
+	}
+	chain = append(chain, identity)
+
+	// and forwards through the successors
+	for current := identity; current.Rekeyed != ""; {
+		if seen[current.Rekeyed] {
+			return nil, ErrRekeyCycle
+		}
+		seen[current.Rekeyed] = true
+		next, err := authStore.FindIdentityContext(ctx, current.Rekeyed)
+		if err == ErrNotFound {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, next)
+		current = next
+	}
+	return chain, nil
+}
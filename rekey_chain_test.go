@@ -0,0 +1,101 @@
+package ssp
+
+import (
+	"context"
+	"testing"
+)
+
+func rekeyTestAPI(identities ...*SqrlIdentity) *SqrlSspAPI {
+	store := NewMapAuthStore()
+	for _, identity := range identities {
+		store.SaveIdentity(identity)
+	}
+	return NewSqrlSspAPI(nil, nil, nil, store)
+}
+
+func TestRekeyChain(t *testing.T) {
+	api := rekeyTestAPI(
+		&SqrlIdentity{Idk: "a", Rekeyed: "b"},
+		&SqrlIdentity{Idk: "b", Pidk: "a", Rekeyed: "c"},
+		&SqrlIdentity{Idk: "c", Pidk: "b"},
+		// sent a as pidk but a was already swapped for b
+		&SqrlIdentity{Idk: "x", Pidk: "a"},
+	)
+	defer api.Close()
+
+	for _, idk := range []string{"a", "b", "c"} {
+		chain, err := api.RekeyChain(idk)
+		if err != nil {
+			t.Fatalf("Failed chain for %v: %v", idk, err)
+		}
+		if idks := listedIdks(chain); idks != "abc" {
+			t.Errorf("Wrong chain for %v: %v", idk, idks)
+		}
+		current, err := api.CurrentIdentity(idk)
+		if err != nil || current.Idk != "c" {
+			t.Errorf("Wrong current identity for %v: %v %v", idk, current, err)
+		}
+	}
+
+	chain, err := api.RekeyChain("x")
+	if err != nil || listedIdks(chain) != "x" {
+		t.Errorf("Wrong chain for x: %v %v", listedIdks(chain), err)
+	}
+	if _, err := api.RekeyChain("missing"); err != ErrNotFound {
+		t.Errorf("Expected not found but got %v", err)
+	}
+}
+
+func TestRekeyChainBroken(t *testing.T) {
+	api := rekeyTestAPI(
+		&SqrlIdentity{Idk: "a", Rekeyed: "b"},
+		&SqrlIdentity{Idk: "b", Pidk: "a", Rekeyed: "removed"},
+	)
+	defer api.Close()
+	chain, err := api.RekeyChain("a")
+	if err != nil || listedIdks(chain) != "ab" {
+		t.Fatalf("Wrong chain: %v %v", listedIdks(chain), err)
+	}
+	if _, err := api.CurrentIdentity("a"); err != ErrNotFound {
+		t.Fatalf("Expected not found but got %v", err)
+	}
+}
+
+func TestRekeyChainCycle(t *testing.T) {
+	api := rekeyTestAPI(
+		&SqrlIdentity{Idk: "a", Pidk: "c", Rekeyed: "b"},
+		&SqrlIdentity{Idk: "b", Pidk: "a", Rekeyed: "c"},
+		&SqrlIdentity{Idk: "c", Pidk: "b", Rekeyed: "a"},
+	)
+	defer api.Close()
+	for _, idk := range []string{"a", "b", "c"} {
+		if _, err := api.RekeyChain(idk); err != ErrRekeyCycle {
+			t.Fatalf("Expected cycle for %v but got %v", idk, err)
+		}
+		if _, err := api.CurrentIdentity(idk); err != ErrRekeyCycle {
+			t.Fatalf("Expected cycle for %v but got %v", idk, err)
+		}
+	}
+}
+
+func TestRekeyChainContext(t *testing.T) {
+	recorder := &contextRecorder{t: t}
+	store := &contextAuthStore{NewMapAuthStore(), recorder}
+	store.SaveIdentity(&SqrlIdentity{Idk: "a", Rekeyed: "b"})
+	store.SaveIdentity(&SqrlIdentity{Idk: "b", Pidk: "a"})
+	api := NewSqrlSspAPI(nil, nil, nil, store)
+	defer api.Close()
+	ctx := context.WithValue(context.Background(), contextKey("test"), "value")
+
+	chain, err := api.RekeyChainContext(ctx, "b")
+	if err != nil || listedIdks(chain) != "ab" {
+		t.Fatalf("Wrong chain: %v %v", listedIdks(chain), err)
+	}
+	current, err := api.CurrentIdentityContext(ctx, "a")
+	if err != nil || current.Idk != "b" {
+		t.Fatalf("Wrong current identity: %v %v", current, err)
+	}
+	if len(recorder.calls) != 4 {
+		t.Fatalf("Expected every lookup to get the context: %v", recorder.calls)
+	}
+}
@@ -236,7 +236,7 @@ func sqrlapiJs() (*asset, error) {
 	return a, nil
 }
 
-var _successHtml = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x74\x93\x51\x6f\xd3\x30\x10\xc7\xdf\xfd\x29\x0e\x3f\xb0\x56\x43\xc9\xba\x47\x6a\x67\x12\x08\x89\x4a\x03\x69\x1b\xf0\x32\xed\xc1\xb5\xaf\xb1\xa9\x6b\x67\xf6\xa5\x23\x42\xfb\xee\xc8\x49\x03\x43\x08\x3f\x44\xf6\xe5\x7e\xff\xff\x9d\x73\x11\x96\x0e\xbe\x61\xc2\xa2\x32\x0d\x13\xe4\xc8\x63\x73\xd7\x6b\x8d\x39\xbf\x12\xf5\x74\x66\xc2\xbb\xb0\x87\x84\x5e\xf2\x4c\x83\xc7\x6c\x11\x89\xc3\x01\x8d\x53\x92\x2b\xef\x39\xd0\xd0\xa1\xe4\x84\x3f\xa8\xd6\x39\x73\xb0\x09\x77\x92\xe7\xc7\xe4\x55\xe7\xaa\x31\x54\x37\x4c\xd4\x93\x11\x13\xdb\x68\x86\x86\x01\x00\x08\x8d\x81\x30\x9d\x0e\x76\x35\xdb\xef\x7a\xef\x07\xe0\x3e\xb6\x2d\x1a\x0e\x9b\x20\x6a\xbb\x9a\xb3\x2e\x9b\x8d\xc1\x40\x8e\x86\xb7\x20\x72\xa7\x02\x38\x23\xb9\x3b\xc5\x78\x73\x75\x75\x25\xea\x12\x6f\x44\x6d\x2f\x27\xea\x73\x04\x1d\xe3\xde\x21\x58\x95\x41\x69\xea\x55\x71\xd8\x22\x06\xc8\x48\x6f\x60\xdb\x13\x0c\xb1\x4f\x30\xeb\xc0\x93\xca\x90\x5f\x96\xa3\x7a\xb2\xe5\x9d\x56\x84\x06\xb6\x03\x90\x45\xb8\xbb\xb9\xbd\x86\x8c\xe9\x88\x69\x2a\xaf\x9e\x5b\x12\xf5\xd4\xa7\xc8\x3a\xb9\x8e\x5e\xde\xd2\x77\x75\x54\x53\x94\x37\x6c\xd7\x07\x4d\x2e\x06\x68\x91\x6e\x7a\x4c\xc3\x37\x95\x9c\xda\x7a\x5c\x1c\x4f\x9b\x25\xfc\x1c\xb5\x8f\x2a\xc1\x63\xc9\x00\x09\x4f\x2e\x98\xf8\x54\xf9\xa8\x55\x81\xab\x8c\x2a\x69\x5b\xe5\x7e\x9b\x29\xb9\xd0\x2e\x56\xcb\xf5\x6f\xe8\xa8\x52\x06\x39\xb1\x55\xee\xbc\xa3\xc5\xd9\xeb\xb3\x53\xc2\x2e\x26\x28\x56\xe0\x40\xc2\xc5\x1a\x1c\x88\x11\xa8\x3c\x86\x96\xec\x1a\xdc\xf9\xf9\x5c\xc1\x2c\xd8\x29\x97\x40\x8e\x69\xf7\xee\x61\x96\x94\xb3\x64\x59\x6e\x07\x0b\x83\x3a\x1a\xfc\x7a\xbb\x79\x1f\x0f\x5d\x0c\x18\x68\x51\xc8\xfb\x8b\x87\x25\xc8\x11\xff\xab\xbf\x79\x25\xa4\x3e\x05\xf8\x1f\xbd\x7a\x78\x61\xf3\xcc\xa6\xe7\x33\x1b\x5b\x30\x7b\x90\xff\x5e\x24\x77\x66\xcf\x97\x6b\x56\x6a\x72\x66\x3f\xfb\x99\xa8\xfb\x03\x06\xaa\x5a\xa4\x0f\x1e\xcb\xf6\xdd\xb0\x31\x8b\x3f\xb3\xb4\xac\x5c\x08\x98\x3e\x7e\xf9\x74\x0d\xb2\xa8\xaf\xd9\x33\x13\xf5\xf4\xed\xc6\x91\x2e\xbf\xd0\xaf\x00\x00\x00\xff\xff\x7a\xea\xc8\x3b\x49\x03\x00\x00")
+var _successHtml = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x4c\x51\xc1\x8e\x13\x31\x0c\xbd\xe7\x2b\x4c\x4e\xad\x84\x26\xbb\x7b\x64\x33\xa9\x00\xad\xa0\xa8\x80\xd8\xee\x81\x6b\x3a\x71\x9b\xd0\x34\x99\x8d\x3d\x65\x47\x68\xff\x1d\xcd\x4c\x07\xaa\x5c\xec\x67\xc7\x7e\xef\x59\x7b\x3e\x45\x23\xb4\x47\xeb\x8c\xd0\x1c\x38\xa2\xd9\x76\x4d\x83\x44\x6f\xb4\x9a\x72\xa1\x63\x48\x47\x28\x18\x6b\x49\xdc\x47\x24\x8f\xc8\x12\x4e\xe8\x82\xad\xa5\x8d\x51\x02\xf7\x2d\xd6\x92\xf1\x85\x55\x43\x24\xc1\x17\xdc\xd7\x92\x9e\x4b\xb4\x6d\xa8\x46\x48\x19\xa1\xd5\xb4\x48\xe8\x5d\x76\xbd\x11\x00\x00\xba\xc1\xc4\x58\x2e\x89\xbf\x9d\xd7\xef\xbb\x18\x7b\xd8\xe4\xc3\x01\x1d\xac\x93\x56\xfe\x76\xee\xb9\x33\x6b\x87\x89\x03\xf7\xef\x40\x53\x6b\x13\x04\x57\xcb\x70\xc1\xa4\x59\xad\x56\x5a\x0d\xb8\xd1\xca\xdf\x4d\xbf\xde\x03\x21\x51\xc8\x09\x9a\x9c\x8f\x01\xc1\x5b\x82\x1d\x62\x02\x42\x86\x7d\x2e\xc0\x1e\x61\x9e\x01\xb6\x63\x3f\x84\x8d\x65\x74\xb0\xeb\xc7\xea\xf6\xc7\xe3\x06\x08\xcb\x19\xcb\x38\x53\xab\x99\xbb\x56\x93\x20\x4d\x4d\x09\x2d\x5f\xdb\xf1\xcb\x9e\xed\x84\x4a\x23\xce\xb6\x40\xc1\xe7\x0e\x89\xa1\x86\x84\xbf\xe1\xe7\xd7\xcd\x67\xe6\xf6\x71\x02\x17\xcb\x7b\x71\xa9\x57\x39\xc5\x6c\x1d\xd4\xb0\xef\x52\xc3\x21\xa7\xc5\x12\xfe\x8c\x7b\xc3\x1e\x16\x73\x17\xb1\xe5\x8e\xa0\xae\xe1\xee\xe6\x66\x6e\x18\x9e\xcb\x4d\x77\xc2\xc4\xd5\x01\xf9\x21\xe2\x10\x7e\xe8\xd7\x6e\xf1\xdf\xa7\x65\x35\xdc\xeb\x63\x4e\x8c\x69\xa0\xf3\x65\xfb\xfd\x5b\xd5\xda\x42\xf8\x6f\x7a\x41\x6a\x73\x22\x7c\xc2\x17\x5e\x56\xc1\x1d\xef\x47\x02\xaf\xe2\xf5\x8a\x67\x8b\x69\x21\x3f\x3d\x3c\xc9\xb7\x20\x2f\x26\x57\xc3\xe5\xe5\x95\x18\xc2\xe4\x06\x71\x5a\x4d\x5e\x18\xa1\x95\xe7\x53\x34\x7f\x07\x00\x3c\x27\xa4\x3a\x82\x02\x00\x00")
 
 func successHtmlBytes() ([]byte, error) {
 	return bindataRead(
@@ -251,7 +251,7 @@ func successHtml() (*asset, error) {
 		return nil, err
 	}
 
-	info := bindataFileInfo{name: "success.html", size: 841, mode: os.FileMode(420), modTime: time.Unix(1562894854, 0)}
+	info := bindataFileInfo{name: "success.html", size: 642, mode: os.FileMode(420), modTime: time.Unix(1562894854, 0)}
 	a := &asset{bytes: bytes, info: info}
 	return a, nil
 }
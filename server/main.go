@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -12,6 +14,8 @@ import (
 
 var certFile, keyFile string
 var hostOverride, rootPath string
+var hoardFile string
+var proxyHeader string
 var port int
 var help string
 
@@ -21,6 +25,8 @@ func main() {
 	flag.StringVar(&hostOverride, "h", "", "hostname used in creating URLs")
 	flag.StringVar(&rootPath, "path", "", "path used as the root for the SQRL handlers (if not /)")
 	flag.IntVar(&port, "p", 8000, "port to listen on")
+	flag.StringVar(&hoardFile, "hoard", "", "file to persist nuts across restarts (in-memory if not set)")
+	flag.StringVar(&proxyHeader, "proxy", "", "header the reverse proxy sets to the client's IP, e.g. X-Real-IP (if behind one)")
 	flag.StringVar(&help, "help", "", "print usage")
 
 	flag.Parse()
@@ -36,15 +42,49 @@ func main() {
 	}
 
 	authStore := ssp.NewMapAuthStore()
-	hoard := ssp.NewMapHoard()
-	// redisClient := redis.NewUniversalClient(&redis.UniversalOptions{})
-	// hoard := redishoard.NewHoard(redisClient)
+	var hoard ssp.Hoard
+	if hoardFile != "" {
+		hoard, err = ssp.NewFileHoard(hoardFile)
+		if err != nil {
+			log.Fatalf("Failed to open hoard: %v", err)
+		}
+	} else {
+		// limit memory use from clients requesting nuts in a loop
+		hoard = ssp.NewBoundedMapHoard(100000)
+	}
+	// hoard := ssp.NewRedisHoard("localhost:6379", 10)
+
+	// sessions don't survive a restart since the key isn't saved
+	sessionKey := make([]byte, 32)
+	_, err = rand.Read(sessionKey)
+	if err != nil {
+		log.Fatalf("Failed to create session key: %v", err)
+	}
+	sessions, err := ssp.NewSessionAuthenticator(hoard, sessionKey, fmt.Sprintf("https://%v%v/login.sqrl", hostOverride, rootPath))
+	if err != nil {
+		log.Fatalf("Failed to create authenticator: %v", err)
+	}
+	sessions.SuccessURL = rootPath + "/success.html"
+	sessions.Secure = certFile != ""
+
 	sspAPI := ssp.NewSqrlSspAPI(tree,
 		hoard,
-		&authy{hostOverride, rootPath},
+		&authy{sessions},
 		authStore)
 	sspAPI.HostOverride = hostOverride
 	sspAPI.RootPath = rootPath
+	sspAPI.MaxNutsPerIP = 50
+	if proxyHeader != "" {
+		// otherwise every client is counted as the proxy
+		clientIP := func(r *http.Request) string {
+			if ip := r.Header.Get(proxyHeader); ip != "" {
+				return ip
+			}
+			return ssp.RemoteAddrIP(r)
+		}
+		sspAPI.TrustedIP = clientIP
+		sessions.RemoteIP = clientIP
+	}
 
 	// Add existing identity to test Pidk
 	idSeed := &ssp.SqrlIdentity{
@@ -64,6 +104,16 @@ func main() {
 	http.HandleFunc("/png.sqrl", sspAPI.PNG)
 	http.HandleFunc("/pag.sqrl", sspAPI.Pag)
 	http.HandleFunc("/cli.sqrl", sspAPI.Cli)
+	http.HandleFunc("/login.sqrl", sessions.Login)
+	http.HandleFunc("/session.sqrl", func(w http.ResponseWriter, r *http.Request) {
+		idk, err := sessions.Session(r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"idk": idk})
+	})
 	http.HandleFunc("/", hph.Handle)
 
 	listenOn := fmt.Sprintf(":%d", port)
@@ -79,23 +129,11 @@ func main() {
 	}
 }
 
+// authy logs in with a session cookie and sends an ask
 type authy struct {
-	Host string
-	Path string
-}
-
-func (a *authy) AuthenticateIdentity(identity *ssp.SqrlIdentity) string {
-	return fmt.Sprintf("https://%v%v/success.html?idk=%v&btn=%v", a.Host, a.Path, identity.Idk, identity.Btn)
+	*ssp.SessionAuthenticator
 }
 
-func (a *authy) SwapIdentities(newIdentity, oldIdentity *ssp.SqrlIdentity) error {
-	// nothing to do here since we're not creating users
-	return nil
-}
-func (a *authy) RemoveIdentity(identity *ssp.SqrlIdentity) error {
-	// nothing to do here since we're not creating users
-	return nil
-}
 func (a *authy) AskResponse(identity *ssp.SqrlIdentity) *ssp.Ask {
 	// really annoying ask
 	return &ssp.Ask{
@@ -0,0 +1,257 @@
+package ssp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidSession is returned by SessionAuthenticator.Session
+// when there's no session cookie or it's invalid or expired
+var ErrInvalidSession = fmt.Errorf("Invalid Session")
+
+// HoardCache.State of a login token saved by a SessionAuthenticator
+const sessionTokenState = "session"
+
+// sessionTokenPrefix keeps login tokens apart from the nuts in the
+// same Hoard so a nut can't be redeemed (and deleted) as a token
+const sessionTokenPrefix = "session:"
+
+// SessionAuthenticator is an Authenticator that logs users in with a
+// session cookie. AuthenticateIdentity saves a random single-use token
+// in the Hoard and returns RedeemURL with the token added. Login serves
+// RedeemURL; it redeems the token, sets a cookie signed with the key and
+// redirects to SuccessURL. Session returns the idk of a request's session.
+//
+// SwapIdentities and RemoveIdentity do nothing and AskResponse returns nil.
+// Embed it in a type that overrides them to manage users or send an Ask.
+type SessionAuthenticator struct {
+	// RedeemURL is the URL the Login handler is served from
+	RedeemURL string
+	// SuccessURL is where Login redirects once the cookie is set
+	SuccessURL string
+	// ErrorURL is returned by AuthenticateIdentity when the token can't
+	// be saved. AuthenticateIdentityWithError is used by SqrlSspAPI so
+	// this is only for other callers.
+	ErrorURL string
+	// CookieName is the name of the session cookie
+	CookieName string
+	// CookiePath is the path of the session cookie
+	CookiePath string
+	// Secure sets the Secure attribute on the session cookie so it's only
+	// sent over HTTPS. It should only be turned off for local testing.
+	Secure bool
+	// TokenExpiration is how long a login token can be redeemed
+	TokenExpiration time.Duration
+	// SessionExpiration is how long a session cookie is valid
+	SessionExpiration time.Duration
+	// CheckRemoteIP makes Login reject a token redeemed from an IP
+	// other than the one that requested the nut, if it was saved with
+	// one. The saved IP is from SqrlSspAPI.RemoteIP so both must see
+	// the same address.
+	CheckRemoteIP bool
+	// RemoteIP gets the IP of a Login request. It defaults to
+	// RemoteAddrIP since X-Forwarded-For can be set by whoever holds
+	// the token. Behind a proxy, set it to read the address the proxy adds.
+	RemoteIP func(r *http.Request) string
+
+	hoard Hoard
+	key   []byte
+}
+
+// NewSessionAuthenticator creates a SessionAuthenticator that saves
+// login tokens in hoard and signs session cookies with key, which must be
+// at least 32 bytes. All servers sharing the hoard must use the same key.
+// redeemURL is where the Login handler is served.
+func NewSessionAuthenticator(hoard Hoard, key []byte, redeemURL string) (*SessionAuthenticator, error) {
+	if len(key) < 32 {
+		return nil, fmt.Errorf("session key must be at least 32 bytes")
+	}
+	if _, err := url.Parse(redeemURL); err != nil {
+		return nil, fmt.Errorf("invalid redeem url: %v", err)
+	}
+	return &SessionAuthenticator{
+		RedeemURL:         redeemURL,
+		SuccessURL:        "/",
+		CookieName:        "sqrl_session",
+		CookiePath:        "/",
+		Secure:            true,
+		TokenExpiration:   time.Minute,
+		SessionExpiration: 24 * time.Hour,
+		CheckRemoteIP:     true,
+		RemoteIP:          RemoteAddrIP,
+		hoard:             hoard,
+		key:               append([]byte(nil), key...),
+	}, nil
+}
+
+// AuthenticateIdentity implements Authenticator
+func (sa *SessionAuthenticator) AuthenticateIdentity(identity *SqrlIdentity) string {
+	redirect, err := sa.AuthenticateIdentityWithError(context.Background(), identity)
+	if err != nil {
+		log.Printf("Failed creating login token: %v", err)
+		return sa.ErrorURL
+	}
+	return redirect
+}
+
+// AuthenticateIdentityWithError implements AuthenticatorWithError.
+// A full hoard is reported as a transient error. No token is saved
+// when AuthenticationInfo.SkipURL is set.
+func (sa *SessionAuthenticator) AuthenticateIdentityWithError(ctx context.Context, identity *SqrlIdentity) (string, error) {
+	hoardCache := &HoardCache{
+		State:    sessionTokenState,
+		Identity: identity,
+	}
+	if info := AuthenticationInfoFromContext(ctx); info != nil {
+		if info.SkipURL {
+			return "", nil
+		}
+		hoardCache.RemoteIP = info.RemoteIP
+		hoardCache.OriginalNut = info.Nut
+	}
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("failed creating login token: %v", err)
+	}
+	token := Sqrl64.EncodeToString(b)
+	err = ContextHoard(sa.hoard).SaveContext(ctx, Nut(sessionTokenPrefix+token), hoardCache, sa.TokenExpiration)
+	if err != nil {
+		if err == ErrHoardFull {
+			return "", NewTransientError(err)
+		}
+		return "", err
+	}
+	redeem, err := url.Parse(sa.RedeemURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid redeem url: %v", err)
+	}
+	query := redeem.Query()
+	query.Set("token", token)
+	redeem.RawQuery = query.Encode()
+	return redeem.String(), nil
+}
+
+// SwapIdentities implements Authenticator
+func (sa *SessionAuthenticator) SwapIdentities(previousIdentity, newIdentity *SqrlIdentity) error {
+	return nil
+}
+
+// RemoveIdentity implements Authenticator
+func (sa *SessionAuthenticator) RemoveIdentity(identity *SqrlIdentity) error {
+	return nil
+}
+
+// AskResponse implements Authenticator
+func (sa *SessionAuthenticator) AskResponse(identity *SqrlIdentity) *Ask {
+	return nil
+}
+
+// Login is an http.HandlerFunc that redeems the token created by
+// AuthenticateIdentity. Each token can only be used once, even if it's
+// rejected for coming from the wrong IP. It sets the session cookie and
+// redirects to SuccessURL.
+func (sa *SessionAuthenticator) Login(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Missing required token parameter"))
+		return
+	}
+	hoardCache, err := ContextHoard(sa.hoard).GetAndDeleteContext(r.Context(), Nut(sessionTokenPrefix+token))
+	if err != nil {
+		if err == ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed token lookup: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if hoardCache.State != sessionTokenState || hoardCache.Identity == nil {
+		log.Printf("Login with a nut that isn't a login token")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if sa.CheckRemoteIP && hoardCache.RemoteIP != "" {
+		getIP := sa.RemoteIP
+		if getIP == nil {
+			getIP = RemoteAddrIP
+		}
+		if ip := getIP(r); ip != hoardCache.RemoteIP {
+			log.Printf("Rejecting login on IP mis-match orig: %v current: %v", hoardCache.RemoteIP, ip)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	expires := time.Now().Add(sa.SessionExpiration)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sa.CookieName,
+		Value:    sa.signSession(hoardCache.Identity.Idk, expires.Unix()),
+		Path:     sa.CookiePath,
+		Expires:  expires,
+		Secure:   sa.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, sa.SuccessURL, http.StatusFound)
+}
+
+// Logout is an http.HandlerFunc that clears the session cookie
+// and redirects to SuccessURL
+func (sa *SessionAuthenticator) Logout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sa.CookieName,
+		Value:    "",
+		Path:     sa.CookiePath,
+		MaxAge:   -1,
+		Secure:   sa.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, sa.SuccessURL, http.StatusFound)
+}
+
+// Session returns the idk from the request's session cookie or
+// ErrInvalidSession if there's no valid, unexpired session
+func (sa *SessionAuthenticator) Session(r *http.Request) (string, error) {
+	cookie, err := r.Cookie(sa.CookieName)
+	if err != nil {
+		return "", ErrInvalidSession
+	}
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidSession
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", ErrInvalidSession
+	}
+	expected := sa.signSession(parts[0], expires)
+	if !hmac.Equal([]byte(cookie.Value), []byte(expected)) {
+		return "", ErrInvalidSession
+	}
+	if time.Now().Unix() > expires {
+		return "", ErrInvalidSession
+	}
+	return parts[0], nil
+}
+
+// signSession creates the cookie value idk.expires.signature.
+// Idks are Sqrl64 encoded so they can't contain a dot.
+func (sa *SessionAuthenticator) signSession(idk string, expires int64) string {
+	payload := idk + "." + strconv.FormatInt(expires, 10)
+	mac := hmac.New(sha256.New, sa.key)
+	mac.Write([]byte(payload))
+	return payload + "." + Sqrl64.EncodeToString(mac.Sum(nil))
+}
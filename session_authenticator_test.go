@@ -0,0 +1,163 @@
+package ssp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSessionKey = []byte("0123456789abcdef0123456789abcdef")
+
+func redeemLogin(sa *SessionAuthenticator, redirect string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	sa.Login(w, httptest.NewRequest("GET", redirect, nil))
+	return w
+}
+
+func TestSessionAuthenticator(t *testing.T) {
+	hoard := NewMapHoard()
+	defer hoard.Close()
+	sa, err := NewSessionAuthenticator(hoard, testSessionKey, "https://example.com/login?from=sqrl")
+	if err != nil {
+		t.Fatalf("Failed creating authenticator: %v", err)
+	}
+	sa.SuccessURL = "/home"
+
+	redirect := sa.AuthenticateIdentity(&SqrlIdentity{Idk: "idk"})
+	parsed, err := url.Parse(redirect)
+	if err != nil || parsed.Host != "example.com" || parsed.Path != "/login" || parsed.Query().Get("from") != "sqrl" {
+		t.Fatalf("Wrong redirect %v: %v", redirect, err)
+	}
+	token := parsed.Query().Get("token")
+	if len(token) != 43 || strings.Contains(redirect, "idk") {
+		t.Fatalf("Redirect should only carry a random token: %v", redirect)
+	}
+
+	w := redeemLogin(sa, redirect)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/home" {
+		t.Fatalf("Expected redirect to /home but got %v %v", w.Code, w.Header().Get("Location"))
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "sqrl_session" || !cookies[0].HttpOnly || !cookies[0].Secure {
+		t.Fatalf("Wrong session cookie %#v", cookies)
+	}
+
+	r := httptest.NewRequest("GET", "/home", nil)
+	r.AddCookie(cookies[0])
+	idk, err := sa.Session(r)
+	if err != nil || idk != "idk" {
+		t.Fatalf("Wrong session %v: %v", idk, err)
+	}
+
+	// tokens are single use
+	if w := redeemLogin(sa, redirect); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected second redemption to fail but got %v", w.Code)
+	}
+	if w := redeemLogin(sa, "/login"); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected bad request without token but got %v", w.Code)
+	}
+}
+
+func TestSessionAuthenticatorInvalidSession(t *testing.T) {
+	hoard := NewMapHoard()
+	defer hoard.Close()
+	sa, _ := NewSessionAuthenticator(hoard, testSessionKey, "/login")
+	other, _ := NewSessionAuthenticator(hoard, []byte("another key that is long enough!!"), "/login")
+
+	valid := sa.signSession("idk", time.Now().Add(time.Hour).Unix())
+	tests := map[string]string{
+		"tampered idk":  strings.Replace(valid, "idk", "xyz", 1),
+		"other key":     other.signSession("idk", time.Now().Add(time.Hour).Unix()),
+		"expired":       sa.signSession("idk", time.Now().Add(-time.Minute).Unix()),
+		"malformed":     "idk",
+		"bad timestamp": "idk.soon." + strings.Split(valid, ".")[2],
+	}
+	for name, value := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "sqrl_session", Value: value})
+		if _, err := sa.Session(r); err != ErrInvalidSession {
+			t.Fatalf("Expected invalid session for %v but got %v", name, err)
+		}
+	}
+	if _, err := sa.Session(httptest.NewRequest("GET", "/", nil)); err != ErrInvalidSession {
+		t.Fatalf("Expected invalid session without cookie but got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	sa.Logout(w, httptest.NewRequest("GET", "/logout", nil))
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge >= 0 || cookies[0].SameSite != http.SameSiteLaxMode {
+		t.Fatalf("Expected logout to clear the cookie: %#v", cookies)
+	}
+}
+
+func TestSessionAuthenticatorToken(t *testing.T) {
+	if _, err := NewSessionAuthenticator(NewMapHoard(), []byte("short"), "/login"); err == nil {
+		t.Fatalf("Expected error for short key")
+	}
+
+	hoard := NewBoundedMapHoard(1)
+	defer hoard.Close()
+	sa, _ := NewSessionAuthenticator(hoard, testSessionKey, "/login")
+	sa.TokenExpiration = 5 * time.Millisecond
+	redirect, err := sa.AuthenticateIdentityWithError(context.Background(), &SqrlIdentity{Idk: "idk"})
+	if err != nil {
+		t.Fatalf("Failed creating token: %v", err)
+	}
+	if _, err := sa.AuthenticateIdentityWithError(context.Background(), &SqrlIdentity{Idk: "idk"}); !IsTransient(err) {
+		t.Fatalf("Expected transient error for full hoard but got %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if w := redeemLogin(sa, redirect); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected expired token to fail but got %v", w.Code)
+	}
+
+	// other hoard values can't be used as tokens or deleted by trying
+	hoard.Save(Nut("nut"), &HoardCache{State: "associated", Identity: &SqrlIdentity{Idk: "idk"}}, time.Minute)
+	if w := redeemLogin(sa, "/login?token=nut"); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected nut to fail as a token but got %v", w.Code)
+	}
+	if _, err := hoard.Get(Nut("nut")); err != nil {
+		t.Fatalf("Redeeming a nut as a token deleted it: %v", err)
+	}
+}
+
+func TestSessionAuthenticatorInfo(t *testing.T) {
+	hoard := NewMapHoard()
+	defer hoard.Close()
+	sa, _ := NewSessionAuthenticator(hoard, testSessionKey, "/login")
+
+	hoardCache := &HoardCache{RemoteIP: "192.0.2.1", OriginalNut: "nut"}
+	redirect, err := sa.AuthenticateIdentityWithError(withAuthenticationInfo(context.Background(), hoardCache, false), &SqrlIdentity{Idk: "idk"})
+	if err != nil {
+		t.Fatalf("Failed creating token: %v", err)
+	}
+	parsed, _ := url.Parse(redirect)
+	saved, err := hoard.Get(Nut(sessionTokenPrefix + parsed.Query().Get("token")))
+	if err != nil || saved.RemoteIP != "192.0.2.1" || saved.OriginalNut != "nut" {
+		t.Fatalf("Token should be saved with the login's IP: %#v %v", saved, err)
+	}
+
+	// no token is minted when the URL won't be used
+	redirect, err = sa.AuthenticateIdentityWithError(withAuthenticationInfo(context.Background(), hoardCache, true), &SqrlIdentity{Idk: "idk"})
+	if err != nil || redirect != "" || hoard.Len() != 1 {
+		t.Fatalf("Expected no token but got %v %v with %v saved", redirect, err, hoard.Len())
+	}
+
+	// the token can only be redeemed from the same IP
+	redirect, _ = sa.AuthenticateIdentityWithError(withAuthenticationInfo(context.Background(), hoardCache, false), &SqrlIdentity{Idk: "idk"})
+	r := httptest.NewRequest("GET", redirect, nil)
+	r.RemoteAddr = "198.51.100.1:1234"
+	w := httptest.NewRecorder()
+	sa.Login(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Expected forbidden from another IP but got %v", w.Code)
+	}
+	redirect, _ = sa.AuthenticateIdentityWithError(withAuthenticationInfo(context.Background(), hoardCache, false), &SqrlIdentity{Idk: "idk"})
+	if w := redeemLogin(sa, redirect); w.Code != http.StatusFound {
+		t.Fatalf("Expected login from the same IP but got %v", w.Code)
+	}
+}
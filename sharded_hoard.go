@@ -0,0 +1,225 @@
+package ssp
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// maximum number of expired entries removed from a shard per lock
+const shardCleanBatch = 256
+
+type hoardEntry struct {
+	nut        Nut
+	value      *HoardCache
+	expiration time.Time
+	// position in the expiry heap
+	index int
+}
+
+func (se *hoardEntry) expired(now time.Time) bool {
+	return se.expiration.Before(now)
+}
+
+// expiryHeap is a min-heap of entries ordered by expiration
+type expiryHeap []*hoardEntry
+
+func (eh expiryHeap) Len() int           { return len(eh) }
+func (eh expiryHeap) Less(i, j int) bool { return eh[i].expiration.Before(eh[j].expiration) }
+func (eh expiryHeap) Swap(i, j int) {
+	eh[i], eh[j] = eh[j], eh[i]
+	eh[i].index = i
+	eh[j].index = j
+}
+func (eh *expiryHeap) Push(x interface{}) {
+	entry := x.(*hoardEntry)
+	entry.index = len(*eh)
+	*eh = append(*eh, entry)
+}
+func (eh *expiryHeap) Pop() interface{} {
+	old := *eh
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.index = -1
+	*eh = old[:n-1]
+	return entry
+}
+
+type hoardShard struct {
+	mutex   sync.Mutex
+	cache   map[Nut]*hoardEntry
+	expires expiryHeap
+}
+
+// clean removes up to shardCleanBatch expired entries
+// and reports if there may be more
+func (hs *hoardShard) clean(now time.Time) bool {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	return hs.removeExpired(now)
+}
+
+// removeExpired is clean for callers that hold the mutex
+func (hs *hoardShard) removeExpired(now time.Time) bool {
+	for i := 0; i < shardCleanBatch; i++ {
+		if len(hs.expires) == 0 || !hs.expires[0].expired(now) {
+			return false
+		}
+		entry := heap.Pop(&hs.expires).(*hoardEntry)
+		delete(hs.cache, entry.nut)
+	}
+	return true
+}
+
+// remove deletes entry from the map and the heap so the value
+// isn't kept in memory. It must be called with the mutex held.
+func (hs *hoardShard) remove(entry *hoardEntry) {
+	delete(hs.cache, entry.nut)
+	if entry.index >= 0 {
+		heap.Remove(&hs.expires, entry.index)
+	}
+}
+
+// ShardedHoard implements a Hoard that is backed by in-memory maps.
+// Nuts are spread over independently locked shards that each expire
+// their entries from a heap like MapHoard. It's intended for single
+// servers with a large number of outstanding nuts where MapHoard's
+// global lock becomes a bottleneck.
+type ShardedHoard struct {
+	shards  []*hoardShard
+	mask    uint32
+	cancel  context.CancelFunc
+	stopped chan struct{}
+}
+
+// NewShardedHoard creates a ShardedHoard with at least the given number
+// of shards, rounded up to a power of two. Call Close to stop the
+// background cleanup of expired values.
+func NewShardedHoard(shards int) *ShardedHoard {
+	return NewShardedHoardContext(context.Background(), shards)
+}
+
+// NewShardedHoardContext creates a new ShardedHoard whose background
+// cleanup stops when ctx is done or Close is called.
+func NewShardedHoardContext(ctx context.Context, shards int) *ShardedHoard {
+	size := 1
+	for size < shards {
+		size <<= 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	sh := &ShardedHoard{
+		shards:  make([]*hoardShard, size),
+		mask:    uint32(size - 1),
+		cancel:  cancel,
+		stopped: make(chan struct{}),
+	}
+	for i := range sh.shards {
+		sh.shards[i] = &hoardShard{
+			cache: make(map[Nut]*hoardEntry),
+		}
+	}
+	go sh.cleaner(ctx)
+	return sh
+}
+
+// Close implements io.Closer. It stops the background cleanup
+// and waits for it to finish. The hoard can still be used but
+// expired values are only removed when they're accessed.
+func (sh *ShardedHoard) Close() error {
+	sh.cancel()
+	<-sh.stopped
+	return nil
+}
+
+func (sh *ShardedHoard) cleaner(ctx context.Context) {
+	defer close(sh.stopped)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
+		for _, shard := range sh.shards {
+			// release the lock between batches so callers aren't stalled
+			for shard.clean(now) {
+				if ctx.Err() != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (sh *ShardedHoard) shard(nut Nut) *hoardShard {
+	h := fnv.New32a()
+	h.Write([]byte(nut))
+	return sh.shards[h.Sum32()&sh.mask]
+}
+
+// Get implements Hoard
+func (sh *ShardedHoard) Get(nut Nut) (*HoardCache, error) {
+	shard := sh.shard(nut)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if entry, ok := shard.cache[nut]; ok {
+		if !entry.expired(time.Now()) {
+			return entry.value, nil
+		}
+		shard.remove(entry)
+	}
+	return nil, ErrNotFound
+}
+
+// GetAndDelete implements Hoard
+func (sh *ShardedHoard) GetAndDelete(nut Nut) (*HoardCache, error) {
+	shard := sh.shard(nut)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if entry, ok := shard.cache[nut]; ok {
+		shard.remove(entry)
+		if !entry.expired(time.Now()) {
+			return entry.value, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Save implements Hoard
+func (sh *ShardedHoard) Save(nut Nut, value *HoardCache, expiration time.Duration) error {
+	if nut == "" {
+		return fmt.Errorf("empty nuts are not allowed")
+	}
+	entry := &hoardEntry{
+		nut:        nut,
+		value:      value,
+		expiration: time.Now().Add(expiration),
+	}
+	shard := sh.shard(nut)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if previous, ok := shard.cache[nut]; ok {
+		shard.remove(previous)
+	}
+	shard.cache[nut] = entry
+	heap.Push(&shard.expires, entry)
+	return nil
+}
+
+// Len returns the number of values in the hoard including
+// expired values that haven't been cleaned up yet
+func (sh *ShardedHoard) Len() int {
+	total := 0
+	for _, shard := range sh.shards {
+		shard.mutex.Lock()
+		total += len(shard.cache)
+		shard.mutex.Unlock()
+	}
+	return total
+}
@@ -0,0 +1,247 @@
+package ssp
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShardedHoard(t *testing.T) {
+	h := NewShardedHoard(4)
+	defer h.Close()
+
+	hoardCache := &HoardCache{}
+	err := h.Save(Nut("nut"), hoardCache, time.Second)
+	if err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	if err := h.Save(Nut(""), hoardCache, time.Second); err == nil {
+		t.Fatalf("Saved empty nut")
+	}
+
+	val, err := h.Get(Nut("nut"))
+	if err != nil || val != hoardCache {
+		t.Fatalf("Failed get: %v %v", val, err)
+	}
+	val, err = h.GetAndDelete(Nut("nut"))
+	if err != nil || val != hoardCache {
+		t.Fatalf("Failed get and delete: %v %v", val, err)
+	}
+	val, err = h.GetAndDelete(Nut("nut"))
+	if err != ErrNotFound || val != nil {
+		t.Fatalf("Expected not found but got: %v %v", val, err)
+	}
+}
+
+func TestShardedHoardReleasesValues(t *testing.T) {
+	h := NewShardedHoard(1)
+	defer h.Close()
+	heapSize := func() int {
+		h.shards[0].mutex.Lock()
+		defer h.shards[0].mutex.Unlock()
+		return len(h.shards[0].expires)
+	}
+
+	for i := 0; i < 10; i++ {
+		h.Save(Nut(strconv.Itoa(i)), &HoardCache{Identity: &SqrlIdentity{Idk: "idk"}}, time.Minute)
+	}
+	// replacing a value drops the old heap entry
+	h.Save(Nut("0"), &HoardCache{}, time.Minute)
+	if size := heapSize(); size != 10 {
+		t.Fatalf("Expected 10 heap entries but got %d", size)
+	}
+	for i := 0; i < 5; i++ {
+		h.GetAndDelete(Nut(strconv.Itoa(i)))
+	}
+	// deleted values aren't referenced until they expire
+	if size := heapSize(); size != 5 || h.Len() != 5 {
+		t.Fatalf("Expected 5 entries but got heap %d map %d", size, h.Len())
+	}
+	for i := 5; i < 10; i++ {
+		if _, err := h.Get(Nut(strconv.Itoa(i))); err != nil {
+			t.Fatalf("Failed get %d after removals: %v", i, err)
+		}
+	}
+}
+
+func TestShardedHoardExpired(t *testing.T) {
+	h := NewShardedHoard(4)
+	defer h.Close()
+
+	h.Save(Nut("nut"), &HoardCache{}, 0)
+	time.Sleep(time.Microsecond)
+	if val, err := h.Get(Nut("nut")); err != ErrNotFound {
+		t.Fatalf("Expected expired but got: %v %v", val, err)
+	}
+}
+
+func TestShardedHoardCleaner(t *testing.T) {
+	h := NewShardedHoard(2)
+	defer h.Close()
+
+	for i := 0; i < 1000; i++ {
+		h.Save(Nut(strconv.Itoa(i)), &HoardCache{}, time.Millisecond)
+	}
+	// replacing a value with a longer expiration must keep it
+	kept := &HoardCache{}
+	h.Save(Nut("7"), kept, time.Minute)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for h.Len() > 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if h.Len() != 1 {
+		t.Fatalf("Expected expired values to be cleaned but have %v", h.Len())
+	}
+	if val, err := h.Get(Nut("7")); err != nil || val != kept {
+		t.Fatalf("Lost replaced value: %v %v", val, err)
+	}
+}
+
+func TestShardedHoardShards(t *testing.T) {
+	h := NewShardedHoard(5)
+	defer h.Close()
+	if len(h.shards) != 8 {
+		t.Fatalf("Expected 8 shards but got %v", len(h.shards))
+	}
+}
+
+// hoardForBenchmark is a Hoard that can stop its background cleanup
+type hoardForBenchmark interface {
+	Hoard
+	Close() error
+}
+
+func benchmarkHoard(b *testing.B, h hoardForBenchmark, outstanding int) {
+	defer h.Close()
+	for i := 0; i < outstanding; i++ {
+		h.Save(Nut(fmt.Sprintf("outstanding%d", i)), &HoardCache{}, time.Minute)
+	}
+	var counter int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			nut := Nut(strconv.FormatInt(atomic.AddInt64(&counter, 1), 10))
+			h.Save(nut, &HoardCache{}, time.Minute)
+			h.GetAndDelete(nut)
+		}
+	})
+}
+
+// baselineHoard is the original MapHoard: one mutex around a map that's
+// cleaned by scanning it. The benchmarks compare the heap and the shards
+// against it.
+type baselineHoard struct {
+	cache   map[Nut]*valExpire
+	mutex   *sync.Mutex
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func newBaselineHoard() *baselineHoard {
+	bh := &baselineHoard{
+		cache:   make(map[Nut]*valExpire),
+		mutex:   &sync.Mutex{},
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go bh.cleaner()
+	return bh
+}
+
+func (bh *baselineHoard) Close() error {
+	close(bh.stop)
+	<-bh.stopped
+	return nil
+}
+
+func (bh *baselineHoard) cleaner() {
+	defer close(bh.stopped)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		var start time.Time
+		select {
+		case <-bh.stop:
+			return
+		case start = <-ticker.C:
+		}
+		bh.mutex.Lock()
+		i := 0
+		for k, v := range bh.cache {
+			if v.Expired() {
+				delete(bh.cache, k)
+			}
+			i++
+			// check for going over time
+			if i%100 == 0 && time.Now().Sub(start) > 50*time.Millisecond {
+				break
+			}
+		}
+		bh.mutex.Unlock()
+	}
+}
+
+func (bh *baselineHoard) Get(nut Nut) (*HoardCache, error) {
+	bh.mutex.Lock()
+	defer bh.mutex.Unlock()
+	if value, ok := bh.cache[nut]; ok {
+		if !value.Expired() {
+			return value.value, nil
+		}
+		delete(bh.cache, nut)
+	}
+	return nil, ErrNotFound
+}
+
+func (bh *baselineHoard) GetAndDelete(nut Nut) (*HoardCache, error) {
+	bh.mutex.Lock()
+	defer bh.mutex.Unlock()
+	if value, ok := bh.cache[nut]; ok {
+		delete(bh.cache, nut)
+		if !value.Expired() {
+			return value.value, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (bh *baselineHoard) Save(nut Nut, value *HoardCache, expiration time.Duration) error {
+	if nut == "" {
+		return fmt.Errorf("empty nuts are not allowed")
+	}
+	bh.mutex.Lock()
+	defer bh.mutex.Unlock()
+	bh.cache[nut] = &valExpire{
+		value:      value,
+		expiration: time.Now().Add(expiration),
+	}
+	return nil
+}
+
+func BenchmarkBaselineHoard(b *testing.B) {
+	benchmarkHoard(b, newBaselineHoard(), 0)
+}
+
+func BenchmarkMapHoard(b *testing.B) {
+	benchmarkHoard(b, NewMapHoard(), 0)
+}
+
+func BenchmarkShardedHoard(b *testing.B) {
+	benchmarkHoard(b, NewShardedHoard(64), 0)
+}
+
+func BenchmarkBaselineHoardOutstanding(b *testing.B) {
+	benchmarkHoard(b, newBaselineHoard(), 200000)
+}
+
+func BenchmarkMapHoardOutstanding(b *testing.B) {
+	benchmarkHoard(b, NewMapHoard(), 200000)
+}
+
+func BenchmarkShardedHoardOutstanding(b *testing.B) {
+	benchmarkHoard(b, NewShardedHoard(64), 200000)
+}
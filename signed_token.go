@@ -0,0 +1,245 @@
+package ssp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// ErrInvalidToken is returned when verifying a signed token fails
+var ErrInvalidToken = fmt.Errorf("Invalid Token")
+
+// the only JWT header used or accepted
+var signedTokenHeader = Sqrl64.EncodeToString([]byte(`{"alg":"EdDSA","typ":"JWT"}`))
+
+// SignedToken holds the claims of a token created by a
+// SignedTokenAuthenticator. It's encoded as a JWT.
+type SignedToken struct {
+	Idk       string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	// RemoteIP is the IP of the browser that requested the nut
+	RemoteIP string `json:"ip,omitempty"`
+}
+
+// SignedTokenAuthenticator is an Authenticator whose redirect URL carries
+// a stateless token instead of one saved on the server. The token is a
+// JWT signed with Ed25519 ("EdDSA") holding a SignedToken so anything
+// with the public key, like an API gateway or a SignedTokenVerifier,
+// can check a login without calling back to the SSP service. It's
+// used for the URL returned from /pag.sqrl and the CPS url.
+//
+// The token can't be made single-use without saving it, so
+// Expiration should be short and verifiers should check the IP.
+// The IP is from SqrlSspAPI.RemoteIP so the check is only as
+// reliable as the X-Forwarded-For header reaching the API.
+//
+// SwapIdentities and RemoveIdentity do nothing and AskResponse returns nil.
+// Embed it in a type that overrides them to manage users or send an Ask.
+type SignedTokenAuthenticator struct {
+	// RedirectURL gets the token added as the token query parameter
+	RedirectURL string
+	// ErrorURL is returned by AuthenticateIdentity when the token can't
+	// be created. AuthenticateIdentityWithError is used by SqrlSspAPI so
+	// this is only for other callers.
+	ErrorURL string
+	// Expiration is how long a token is valid
+	Expiration time.Duration
+
+	privateKey ed25519.PrivateKey
+}
+
+// NewSignedTokenAuthenticator creates a SignedTokenAuthenticator
+// that signs tokens with privateKey and adds them to redirectURL
+func NewSignedTokenAuthenticator(privateKey ed25519.PrivateKey, redirectURL string) (*SignedTokenAuthenticator, error) {
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid ed25519 private key")
+	}
+	if _, err := url.Parse(redirectURL); err != nil {
+		return nil, fmt.Errorf("invalid redirect url: %v", err)
+	}
+	return &SignedTokenAuthenticator{
+		RedirectURL: redirectURL,
+		Expiration:  2 * time.Minute,
+		privateKey:  privateKey,
+	}, nil
+}
+
+// AuthenticateIdentity implements Authenticator. The
+// token doesn't have a RemoteIP since there's no context.
+func (sta *SignedTokenAuthenticator) AuthenticateIdentity(identity *SqrlIdentity) string {
+	redirect, err := sta.AuthenticateIdentityWithError(context.Background(), identity)
+	if err != nil {
+		log.Printf("Failed creating signed token: %v", err)
+		return sta.ErrorURL
+	}
+	return redirect
+}
+
+// AuthenticateIdentityWithError implements AuthenticatorWithError.
+// The RemoteIP comes from AuthenticationInfoFromContext.
+func (sta *SignedTokenAuthenticator) AuthenticateIdentityWithError(ctx context.Context, identity *SqrlIdentity) (string, error) {
+	now := time.Now()
+	claims := &SignedToken{
+		Idk:       identity.Idk,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(sta.Expiration).Unix(),
+	}
+	if info := AuthenticationInfoFromContext(ctx); info != nil {
+		claims.RemoteIP = info.RemoteIP
+	}
+	token, err := sta.Sign(claims)
+	if err != nil {
+		return "", err
+	}
+	redirect, err := url.Parse(sta.RedirectURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid redirect url: %v", err)
+	}
+	query := redirect.Query()
+	query.Set("token", token)
+	redirect.RawQuery = query.Encode()
+	return redirect.String(), nil
+}
+
+// SwapIdentities implements Authenticator
+func (sta *SignedTokenAuthenticator) SwapIdentities(previousIdentity, newIdentity *SqrlIdentity) error {
+	return nil
+}
+
+// RemoveIdentity implements Authenticator
+func (sta *SignedTokenAuthenticator) RemoveIdentity(identity *SqrlIdentity) error {
+	return nil
+}
+
+// AskResponse implements Authenticator
+func (sta *SignedTokenAuthenticator) AskResponse(identity *SqrlIdentity) *Ask {
+	return nil
+}
+
+// Sign encodes and signs claims as a JWT
+func (sta *SignedTokenAuthenticator) Sign(claims *SignedToken) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed encoding token: %v", err)
+	}
+	signed := signedTokenHeader + "." + Sqrl64.EncodeToString(payload)
+	signature := ed25519.Sign(sta.privateKey, []byte(signed))
+	return signed + "." + Sqrl64.EncodeToString(signature), nil
+}
+
+type signedTokenKey struct{}
+
+// SignedTokenFromContext returns the token verified by
+// SignedTokenVerifier.Middleware or nil if there isn't one
+func SignedTokenFromContext(ctx context.Context) *SignedToken {
+	token, _ := ctx.Value(signedTokenKey{}).(*SignedToken)
+	return token
+}
+
+// SignedTokenVerifier checks tokens created by a SignedTokenAuthenticator
+type SignedTokenVerifier struct {
+	// CheckRemoteIP rejects requests from an IP other than the
+	// one in the token if it has one. It's advisory unless
+	// RemoteIP returns an address the client can't choose.
+	CheckRemoteIP bool
+	// Leeway allows for clock differences between servers
+	Leeway time.Duration
+	// RemoteIP gets the IP of a request. It defaults to RemoteAddrIP
+	// since X-Forwarded-For can be set by whoever holds the token.
+	// Behind a proxy, set it to read the address the proxy adds.
+	RemoteIP func(r *http.Request) string
+
+	publicKey ed25519.PublicKey
+}
+
+// NewSignedTokenVerifier creates a SignedTokenVerifier for tokens
+// signed by the private key matching publicKey
+func NewSignedTokenVerifier(publicKey ed25519.PublicKey) (*SignedTokenVerifier, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid ed25519 public key")
+	}
+	return &SignedTokenVerifier{
+		CheckRemoteIP: true,
+		Leeway:        30 * time.Second,
+		RemoteIP:      RemoteAddrIP,
+		publicKey:     publicKey,
+	}, nil
+}
+
+// Verify checks the signature and times of token and returns its claims.
+// It returns ErrInvalidToken if the token isn't valid.
+func (stv *SignedTokenVerifier) Verify(token string) (*SignedToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != signedTokenHeader {
+		return nil, ErrInvalidToken
+	}
+	signature, err := Sqrl64.DecodeString(parts[2])
+	if err != nil || !ed25519.Verify(stv.publicKey, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+	payload, err := Sqrl64.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	claims := &SignedToken{}
+	err = json.Unmarshal(payload, claims)
+	if err != nil || claims.Idk == "" {
+		return nil, ErrInvalidToken
+	}
+	now := time.Now()
+	if now.Add(-stv.Leeway).Unix() > claims.ExpiresAt || now.Add(stv.Leeway).Unix() < claims.IssuedAt {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// VerifyRequest verifies the token in the token query parameter or
+// an Authorization Bearer header and checks the request's IP
+func (stv *SignedTokenVerifier) VerifyRequest(r *http.Request) (*SignedToken, error) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+	}
+	if token == "" {
+		return nil, ErrInvalidToken
+	}
+	claims, err := stv.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if stv.CheckRemoteIP && claims.RemoteIP != "" {
+		getIP := stv.RemoteIP
+		if getIP == nil {
+			getIP = RemoteAddrIP
+		}
+		if ip := getIP(r); ip != claims.RemoteIP {
+			log.Printf("Rejecting token on IP mis-match orig: %v current: %v", claims.RemoteIP, ip)
+			return nil, ErrInvalidToken
+		}
+	}
+	return claims, nil
+}
+
+// Middleware only calls next for requests with a valid token, which
+// is available from SignedTokenFromContext. Others get a 401.
+func (stv *SignedTokenVerifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := stv.VerifyRequest(r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), signedTokenKey{}, claims)))
+	})
+}
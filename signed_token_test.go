@@ -0,0 +1,168 @@
+package ssp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func testSignedToken(t *testing.T) (*SignedTokenAuthenticator, *SignedTokenVerifier) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed generating key: %v", err)
+	}
+	sta, err := NewSignedTokenAuthenticator(priv, "https://example.com/login")
+	if err != nil {
+		t.Fatalf("Failed creating authenticator: %v", err)
+	}
+	stv, err := NewSignedTokenVerifier(pub)
+	if err != nil {
+		t.Fatalf("Failed creating verifier: %v", err)
+	}
+	return sta, stv
+}
+
+func tokenFromURL(t *testing.T, redirect string) string {
+	parsed, err := url.Parse(redirect)
+	if err != nil || parsed.Host != "example.com" || parsed.Path != "/login" {
+		t.Fatalf("Wrong redirect %v: %v", redirect, err)
+	}
+	return parsed.Query().Get("token")
+}
+
+func TestSignedToken(t *testing.T) {
+	sta, stv := testSignedToken(t)
+	ctx := withAuthenticationInfo(context.Background(), &HoardCache{RemoteIP: "192.0.2.1", OriginalNut: "nut"}, false)
+	redirect, err := sta.AuthenticateIdentityWithError(ctx, &SqrlIdentity{Idk: "idk"})
+	if err != nil {
+		t.Fatalf("Failed authenticate: %v", err)
+	}
+	token := tokenFromURL(t, redirect)
+	claims, err := stv.Verify(token)
+	if err != nil {
+		t.Fatalf("Failed verify: %v", err)
+	}
+	if claims.Idk != "idk" || claims.RemoteIP != "192.0.2.1" ||
+		claims.ExpiresAt-claims.IssuedAt != int64(sta.Expiration/time.Second) {
+		t.Fatalf("Wrong claims %#v", claims)
+	}
+
+	_, otherVerifier := testSignedToken(t)
+	parts := strings.Split(token, ".")
+	forged, _ := sta.Sign(&SignedToken{Idk: "other", ExpiresAt: claims.ExpiresAt})
+	expired, _ := sta.Sign(&SignedToken{Idk: "idk", IssuedAt: time.Now().Add(-time.Hour).Unix(), ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+	future, _ := sta.Sign(&SignedToken{Idk: "idk", IssuedAt: time.Now().Add(time.Hour).Unix(), ExpiresAt: time.Now().Add(2 * time.Hour).Unix()})
+	noneHeader := Sqrl64.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	invalid := map[string]string{
+		"swapped payload": parts[0] + "." + strings.Split(forged, ".")[1] + "." + parts[2],
+		"alg none":        noneHeader + "." + parts[1] + ".",
+		"expired":         expired,
+		"future":          future,
+		"truncated":       parts[0] + "." + parts[1],
+		"empty":           "",
+	}
+	for name, value := range invalid {
+		if _, err := stv.Verify(value); err != ErrInvalidToken {
+			t.Fatalf("Expected invalid token for %v but got %v", name, err)
+		}
+	}
+	if _, err := otherVerifier.Verify(token); err != ErrInvalidToken {
+		t.Fatalf("Expected invalid token for other key but got %v", err)
+	}
+
+	if _, err := NewSignedTokenAuthenticator(ed25519.PrivateKey("short"), "/login"); err == nil {
+		t.Fatalf("Expected error for invalid private key")
+	}
+	if _, err := NewSignedTokenVerifier(ed25519.PublicKey("short")); err == nil {
+		t.Fatalf("Expected error for invalid public key")
+	}
+}
+
+func TestSignedTokenMiddleware(t *testing.T) {
+	sta, stv := testSignedToken(t)
+	ctx := withAuthenticationInfo(context.Background(), &HoardCache{RemoteIP: "192.0.2.1", OriginalNut: "nut"}, false)
+	redirect, _ := sta.AuthenticateIdentityWithError(ctx, &SqrlIdentity{Idk: "idk"})
+	token := tokenFromURL(t, redirect)
+
+	var verified *SignedToken
+	handler := stv.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verified = SignedTokenFromContext(r.Context())
+	}))
+	serve := func(r *http.Request) int {
+		verified = nil
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	r := httptest.NewRequest("GET", redirect, nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	if code := serve(r); code != http.StatusOK || verified == nil || verified.Idk != "idk" {
+		t.Fatalf("Expected verified request but got %v %#v", code, verified)
+	}
+
+	r = httptest.NewRequest("GET", "/api", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("Authorization", "Bearer "+token)
+	if code := serve(r); code != http.StatusOK || verified == nil {
+		t.Fatalf("Expected verified bearer token but got %v", code)
+	}
+
+	// X-Forwarded-For is set by the client so it's ignored by default
+	r = httptest.NewRequest("GET", redirect, nil)
+	r.RemoteAddr = "198.51.100.1:1234"
+	r.Header.Set("X-Forwarded-For", "192.0.2.1")
+	if code := serve(r); code != http.StatusUnauthorized {
+		t.Fatalf("Expected X-Forwarded-For to be ignored but got %v", code)
+	}
+	stv.RemoteIP = func(r *http.Request) string { return r.Header.Get("X-Forwarded-For") }
+	if code := serve(r); code != http.StatusOK {
+		t.Fatalf("Expected RemoteIP to be used but got %v", code)
+	}
+	stv.RemoteIP = nil
+
+	r = httptest.NewRequest("GET", redirect, nil)
+	r.RemoteAddr = "198.51.100.1:1234"
+	if code := serve(r); code != http.StatusUnauthorized || verified != nil {
+		t.Fatalf("Expected IP mismatch to be rejected but got %v", code)
+	}
+	stv.CheckRemoteIP = false
+	if code := serve(r); code != http.StatusOK {
+		t.Fatalf("Expected IP to be ignored but got %v", code)
+	}
+
+	if code := serve(httptest.NewRequest("GET", "/api", nil)); code != http.StatusUnauthorized {
+		t.Fatalf("Expected missing token to be rejected but got %v", code)
+	}
+}
+
+func TestSignedTokenPag(t *testing.T) {
+	sta, stv := testSignedToken(t)
+	hoard := NewMapHoard()
+	api := NewSqrlSspAPI(nil, hoard, sta, NewMapAuthStore())
+	defer api.Close()
+	hoard.Save(Nut("pag"), &HoardCache{
+		RemoteIP:    "192.0.2.1",
+		OriginalNut: "nut",
+		Identity:    &SqrlIdentity{Idk: "idk"},
+	}, api.NutExpiration)
+
+	w := httptest.NewRecorder()
+	api.Pag(w, httptest.NewRequest("GET", "/pag.sqrl?nut=nut&pag=pag", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed pag: %v", w.Code)
+	}
+	claims, err := stv.Verify(tokenFromURL(t, w.Body.String()))
+	if err != nil {
+		t.Fatalf("Failed verify: %v", err)
+	}
+	if claims.Idk != "idk" || claims.RemoteIP != "192.0.2.1" {
+		t.Fatalf("Pag token should carry the nut request details: %#v", claims)
+	}
+}
@@ -0,0 +1,225 @@
+package ssp
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// sqlAuthStoreMigrations are the schema versions of the identity table.
+// Only ever append to this list.
+var sqlAuthStoreMigrations = []string{
+	`CREATE TABLE sqrl_identities (
+		idk VARCHAR(64) NOT NULL PRIMARY KEY,
+		suk VARCHAR(64) NOT NULL,
+		vuk VARCHAR(64) NOT NULL,
+		pidk VARCHAR(64) NOT NULL,
+		sqrl_only BOOLEAN NOT NULL,
+		hardlock BOOLEAN NOT NULL,
+		disabled BOOLEAN NOT NULL,
+		rekeyed VARCHAR(64) NOT NULL
+	)`,
+	`CREATE INDEX sqrl_identities_pidk ON sqrl_identities (pidk)`,
+	// widen suk, vuk and pidk for EncryptedAuthStore values. The table is
+	// rebuilt since SQLite, PostgreSQL and MySQL can't agree on ALTER COLUMN.
+	`CREATE TABLE sqrl_identities_v3 (
+		idk VARCHAR(64) NOT NULL PRIMARY KEY,
+		suk VARCHAR(128) NOT NULL,
+		vuk VARCHAR(128) NOT NULL,
+		pidk VARCHAR(128) NOT NULL,
+		sqrl_only BOOLEAN NOT NULL,
+		hardlock BOOLEAN NOT NULL,
+		disabled BOOLEAN NOT NULL,
+		rekeyed VARCHAR(64) NOT NULL
+	)`,
+	`INSERT INTO sqrl_identities_v3 (` + sqlIdentityColumns + `) SELECT ` + sqlIdentityColumns + ` FROM sqrl_identities`,
+	`DROP TABLE sqrl_identities`,
+	`ALTER TABLE sqrl_identities_v3 RENAME TO sqrl_identities`,
+	`CREATE INDEX sqrl_identities_pidk ON sqrl_identities (pidk)`,
+}
+
+const sqlIdentityColumns = "idk, suk, vuk, pidk, sqrl_only, hardlock, disabled, rekeyed"
+
+// SQLAuthStore is an AuthStore backed by a database/sql database.
+// The sqrl_identities table is created and kept up to date by
+// versioned migrations that run when the store is created.
+type SQLAuthStore struct {
+	db          *sql.DB
+	placeholder SQLPlaceholder
+}
+
+// NewSQLAuthStore creates the store and migrates the schema. The
+// placeholder must match the parameter style of the db's driver.
+func NewSQLAuthStore(db *sql.DB, placeholder SQLPlaceholder) (*SQLAuthStore, error) {
+	err := migrateSQL(db, placeholder, "authstore", sqlAuthStoreMigrations)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLAuthStore{
+		db:          db,
+		placeholder: placeholder,
+	}, nil
+}
+
+type sqlScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanIdentity(row sqlScanner) (*SqrlIdentity, error) {
+	identity := &SqrlIdentity{}
+	err := row.Scan(
+		&identity.Idk,
+		&identity.Suk,
+		&identity.Vuk,
+		&identity.Pidk,
+		&identity.SQRLOnly,
+		&identity.Hardlock,
+		&identity.Disabled,
+		&identity.Rekeyed,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+// FindIdentity implements AuthStore
+func (s *SQLAuthStore) FindIdentity(idk string) (*SqrlIdentity, error) {
+	return s.FindIdentityContext(context.Background(), idk)
+}
+
+// FindIdentityContext implements AuthStoreContext
+func (s *SQLAuthStore) FindIdentityContext(ctx context.Context, idk string) (*SqrlIdentity, error) {
+	row := s.db.QueryRowContext(ctx, s.placeholder.rebind(`SELECT `+sqlIdentityColumns+` FROM sqrl_identities WHERE idk = ?`), idk)
+	identity, err := scanIdentity(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed finding identity: %v", err)
+	}
+	return identity, nil
+}
+
+// SaveIdentity implements AuthStore. It inserts or updates the identity
+// without relying on database specific upsert syntax.
+func (s *SQLAuthStore) SaveIdentity(identity *SqrlIdentity) error {
+	return s.SaveIdentityContext(context.Background(), identity)
+}
+
+// SaveIdentityContext implements AuthStoreContext
+func (s *SQLAuthStore) SaveIdentityContext(ctx context.Context, identity *SqrlIdentity) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed saving identity: %v", err)
+	}
+	err = s.saveIdentity(ctx, tx, identity)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed saving identity: %v", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed saving identity: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLAuthStore) saveIdentity(ctx context.Context, tx *sql.Tx, identity *SqrlIdentity) error {
+	var exists int
+	err := tx.QueryRowContext(ctx, s.placeholder.rebind(`SELECT 1 FROM sqrl_identities WHERE idk = ?`), identity.Idk).Scan(&exists)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == sql.ErrNoRows {
+		_, err = tx.ExecContext(ctx, s.placeholder.rebind(`INSERT INTO sqrl_identities (`+sqlIdentityColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+			identity.Idk,
+			identity.Suk,
+			identity.Vuk,
+			identity.Pidk,
+			identity.SQRLOnly,
+			identity.Hardlock,
+			identity.Disabled,
+			identity.Rekeyed,
+		)
+		return err
+	}
+	_, err = tx.ExecContext(ctx, s.placeholder.rebind(`UPDATE sqrl_identities SET suk = ?, vuk = ?, pidk = ?, sqrl_only = ?, hardlock = ?, disabled = ?, rekeyed = ? WHERE idk = ?`),
+		identity.Suk,
+		identity.Vuk,
+		identity.Pidk,
+		identity.SQRLOnly,
+		identity.Hardlock,
+		identity.Disabled,
+		identity.Rekeyed,
+		identity.Idk,
+	)
+	return err
+}
+
+// DeleteIdentity implements AuthStore
+func (s *SQLAuthStore) DeleteIdentity(idk string) error {
+	return s.DeleteIdentityContext(context.Background(), idk)
+}
+
+// DeleteIdentityContext implements AuthStoreContext
+func (s *SQLAuthStore) DeleteIdentityContext(ctx context.Context, idk string) error {
+	_, err := s.db.ExecContext(ctx, s.placeholder.rebind(`DELETE FROM sqrl_identities WHERE idk = ?`), idk)
+	if err != nil {
+		return fmt.Errorf("failed deleting identity: %v", err)
+	}
+	return nil
+}
+
+// ListIdentities implements IdentityLister
+func (s *SQLAuthStore) ListIdentities(filter IdentityFilter, after string, limit int) ([]*SqrlIdentity, error) {
+	where := []string{"idk > ?"}
+	args := []interface{}{after}
+	if filter.Disabled != nil {
+		where = append(where, "disabled = ?")
+		args = append(args, *filter.Disabled)
+	}
+	if filter.Rekeyed != nil {
+		if *filter.Rekeyed {
+			where = append(where, "rekeyed <> ''")
+		} else {
+			where = append(where, "rekeyed = ''")
+		}
+	}
+	if filter.SQRLOnly != nil {
+		where = append(where, "sqrl_only = ?")
+		args = append(args, *filter.SQRLOnly)
+	}
+	query := `SELECT ` + sqlIdentityColumns + ` FROM sqrl_identities WHERE ` + strings.Join(where, " AND ") + ` ORDER BY idk`
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+	return s.queryIdentities(query, args...)
+}
+
+// FindIdentitiesByPidk implements IdentityLister
+func (s *SQLAuthStore) FindIdentitiesByPidk(pidk string) ([]*SqrlIdentity, error) {
+	return s.queryIdentities(`SELECT `+sqlIdentityColumns+` FROM sqrl_identities WHERE pidk = ? ORDER BY idk`, pidk)
+}
+
+func (s *SQLAuthStore) queryIdentities(query string, args ...interface{}) ([]*SqrlIdentity, error) {
+	rows, err := s.db.Query(s.placeholder.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing identities: %v", err)
+	}
+	defer rows.Close()
+	identities := make([]*SqrlIdentity, 0)
+	for rows.Next() {
+		identity, err := scanIdentity(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed listing identities: %v", err)
+		}
+		identities = append(identities, identity)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed listing identities: %v", err)
+	}
+	return identities, nil
+}
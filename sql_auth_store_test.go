@@ -0,0 +1,133 @@
+package ssp
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var sqliteCount int
+
+// openTestSQLite opens a private in-memory SQLite database
+func openTestSQLite(t *testing.T) *sql.DB {
+	sqliteCount++
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%v%d?mode=memory&cache=shared", t.Name(), sqliteCount))
+	if err != nil {
+		t.Fatalf("Failed opening sqlite: %v", err)
+	}
+	// the in-memory database lives as long as a connection is open
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+func TestSQLAuthStore(t *testing.T) {
+	db := openTestSQLite(t)
+	defer db.Close()
+	store, err := NewSQLAuthStore(db, SQLPlaceholderQuestion)
+	if err != nil {
+		t.Fatalf("Failed creating store: %v", err)
+	}
+
+	if _, err := store.FindIdentity("missing"); err != ErrNotFound {
+		t.Fatalf("Expected not found but got %v", err)
+	}
+
+	identity := &SqrlIdentity{
+		Idk:      "idk",
+		Suk:      "suk",
+		Vuk:      "vuk",
+		Pidk:     "pidk",
+		SQRLOnly: true,
+		Hardlock: true,
+		Btn:      2,
+		Ins:      "ins",
+	}
+	if err := store.SaveIdentity(identity); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	found, err := store.FindIdentity("idk")
+	if err != nil {
+		t.Fatalf("Failed find: %v", err)
+	}
+	// per-request values aren't stored
+	expected := *identity
+	expected.Btn = 0
+	expected.Ins = ""
+	if *found != expected {
+		t.Fatalf("Wrong identity %#v expected %#v", found, expected)
+	}
+
+	// update in place
+	found.Disabled = true
+	found.Rekeyed = "newidk"
+	found.SQRLOnly = false
+	if err := store.SaveIdentity(found); err != nil {
+		t.Fatalf("Failed update: %v", err)
+	}
+	updated, _ := store.FindIdentity("idk")
+	if *updated != *found {
+		t.Fatalf("Wrong updated identity %#v expected %#v", updated, found)
+	}
+
+	if err := store.DeleteIdentity("idk"); err != nil {
+		t.Fatalf("Failed delete: %v", err)
+	}
+	if _, err := store.FindIdentity("idk"); err != ErrNotFound {
+		t.Fatalf("Expected not found after delete but got %v", err)
+	}
+}
+
+func TestSQLMigrations(t *testing.T) {
+	db := openTestSQLite(t)
+	defer db.Close()
+
+	migrations := []string{
+		`CREATE TABLE migrated (a INTEGER)`,
+	}
+	if err := migrateSQL(db, SQLPlaceholderQuestion, "test", migrations); err != nil {
+		t.Fatalf("Failed migrate: %v", err)
+	}
+	// running again is a no-op
+	if err := migrateSQL(db, SQLPlaceholderQuestion, "test", migrations); err != nil {
+		t.Fatalf("Failed second migrate: %v", err)
+	}
+	// a failed migration isn't recorded
+	migrations = append(migrations, `ALTER TABLE missing ADD COLUMN b INTEGER`)
+	if err := migrateSQL(db, SQLPlaceholderQuestion, "test", migrations); err == nil {
+		t.Fatalf("Expected migration failure")
+	}
+	migrations[1] = `ALTER TABLE migrated ADD COLUMN b INTEGER`
+	if err := migrateSQL(db, SQLPlaceholderQuestion, "test", migrations); err != nil {
+		t.Fatalf("Failed fixed migrate: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO migrated (a, b) VALUES (1, 2)`); err != nil {
+		t.Fatalf("Migration not applied: %v", err)
+	}
+	// older code refuses a newer schema
+	if err := migrateSQL(db, SQLPlaceholderQuestion, "test", migrations[:1]); err == nil {
+		t.Fatalf("Expected error for newer schema")
+	}
+}
+
+func TestSQLRebind(t *testing.T) {
+	query := `UPDATE t SET a = ?, b = ? WHERE c = ?`
+	if SQLPlaceholderQuestion.rebind(query) != query {
+		t.Fatalf("Question placeholder changed the query")
+	}
+	expected := `UPDATE t SET a = $1, b = $2 WHERE c = $3`
+	if rebound := SQLPlaceholderDollar.rebind(query); rebound != expected {
+		t.Fatalf("Wrong rebind %v", rebound)
+	}
+}
+
+func TestSQLAuthStoreLister(t *testing.T) {
+	db := openTestSQLite(t)
+	defer db.Close()
+	store, err := NewSQLAuthStore(db, SQLPlaceholderQuestion)
+	if err != nil {
+		t.Fatalf("Failed creating store: %v", err)
+	}
+	testIdentityLister(t, store)
+}
@@ -0,0 +1,204 @@
+package ssp
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// sqlHoardMigrations are the schema versions of the hoard table.
+// Only ever append to this list.
+var sqlHoardMigrations = []string{
+	`CREATE TABLE sqrl_hoard (
+		nut VARCHAR(128) NOT NULL PRIMARY KEY,
+		value TEXT NOT NULL,
+		expires_at BIGINT NOT NULL
+	)`,
+	`CREATE INDEX sqrl_hoard_expires_at ON sqrl_hoard (expires_at)`,
+}
+
+// SQLHoard is a Hoard backed by a database/sql database for deployments
+// without a cache tier. Values are stored as JSON with their expiration
+// in unix nanoseconds. Expired rows are never returned and are deleted
+// by a background sweeper.
+type SQLHoard struct {
+	db          *sql.DB
+	placeholder SQLPlaceholder
+	cancel      context.CancelFunc
+	stopped     chan struct{}
+}
+
+// NewSQLHoard creates the hoard and migrates the schema. The placeholder
+// must match the parameter style of the db's driver. Expired rows are
+// deleted every sweepInterval until Close is called. A sweepInterval of
+// zero or less starts no sweeper so the caller must call Sweep itself.
+// Close doesn't close the db.
+func NewSQLHoard(db *sql.DB, placeholder SQLPlaceholder, sweepInterval time.Duration) (*SQLHoard, error) {
+	return NewSQLHoardContext(context.Background(), db, placeholder, sweepInterval)
+}
+
+// NewSQLHoardContext is like NewSQLHoard but the sweeper
+// stops when ctx is done or Close is called.
+func NewSQLHoardContext(ctx context.Context, db *sql.DB, placeholder SQLPlaceholder, sweepInterval time.Duration) (*SQLHoard, error) {
+	err := migrateSQL(db, placeholder, "hoard", sqlHoardMigrations)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	sh := &SQLHoard{
+		db:          db,
+		placeholder: placeholder,
+		cancel:      cancel,
+		stopped:     make(chan struct{}),
+	}
+	if sweepInterval <= 0 {
+		close(sh.stopped)
+		return sh, nil
+	}
+	go sh.sweeper(ctx, sweepInterval)
+	return sh, nil
+}
+
+// Close implements io.Closer. It stops the sweeper
+// and waits for it to finish.
+func (sh *SQLHoard) Close() error {
+	sh.cancel()
+	<-sh.stopped
+	return nil
+}
+
+func (sh *SQLHoard) sweeper(ctx context.Context, interval time.Duration) {
+	defer close(sh.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		_, err := sh.Sweep()
+		if err != nil {
+			log.Printf("Failed sweeping hoard: %v", err)
+		}
+	}
+}
+
+// Sweep deletes the expired rows and returns how many were deleted
+func (sh *SQLHoard) Sweep() (int64, error) {
+	result, err := sh.db.Exec(sh.placeholder.rebind(`DELETE FROM sqrl_hoard WHERE expires_at < ?`), time.Now().UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("failed deleting expired nuts: %v", err)
+	}
+	return result.RowsAffected()
+}
+
+func decodeHoardRow(value string, expiresAt int64) (*HoardCache, error) {
+	if time.Unix(0, expiresAt).Before(time.Now()) {
+		return nil, ErrNotFound
+	}
+	hoardCache := &HoardCache{}
+	err := json.Unmarshal([]byte(value), hoardCache)
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding hoard value: %v", err)
+	}
+	return hoardCache, nil
+}
+
+// Get implements Hoard
+func (sh *SQLHoard) Get(nut Nut) (*HoardCache, error) {
+	return sh.GetContext(context.Background(), nut)
+}
+
+// GetContext implements HoardContext
+func (sh *SQLHoard) GetContext(ctx context.Context, nut Nut) (*HoardCache, error) {
+	var value string
+	var expiresAt int64
+	err := sh.db.QueryRowContext(ctx, sh.placeholder.rebind(`SELECT value, expires_at FROM sqrl_hoard WHERE nut = ?`), string(nut)).Scan(&value, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed reading nut: %v", err)
+	}
+	return decodeHoardRow(value, expiresAt)
+}
+
+// GetAndDelete implements Hoard. The row is read and deleted in a
+// transaction and only returned if this call was the one that deleted
+// it so concurrent requests with the same nut can't both succeed.
+func (sh *SQLHoard) GetAndDelete(nut Nut) (*HoardCache, error) {
+	return sh.GetAndDeleteContext(context.Background(), nut)
+}
+
+// GetAndDeleteContext implements HoardContext
+func (sh *SQLHoard) GetAndDeleteContext(ctx context.Context, nut Nut) (*HoardCache, error) {
+	tx, err := sh.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading nut: %v", err)
+	}
+	defer tx.Rollback()
+	var value string
+	var expiresAt int64
+	err = tx.QueryRowContext(ctx, sh.placeholder.rebind(`SELECT value, expires_at FROM sqrl_hoard WHERE nut = ?`), string(nut)).Scan(&value, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed reading nut: %v", err)
+	}
+	result, err := tx.ExecContext(ctx, sh.placeholder.rebind(`DELETE FROM sqrl_hoard WHERE nut = ?`), string(nut))
+	if err != nil {
+		return nil, fmt.Errorf("failed deleting nut: %v", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed deleting nut: %v", err)
+	}
+	if deleted != 1 {
+		// deleted by a concurrent request
+		return nil, ErrNotFound
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed deleting nut: %v", err)
+	}
+	return decodeHoardRow(value, expiresAt)
+}
+
+// Save implements Hoard
+func (sh *SQLHoard) Save(nut Nut, value *HoardCache, expiration time.Duration) error {
+	return sh.SaveContext(context.Background(), nut, value, expiration)
+}
+
+// SaveContext implements HoardContext
+func (sh *SQLHoard) SaveContext(ctx context.Context, nut Nut, value *HoardCache, expiration time.Duration) error {
+	if nut == "" {
+		return fmt.Errorf("empty nuts are not allowed")
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed encoding hoard value: %v", err)
+	}
+	tx, err := sh.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed saving nut: %v", err)
+	}
+	defer tx.Rollback()
+	// delete and insert rather than a database specific upsert
+	_, err = tx.ExecContext(ctx, sh.placeholder.rebind(`DELETE FROM sqrl_hoard WHERE nut = ?`), string(nut))
+	if err == nil {
+		_, err = tx.ExecContext(ctx, sh.placeholder.rebind(`INSERT INTO sqrl_hoard (nut, value, expires_at) VALUES (?, ?, ?)`),
+			string(nut), string(encoded), time.Now().Add(expiration).UnixNano())
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return fmt.Errorf("failed saving nut: %v", err)
+	}
+	return nil
+}
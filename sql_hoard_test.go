@@ -0,0 +1,121 @@
+package ssp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSQLHoard(t *testing.T) {
+	db := openTestSQLite(t)
+	defer db.Close()
+	h, err := NewSQLHoard(db, SQLPlaceholderQuestion, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed creating hoard: %v", err)
+	}
+	defer h.Close()
+
+	hoardCache := &HoardCache{
+		State:        "issued",
+		RemoteIP:     "192.0.2.1",
+		OriginalNut:  "nut",
+		PagNut:       "pag",
+		Identity:     &SqrlIdentity{Idk: "idk"},
+		LastResponse: []byte("response"),
+	}
+	if err := h.Save(Nut("nut"), hoardCache, time.Minute); err != nil {
+		t.Fatalf("Failed save: %v", err)
+	}
+	// saving again replaces the value
+	if err := h.Save(Nut("nut"), hoardCache, time.Minute); err != nil {
+		t.Fatalf("Failed replace: %v", err)
+	}
+
+	val, err := h.Get(Nut("nut"))
+	if err != nil {
+		t.Fatalf("Failed get: %v", err)
+	}
+	if val.State != "issued" || val.PagNut != "pag" || val.Identity.Idk != "idk" || string(val.LastResponse) != "response" {
+		t.Fatalf("Wrong value: %#v", val)
+	}
+	val, err = h.GetAndDelete(Nut("nut"))
+	if err != nil || val.OriginalNut != "nut" {
+		t.Fatalf("Failed get and delete: %v %v", val, err)
+	}
+	if _, err := h.GetAndDelete(Nut("nut")); err != ErrNotFound {
+		t.Fatalf("Expected not found but got %v", err)
+	}
+}
+
+func TestSQLHoardExpired(t *testing.T) {
+	db := openTestSQLite(t)
+	defer db.Close()
+	h, err := NewSQLHoard(db, SQLPlaceholderQuestion, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed creating hoard: %v", err)
+	}
+	defer h.Close()
+
+	h.Save(Nut("expired"), &HoardCache{}, 0)
+	h.Save(Nut("kept"), &HoardCache{}, time.Minute)
+	time.Sleep(time.Microsecond)
+	if _, err := h.Get(Nut("expired")); err != ErrNotFound {
+		t.Fatalf("Expected expired but got %v", err)
+	}
+	if _, err := h.GetAndDelete(Nut("expired")); err != ErrNotFound {
+		t.Fatalf("Expected expired but got %v", err)
+	}
+
+	h.Save(Nut("expired"), &HoardCache{}, 0)
+	time.Sleep(time.Microsecond)
+	swept, err := h.Sweep()
+	if err != nil || swept != 1 {
+		t.Fatalf("Expected 1 swept but got %v %v", swept, err)
+	}
+	if _, err := h.Get(Nut("kept")); err != nil {
+		t.Fatalf("Swept unexpired value: %v", err)
+	}
+}
+
+func TestSQLHoardSweeper(t *testing.T) {
+	db := openTestSQLite(t)
+	defer db.Close()
+	h, err := NewSQLHoard(db, SQLPlaceholderQuestion, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed creating hoard: %v", err)
+	}
+	h.Save(Nut("expired"), &HoardCache{}, 0)
+
+	var count int
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		db.QueryRow(`SELECT COUNT(*) FROM sqrl_hoard`).Scan(&count)
+		if count == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count != 0 {
+		t.Fatalf("Sweeper didn't delete expired row")
+	}
+	if err := h.Close(); err != nil {
+		t.Fatalf("Failed close: %v", err)
+	}
+}
+
+func TestSQLHoardNoSweeper(t *testing.T) {
+	db := openTestSQLite(t)
+	defer db.Close()
+	h, err := NewSQLHoard(db, SQLPlaceholderQuestion, 0)
+	if err != nil {
+		t.Fatalf("Failed creating hoard: %v", err)
+	}
+	h.Save(Nut("expired"), &HoardCache{}, 0)
+	time.Sleep(time.Microsecond)
+	swept, err := h.Sweep()
+	if err != nil || swept != 1 {
+		t.Fatalf("Expected 1 swept but got %v %v", swept, err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatalf("Failed close: %v", err)
+	}
+}
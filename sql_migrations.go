@@ -0,0 +1,82 @@
+package ssp
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SQLPlaceholder is the style of bind parameters used by a database driver
+type SQLPlaceholder int
+
+const (
+	// SQLPlaceholderQuestion uses ? for parameters (SQLite, MySQL)
+	SQLPlaceholderQuestion SQLPlaceholder = iota
+	// SQLPlaceholderDollar uses $1, $2... for parameters (PostgreSQL)
+	SQLPlaceholderDollar
+)
+
+// rebind replaces the ? parameters in query with the placeholder style
+func (p SQLPlaceholder) rebind(query string) string {
+	if p != SQLPlaceholderDollar {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// sqlMigrationsTable records the applied schema versions of each component
+const sqlMigrationsTable = "sqrl_schema_migrations"
+
+// migrateSQL applies the migrations of a component that haven't been
+// applied yet. Version N is migrations[N-1] and each one is applied in
+// its own transaction along with recording the version. Migrations
+// must only ever be appended.
+func migrateSQL(db *sql.DB, placeholder SQLPlaceholder, component string, migrations []string) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + sqlMigrationsTable + ` (
+		component VARCHAR(64) NOT NULL,
+		version INTEGER NOT NULL,
+		PRIMARY KEY (component, version)
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed creating migrations table: %v", err)
+	}
+	var current sql.NullInt64
+	err = db.QueryRow(placeholder.rebind(`SELECT MAX(version) FROM `+sqlMigrationsTable+` WHERE component = ?`), component).Scan(&current)
+	if err != nil {
+		return fmt.Errorf("failed reading %v schema version: %v", component, err)
+	}
+	if int(current.Int64) > len(migrations) {
+		return fmt.Errorf("%v schema version %d is newer than this code supports (%d)", component, current.Int64, len(migrations))
+	}
+	for i := int(current.Int64); i < len(migrations); i++ {
+		version := i + 1
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed starting %v migration %d: %v", component, version, err)
+		}
+		_, err = tx.Exec(migrations[i])
+		if err == nil {
+			_, err = tx.Exec(placeholder.rebind(`INSERT INTO `+sqlMigrationsTable+` (component, version) VALUES (?, ?)`), component, version)
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+		if err != nil {
+			return fmt.Errorf("failed %v migration %d: %v", component, version, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,355 @@
+package ssp
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Webhook event types sent in WebhookEvent.Type
+const (
+	WebhookEventAuthenticate = "authenticate"
+	WebhookEventSwap         = "swap"
+	WebhookEventRemove       = "remove"
+	WebhookEventAsk          = "ask"
+)
+
+// WebhookSignatureHeader holds the HMAC signature of a webhook request
+// in the form "t=<unix seconds>,v1=<hex HMAC-SHA256 of t.body>"
+const WebhookSignatureHeader = "X-Sqrl-Signature"
+
+// largest response body read from the user service
+const webhookMaxResponse = 1 << 20
+
+// WebhookEvent is the JSON body POSTed by a WebhookAuthenticator
+type WebhookEvent struct {
+	// ID is unique per event and is the same across retries so
+	// the user service can ignore duplicates. A non-CPS login sends
+	// two authenticate events; see WebhookAuthenticator.
+	ID               string        `json:"id"`
+	Type             string        `json:"type"`
+	Time             int64         `json:"time"`
+	Identity         *SqrlIdentity `json:"identity"`
+	PreviousIdentity *SqrlIdentity `json:"previousIdentity,omitempty"`
+	// Btn is the ask button the user pressed if there was one
+	Btn int `json:"btn,omitempty"`
+}
+
+// WebhookResponse is the JSON body expected from the user service.
+// An empty body is the same as an empty response.
+type WebhookResponse struct {
+	// URL is the redirect for an authenticate event.
+	// It must be an absolute http or https URL.
+	URL string `json:"url,omitempty"`
+	// Ask is sent to the SQRL client for an ask event
+	Ask *Ask `json:"ask,omitempty"`
+	// Error may be "locked" or "banned" with a 403 status
+	Error string `json:"error,omitempty"`
+}
+
+// WebhookAuthenticator is an Authenticator that sends each event to an
+// external user service so the SSP service can run on its own. Events are
+// POSTed as a WebhookEvent signed with Secret. A 2xx response is success
+// and the body is decoded as a WebhookResponse. A 403 refuses the event,
+// network errors and 429 or 5xx responses are retried, and all other
+// responses are failures. Retries that run out are reported as transient
+// errors so the SQRL client can try again.
+//
+// A login without CPS sends two authenticate events with different IDs:
+// one when the SQRL client idents, which can refuse the login, and one
+// when the browser polls /pag.sqrl. Only the URL from the second is used.
+type WebhookAuthenticator struct {
+	// AuthenticateURL, SwapURL and RemoveURL receive those events
+	AuthenticateURL string
+	SwapURL         string
+	RemoveURL       string
+	// AskURL receives ask events. If empty, no Ask is sent to the client.
+	AskURL string
+	// Secret is the HMAC key used to sign requests
+	Secret []byte
+	// ErrorURL is returned by AuthenticateIdentity when the user
+	// service fails. AuthenticateIdentityWithError is used by
+	// SqrlSspAPI so this is only for other callers.
+	ErrorURL string
+	// Client sends the requests
+	Client *http.Client
+	// Retries is the number of times a failed request is retried
+	Retries int
+	// RetryDelay is the wait before the first retry. It doubles for each retry.
+	RetryDelay time.Duration
+}
+
+// NewWebhookAuthenticator creates a WebhookAuthenticator that sends
+// events to baseURL with the event type appended as a path, for example
+// https://users.example.com/sqrl/authenticate. Requests are signed with secret.
+func NewWebhookAuthenticator(baseURL string, secret []byte) *WebhookAuthenticator {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	return &WebhookAuthenticator{
+		AuthenticateURL: baseURL + "/" + WebhookEventAuthenticate,
+		SwapURL:         baseURL + "/" + WebhookEventSwap,
+		RemoveURL:       baseURL + "/" + WebhookEventRemove,
+		AskURL:          baseURL + "/" + WebhookEventAsk,
+		Secret:          secret,
+		Client:          &http.Client{Timeout: 10 * time.Second},
+		Retries:         2,
+		RetryDelay:      100 * time.Millisecond,
+	}
+}
+
+// AuthenticateIdentity implements Authenticator
+func (wa *WebhookAuthenticator) AuthenticateIdentity(identity *SqrlIdentity) string {
+	return wa.AuthenticateIdentityContext(context.Background(), identity)
+}
+
+// AuthenticateIdentityContext implements AuthenticatorContext
+func (wa *WebhookAuthenticator) AuthenticateIdentityContext(ctx context.Context, identity *SqrlIdentity) string {
+	redirect, err := wa.AuthenticateIdentityWithError(ctx, identity)
+	if err != nil {
+		log.Printf("Webhook authenticate failed: %v", err)
+		return wa.ErrorURL
+	}
+	return redirect
+}
+
+// AuthenticateIdentityWithError implements AuthenticatorWithError
+func (wa *WebhookAuthenticator) AuthenticateIdentityWithError(ctx context.Context, identity *SqrlIdentity) (string, error) {
+	response, err := wa.send(ctx, wa.AuthenticateURL, &WebhookEvent{
+		Type:     WebhookEventAuthenticate,
+		Identity: identity,
+	})
+	if err != nil {
+		return "", err
+	}
+	if response.URL == "" {
+		return "", fmt.Errorf("webhook authenticate response has no url")
+	}
+	err = checkWebhookURL(response.URL)
+	if err != nil {
+		return "", err
+	}
+	return response.URL, nil
+}
+
+// checkWebhookURL rejects a redirect that isn't an absolute http(s) URL.
+// It's sent to the SQRL client in the CRLF delimited CPS response
+// so a line break would let the user service add other fields.
+func checkWebhookURL(redirect string) error {
+	if strings.ContainsAny(redirect, "\r\n") {
+		return fmt.Errorf("webhook authenticate url contains a line break")
+	}
+	parsed, err := url.Parse(redirect)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("webhook authenticate url %q isn't an absolute http(s) url", redirect)
+	}
+	return nil
+}
+
+// SwapIdentities implements Authenticator
+func (wa *WebhookAuthenticator) SwapIdentities(previousIdentity, newIdentity *SqrlIdentity) error {
+	return wa.SwapIdentitiesContext(context.Background(), previousIdentity, newIdentity)
+}
+
+// SwapIdentitiesContext implements AuthenticatorContext
+func (wa *WebhookAuthenticator) SwapIdentitiesContext(ctx context.Context, previousIdentity, newIdentity *SqrlIdentity) error {
+	_, err := wa.send(ctx, wa.SwapURL, &WebhookEvent{
+		Type:             WebhookEventSwap,
+		Identity:         newIdentity,
+		PreviousIdentity: previousIdentity,
+	})
+	return err
+}
+
+// RemoveIdentity implements Authenticator
+func (wa *WebhookAuthenticator) RemoveIdentity(identity *SqrlIdentity) error {
+	return wa.RemoveIdentityContext(context.Background(), identity)
+}
+
+// RemoveIdentityContext implements AuthenticatorContext
+func (wa *WebhookAuthenticator) RemoveIdentityContext(ctx context.Context, identity *SqrlIdentity) error {
+	_, err := wa.send(ctx, wa.RemoveURL, &WebhookEvent{
+		Type:     WebhookEventRemove,
+		Identity: identity,
+	})
+	return err
+}
+
+// AskResponse implements Authenticator
+func (wa *WebhookAuthenticator) AskResponse(identity *SqrlIdentity) *Ask {
+	return wa.AskResponseContext(context.Background(), identity)
+}
+
+// AskResponseContext implements AuthenticatorContext. A failed
+// request is logged and no Ask is sent to the client.
+func (wa *WebhookAuthenticator) AskResponseContext(ctx context.Context, identity *SqrlIdentity) *Ask {
+	if wa.AskURL == "" {
+		return nil
+	}
+	event := &WebhookEvent{
+		Type:     WebhookEventAsk,
+		Identity: identity,
+	}
+	if identity.Btn > 0 {
+		event.Btn = identity.Btn
+	}
+	response, err := wa.send(ctx, wa.AskURL, event)
+	if err != nil {
+		log.Printf("Webhook ask failed: %v", err)
+		return nil
+	}
+	return response.Ask
+}
+
+// send POSTs the event to url and retries failures that may succeed later
+func (wa *WebhookAuthenticator) send(ctx context.Context, url string, event *WebhookEvent) (*WebhookResponse, error) {
+	id, err := webhookEventID()
+	if err != nil {
+		return nil, err
+	}
+	event.ID = id
+	event.Time = time.Now().Unix()
+	body, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed encoding webhook event: %v", err)
+	}
+
+	delay := wa.RetryDelay
+	for attempt := 0; ; attempt++ {
+		response, retry, err := wa.post(ctx, url, body)
+		if err == nil {
+			return response, nil
+		}
+		if !retry {
+			return nil, err
+		}
+		if attempt >= wa.Retries {
+			return nil, NewTransientError(err)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, NewTransientError(ctx.Err())
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// post makes a single request. retry is true if the error may not happen again.
+func (wa *WebhookAuthenticator) post(ctx context.Context, url string, body []byte) (response *WebhookResponse, retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed creating webhook request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(wa.Secret, time.Now(), body))
+
+	client := wa.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, ctx.Err() == nil, fmt.Errorf("webhook request to %v failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, webhookMaxResponse))
+	if err != nil {
+		return nil, true, fmt.Errorf("failed reading webhook response: %v", err)
+	}
+
+	response = &WebhookResponse{}
+	if len(bytes.TrimSpace(respBody)) > 0 {
+		// error responses may not be JSON so only fail on success
+		decodeErr := json.Unmarshal(respBody, response)
+		if decodeErr != nil && resp.StatusCode/100 == 2 {
+			return nil, false, fmt.Errorf("failed decoding webhook response: %v", decodeErr)
+		}
+	}
+	switch {
+	case resp.StatusCode/100 == 2:
+		return response, false, nil
+	case resp.StatusCode == http.StatusForbidden && response.Error == "locked":
+		return nil, false, ErrAccountLocked
+	case resp.StatusCode == http.StatusForbidden && response.Error == "banned":
+		return nil, false, ErrUserBanned
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5:
+		return nil, true, fmt.Errorf("webhook %v responded %v", url, resp.StatusCode)
+	}
+	return nil, false, fmt.Errorf("webhook %v responded %v", url, resp.StatusCode)
+}
+
+func webhookEventID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("failed creating webhook event id: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func webhookMAC(secret []byte, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// SignWebhook returns the WebhookSignatureHeader value for body
+func SignWebhook(secret []byte, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + t + ",v1=" + hex.EncodeToString(webhookMAC(secret, t, body))
+}
+
+// VerifyWebhook checks the WebhookSignatureHeader value for body and that
+// it was signed within tolerance of now. User services receiving events
+// from a WebhookAuthenticator should call this before trusting them.
+func VerifyWebhook(secret []byte, header string, body []byte, tolerance time.Duration) error {
+	var timestamp string
+	var signatures [][]byte
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			sig, err := hex.DecodeString(kv[1])
+			if err == nil {
+				signatures = append(signatures, sig)
+			}
+		}
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid webhook signature timestamp")
+	}
+	age := time.Since(time.Unix(seconds, 0))
+	if age > tolerance || age < -tolerance {
+		return fmt.Errorf("webhook signature timestamp outside tolerance")
+	}
+	expected := webhookMAC(secret, timestamp, body)
+	for _, sig := range signatures {
+		if hmac.Equal(sig, expected) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid webhook signature")
+}
@@ -0,0 +1,228 @@
+package ssp
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookServer is a stand-in user service that records verified events
+type webhookServer struct {
+	*httptest.Server
+	mutex  sync.Mutex
+	events []*WebhookEvent
+	// respond writes the response for the nth request to a path
+	respond func(w http.ResponseWriter, event *WebhookEvent, n int)
+}
+
+func newWebhookServer(t *testing.T, secret []byte) *webhookServer {
+	ws := &webhookServer{}
+	counts := make(map[string]int)
+	ws.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		err := VerifyWebhook(secret, r.Header.Get(WebhookSignatureHeader), body, time.Minute)
+		if err != nil {
+			t.Errorf("Failed verifying webhook: %v", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		event := &WebhookEvent{}
+		err = json.Unmarshal(body, event)
+		if err != nil || "/"+event.Type != r.URL.Path {
+			t.Errorf("Bad event for %v: %v %v", r.URL.Path, string(body), err)
+		}
+		ws.mutex.Lock()
+		ws.events = append(ws.events, event)
+		counts[r.URL.Path]++
+		n := counts[r.URL.Path]
+		ws.mutex.Unlock()
+		ws.respond(w, event, n)
+	}))
+	return ws
+}
+
+func (ws *webhookServer) received() []*WebhookEvent {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	return append([]*WebhookEvent(nil), ws.events...)
+}
+
+func TestWebhookAuthenticator(t *testing.T) {
+	secret := []byte("secret")
+	server := newWebhookServer(t, secret)
+	defer server.Close()
+	server.respond = func(w http.ResponseWriter, event *WebhookEvent, n int) {
+		switch event.Type {
+		case WebhookEventAuthenticate:
+			json.NewEncoder(w).Encode(&WebhookResponse{URL: "https://example.com/login?user=" + event.Identity.Idk})
+		case WebhookEventAsk:
+			json.NewEncoder(w).Encode(&WebhookResponse{Ask: &Ask{Message: "Hello", Button1: "OK"}})
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+	wa := NewWebhookAuthenticator(server.URL+"/", secret)
+
+	redirect, err := wa.AuthenticateIdentityWithError(context.Background(), &SqrlIdentity{Idk: "idk"})
+	if err != nil || redirect != "https://example.com/login?user=idk" {
+		t.Fatalf("Wrong authenticate redirect %v: %v", redirect, err)
+	}
+	if redirect := wa.AuthenticateIdentity(&SqrlIdentity{Idk: "other"}); redirect != "https://example.com/login?user=other" {
+		t.Fatalf("Wrong authenticate redirect %v", redirect)
+	}
+	if err := wa.SwapIdentities(&SqrlIdentity{Idk: "old"}, &SqrlIdentity{Idk: "new"}); err != nil {
+		t.Fatalf("Failed swap: %v", err)
+	}
+	if err := wa.RemoveIdentity(&SqrlIdentity{Idk: "new"}); err != nil {
+		t.Fatalf("Failed remove: %v", err)
+	}
+	ask := wa.AskResponse(&SqrlIdentity{Idk: "new", Btn: 2})
+	if ask == nil || ask.Message != "Hello" || ask.Button1 != "OK" {
+		t.Fatalf("Wrong ask %#v", ask)
+	}
+
+	events := server.received()
+	if len(events) != 5 {
+		t.Fatalf("Expected 5 events but got %v", len(events))
+	}
+	swap := events[2]
+	if swap.Identity.Idk != "new" || swap.PreviousIdentity == nil || swap.PreviousIdentity.Idk != "old" {
+		t.Fatalf("Wrong swap event %#v", swap)
+	}
+	if events[4].Btn != 2 {
+		t.Fatalf("Expected ask button 2 but got %v", events[4].Btn)
+	}
+	if events[0].ID == "" || events[0].ID == events[1].ID || events[0].Time == 0 {
+		t.Fatalf("Events should have unique ids and times: %#v %#v", events[0], events[1])
+	}
+
+	wa.AskURL = ""
+	if ask := wa.AskResponse(&SqrlIdentity{Idk: "new"}); ask != nil || len(server.received()) != 5 {
+		t.Fatalf("Expected no ask request without AskURL")
+	}
+}
+
+func TestWebhookAuthenticatorRetry(t *testing.T) {
+	secret := []byte("secret")
+	server := newWebhookServer(t, secret)
+	defer server.Close()
+	server.respond = func(w http.ResponseWriter, event *WebhookEvent, n int) {
+		if event.Type == WebhookEventAuthenticate && n < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if event.Type == WebhookEventRemove {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(&WebhookResponse{URL: "https://example.com/welcome"})
+	}
+	wa := NewWebhookAuthenticator(server.URL, secret)
+	wa.RetryDelay = time.Millisecond
+
+	redirect, err := wa.AuthenticateIdentityWithError(context.Background(), &SqrlIdentity{Idk: "idk"})
+	if err != nil || redirect != "https://example.com/welcome" {
+		t.Fatalf("Expected success after retries but got %v %v", redirect, err)
+	}
+	events := server.received()
+	if len(events) != 3 || events[0].ID != events[2].ID {
+		t.Fatalf("Retries should send the same event: %#v", events)
+	}
+
+	err = wa.RemoveIdentity(&SqrlIdentity{Idk: "idk"})
+	if !IsTransient(err) {
+		t.Fatalf("Expected transient error but got %v", err)
+	}
+	if len(server.received()) != 6 {
+		t.Fatalf("Expected 3 remove attempts but got %v", len(server.received())-3)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := wa.SwapIdentitiesContext(ctx, &SqrlIdentity{Idk: "a"}, &SqrlIdentity{Idk: "b"}); err == nil {
+		t.Fatalf("Expected error from canceled context")
+	}
+}
+
+func TestWebhookAuthenticatorRefused(t *testing.T) {
+	secret := []byte("secret")
+	server := newWebhookServer(t, secret)
+	defer server.Close()
+	server.respond = func(w http.ResponseWriter, event *WebhookEvent, n int) {
+		switch event.Identity.Idk {
+		case "locked", "banned":
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(&WebhookResponse{Error: event.Identity.Idk})
+		case "bad":
+			w.WriteHeader(http.StatusBadRequest)
+		case "relative":
+			json.NewEncoder(w).Encode(&WebhookResponse{URL: "/login"})
+		case "crlf":
+			json.NewEncoder(w).Encode(&WebhookResponse{URL: "https://example.com/login\r\nsuk=injected"})
+		case "script":
+			json.NewEncoder(w).Encode(&WebhookResponse{URL: "javascript:alert(1)"})
+		default:
+			w.Write([]byte("{}"))
+		}
+	}
+	wa := NewWebhookAuthenticator(server.URL, secret)
+	wa.ErrorURL = "/error"
+
+	tests := []struct {
+		idk string
+		err error
+	}{
+		{"locked", ErrAccountLocked},
+		{"banned", ErrUserBanned},
+	}
+	for _, test := range tests {
+		_, err := wa.AuthenticateIdentityWithError(context.Background(), &SqrlIdentity{Idk: test.idk})
+		if err != test.err {
+			t.Fatalf("Expected %v but got %v", test.err, err)
+		}
+	}
+	_, err := wa.AuthenticateIdentityWithError(context.Background(), &SqrlIdentity{Idk: "bad"})
+	if err == nil || IsTransient(err) {
+		t.Fatalf("Expected permanent error but got %v", err)
+	}
+	// a missing or unsafe url is an error
+	for _, idk := range []string{"idk", "relative", "crlf", "script"} {
+		redirect, err := wa.AuthenticateIdentityWithError(context.Background(), &SqrlIdentity{Idk: idk})
+		if err == nil {
+			t.Fatalf("Expected error for %v url but got %q", idk, redirect)
+		}
+	}
+	if redirect := wa.AuthenticateIdentity(&SqrlIdentity{Idk: "bad"}); redirect != "/error" {
+		t.Fatalf("Expected ErrorURL but got %v", redirect)
+	}
+	if len(server.received()) != 8 {
+		t.Fatalf("Refused requests shouldn't be retried")
+	}
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`{"type":"authenticate"}`)
+	header := SignWebhook(secret, time.Now(), body)
+	if err := VerifyWebhook(secret, header, body, time.Minute); err != nil {
+		t.Fatalf("Failed verify: %v", err)
+	}
+	if err := VerifyWebhook([]byte("other"), header, body, time.Minute); err == nil {
+		t.Fatalf("Expected failure with wrong secret")
+	}
+	if err := VerifyWebhook(secret, header, []byte(`{"type":"remove"}`), time.Minute); err == nil {
+		t.Fatalf("Expected failure with changed body")
+	}
+	old := SignWebhook(secret, time.Now().Add(-time.Hour), body)
+	if err := VerifyWebhook(secret, old, body, time.Minute); err == nil {
+		t.Fatalf("Expected failure with old timestamp")
+	}
+	if err := VerifyWebhook(secret, "", body, time.Minute); err == nil {
+		t.Fatalf("Expected failure with no header")
+	}
+}